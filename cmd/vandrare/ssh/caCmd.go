@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/andrebq/vandrare/gateway/ssh"
+	"github.com/andrebq/vandrare/internal/flagutil"
+	"github.com/andrebq/vandrare/internal/store"
+	"github.com/urfave/cli/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func caCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "ca",
+		Usage: "Manage the CA rotation of the gateway",
+		Subcommands: []*cli.Command{
+			caNewSeedCmd(),
+			caFingerprintCmd(),
+			caRetireCmd(),
+		},
+	}
+}
+
+func caNewSeedCmd() *cli.Command {
+	output := ""
+	return &cli.Command{
+		Name:  "new-seed",
+		Usage: "Generates a seed for the next CA, use it with gateway --next-ca-seed-file",
+		Flags: []cli.Flag{
+			flagutil.String(&output, "output", []string{"o"}, "", "Where to write the hex-encoded seed", true),
+		},
+		Action: func(ctx *cli.Context) error {
+			seed, created, err := initCASeed(output)
+			if err != nil {
+				return err
+			} else if !created {
+				return fmt.Errorf("%v already exists, refusing to overwrite it", output)
+			}
+			capub, err := ssh.GenerateCAKey(seed).PublicKey()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(ctx.App.Writer, "Seed written to %v\nCA fingerprint: %v\n", output, gossh.FingerprintSHA256(capub))
+			return nil
+		},
+	}
+}
+
+func caFingerprintCmd() *cli.Command {
+	seed := caSeedSource{name: "ca-seed"}
+	return &cli.Command{
+		Name:  "fingerprint",
+		Usage: "Prints the fingerprint and public key of the CA derived from a seed",
+		Flags: seed.flags(),
+		Action: func(ctx *cli.Context) error {
+			buf, _, err := seed.load()
+			if err != nil {
+				return err
+			}
+			capub, err := ssh.GenerateCAKey(buf).PublicKey()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(ctx.App.Writer, "%v\n%s", gossh.FingerprintSHA256(capub), gossh.MarshalAuthorizedKey(capub))
+			return nil
+		},
+	}
+}
+
+func caRetireCmd() *cli.Command {
+	storeDir := ""
+	fingerprint := ""
+	caSeed := caSeedSource{name: "ca-seed"}
+	nextCASeed := caSeedSource{name: "next-ca-seed", optional: true}
+	return &cli.Command{
+		Name:  "retire",
+		Usage: "Retires a CA, running gateways stop publishing it and sign new certificates with the other CA",
+		Flags: append([]cli.Flag{
+			flagutil.String(&storeDir, "store-dir", nil, envPrefix, "Directory where the gateway keeps its data", true),
+			flagutil.String(&fingerprint, "fingerprint", nil, "", "Fingerprint (SHA256:...) of the CA to retire, must be the one of the CA or of the next CA", true),
+		}, append(caSeed.flags(), nextCASeed.flags()...)...),
+		Action: func(ctx *cli.Context) error {
+			if fingerprint == "" {
+				return errors.New("fingerprint is required")
+			}
+			seed, _, err := caSeed.load()
+			if err != nil {
+				return err
+			}
+			nextSeed, hasNext, err := nextCASeed.load()
+			if err != nil {
+				return err
+			}
+			var next *ssh.CAKey
+			if hasNext {
+				key := ssh.GenerateCAKey(nextSeed)
+				next = &key
+			}
+			st, err := store.Open(storeDir)
+			if err != nil {
+				return err
+			}
+			if err := ssh.RetireCA(ctx.Context, st, fingerprint, ssh.GenerateCAKey(seed), next); err != nil {
+				return err
+			}
+			fmt.Fprintf(ctx.App.Writer, "CA %v retired, once every client trusts the new CA use its seed as --ca-seed and drop --next-ca-seed\n", fingerprint)
+			return nil
+		},
+	}
+}
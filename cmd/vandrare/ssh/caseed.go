@@ -0,0 +1,205 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/andrebq/vandrare/internal/flagutil"
+	"github.com/andrebq/vandrare/internal/keystore"
+	"github.com/urfave/cli/v2"
+)
+
+type (
+	// caSeedSource lists the places where the CA seed can be read from,
+	// at most one of them can be used. Flags are prefixed by name.
+	caSeedSource struct {
+		name     string
+		optional bool
+
+		env        string
+		file       string
+		fd         int
+		keystore   string
+		credential string
+
+		envFlag *cli.StringFlag
+	}
+)
+
+func (s *caSeedSource) flags() []cli.Flag {
+	s.fd = -1
+	s.credential = s.name
+	s.envFlag = flagutil.String(&s.env, s.name, nil, envPrefix, "32-byte, hex-encoded, seed used to generate a ed25519 private key, use the environment variable", false)
+	s.envFlag.Hidden = true
+	return []cli.Flag{
+		s.envFlag,
+		flagutil.String(&s.file, s.name+"-file", nil, envPrefix, "File with the hex-encoded seed, must not be readable by group or others", false),
+		flagutil.Int(&s.fd, s.name+"-fd", nil, envPrefix, "Inherited file descriptor from which the hex-encoded seed is read", false),
+		flagutil.String(&s.keystore, s.name+"-keystore", nil, envPrefix, "Passphrase-encrypted seed, the passphrase is read from the terminal", false),
+		flagutil.String(&s.credential, s.name+"-credential", nil, envPrefix, "Name of the systemd credential (under $CREDENTIALS_DIRECTORY) with the hex-encoded seed", false),
+	}
+}
+
+// load the seed from the configured source, if none is configured
+// the systemd credential is used when $CREDENTIALS_DIRECTORY is set.
+//
+// Optional sources return false (and no error) when nothing is configured.
+func (s *caSeedSource) load() ([ed25519.SeedSize]byte, bool, error) {
+	var seed [ed25519.SeedSize]byte
+	var sources []string
+	for _, v := range []struct {
+		name string
+		set  bool
+	}{
+		{s.name, s.env != ""},
+		{s.name + "-file", s.file != ""},
+		{s.name + "-fd", s.fd >= 0},
+		{s.name + "-keystore", s.keystore != ""},
+	} {
+		if v.set {
+			sources = append(sources, v.name)
+		}
+	}
+	if len(sources) > 1 {
+		return seed, false, fmt.Errorf("only one %v source can be used, got: %v", s.name, sources)
+	}
+
+	var buf []byte
+	var err error
+	switch {
+	case s.env != "":
+		buf = []byte(s.env)
+		// clear the environment
+		for _, v := range s.envFlag.EnvVars {
+			os.Setenv(v, "")
+		}
+	case s.file != "":
+		buf, err = readPrivateFile(s.file)
+	case s.fd >= 0:
+		fd := os.NewFile(uintptr(s.fd), s.name+"-fd")
+		if fd == nil {
+			return seed, false, fmt.Errorf("invalid file descriptor %v", s.fd)
+		}
+		buf, err = io.ReadAll(fd)
+		fd.Close()
+	case s.keystore != "":
+		seed, err = s.openKeystore()
+		return seed, err == nil, err
+	case os.Getenv("CREDENTIALS_DIRECTORY") != "" && s.credential != "":
+		buf, err = os.ReadFile(filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), s.credential))
+		if s.optional && errors.Is(err, os.ErrNotExist) {
+			return seed, false, nil
+		}
+	case s.optional:
+		return seed, false, nil
+	default:
+		return seed, false, fmt.Errorf("missing %v, use one of %v-file, %v-fd, %v-keystore or a systemd credential", s.name, s.name, s.name, s.name)
+	}
+	if err != nil {
+		return seed, false, fmt.Errorf("unable to read %v: %w", s.name, err)
+	}
+	seed, err = decodeSeed(buf)
+	return seed, err == nil, err
+}
+
+func (s *caSeedSource) openKeystore() ([ed25519.SeedSize]byte, error) {
+	var seed [ed25519.SeedSize]byte
+	buf, err := os.ReadFile(s.keystore)
+	if err != nil {
+		return seed, fmt.Errorf("unable to read %v keystore: %w", s.name, err)
+	}
+	passphrase, err := keystore.ReadPassphrase(fmt.Sprintf("Passphrase for %v: ", s.keystore))
+	if err != nil {
+		return seed, err
+	}
+	plain, err := keystore.Open(buf, passphrase)
+	if err != nil {
+		return seed, err
+	}
+	if len(plain) != ed25519.SeedSize {
+		return seed, fmt.Errorf("keystore does not contain a valid %v", s.name)
+	}
+	copy(seed[:], plain)
+	return seed, nil
+}
+
+func decodeSeed(buf []byte) ([ed25519.SeedSize]byte, error) {
+	var seed [ed25519.SeedSize]byte
+	buf = bytes.TrimSpace(buf)
+	if hex.DecodedLen(len(buf)) != ed25519.SeedSize {
+		return seed, errors.New("seed should be 32-byte long, hex-encoded")
+	}
+	if _, err := hex.Decode(seed[:], buf); err != nil {
+		return seed, err
+	}
+	return seed, nil
+}
+
+// readPrivateFile refuses to read files which can be accessed by group or others
+func readPrivateFile(file string) ([]byte, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("permissions %v for %v are too open, use 0600 or 0400", info.Mode().Perm(), file)
+	}
+	return os.ReadFile(file)
+}
+
+func sealCASeedCmd() *cli.Command {
+	seedFile := ""
+	output := ""
+	return &cli.Command{
+		Name:  "seal-ca-seed",
+		Usage: "Encrypts a hex-encoded CA seed file with a passphrase, to be used with gateway --ca-seed-keystore",
+		Flags: []cli.Flag{
+			flagutil.String(&seedFile, "ca-seed-file", nil, "", "File with the hex-encoded CA seed", true),
+			flagutil.String(&output, "output", []string{"o"}, "", "Where to write the encrypted keystore", true),
+		},
+		Action: func(ctx *cli.Context) error {
+			buf, err := readPrivateFile(seedFile)
+			if err != nil {
+				return err
+			}
+			seed, err := decodeSeed(buf)
+			if err != nil {
+				return err
+			}
+			passphrase, err := keystore.ReadPassphrase("New passphrase: ")
+			if err != nil {
+				return err
+			}
+			confirm, err := keystore.ReadPassphrase("Confirm passphrase: ")
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(passphrase, confirm) {
+				return errors.New("passphrases do not match")
+			} else if len(passphrase) == 0 {
+				return errors.New("passphrase cannot be empty")
+			}
+			sealed, err := keystore.Seal(seed[:], passphrase, keystore.DefaultParams())
+			if err != nil {
+				return err
+			}
+			created, err := writeNewFile(output, 0600, func(w io.Writer) error {
+				_, err := w.Write(sealed)
+				return err
+			})
+			if err != nil {
+				return err
+			} else if !created {
+				return fmt.Errorf("%v already exists, refusing to overwrite it", output)
+			}
+			fmt.Fprintf(ctx.App.Writer, "Keystore written to %v, %v can now be removed\n", output, seedFile)
+			return nil
+		},
+	}
+}
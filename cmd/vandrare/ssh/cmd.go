@@ -1,10 +1,13 @@
 package ssh
 
 import (
-	"crypto/ed25519"
-	"encoding/hex"
-	"errors"
+	"context"
+	"encoding/json"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/andrebq/vandrare/gateway/ssh"
 	"github.com/andrebq/vandrare/internal/flagutil"
@@ -21,70 +24,152 @@ func Cmd() *cli.Command {
 		Subcommands: []*cli.Command{
 			gatewayCmd(),
 			configCmd(),
+			initCmd(),
+			sealCASeedCmd(),
+			caCmd(),
+			tokenCmd(),
 		},
 	}
 }
 
 func gatewayCmd() *cli.Command {
-	bind := "127.0.0.1:2222"
-	bindHTTP := "127.0.0.1:8222"
+	cfg := ssh.DefaultConfig()
+	configFile := ""
 	adminKeyFile := ""
-	kdbStoreDir := ""
-	caSeed := ""
-	caSeedFlag := flagutil.String(&caSeed, "ca-seed", nil, envPrefix, "32-byte, hex-encoded, seed used to generate a ed25519 private key, use the environment variable", true)
-	caSeedFlag.Hidden = true
+	caSeed := caSeedSource{name: "ca-seed"}
+	nextCASeed := caSeedSource{name: "next-ca-seed", optional: true}
+	proxyUpstreams := cli.StringSlice{}
 
 	subdomains := cli.StringSlice{}
 	selfDomains := cli.StringSlice{}
+
+	// loadConfig merges flags and the config file (if any), values from the file take precedence
+	loadConfig := func() (ssh.Config, error) {
+		base := cfg
+		base.Domains = selfDomains.Value()
+		base.Subdomains = subdomains.Value()
+		base.Network.ProxyProtocol.TrustedUpstreams = proxyUpstreams.Value()
+		if adminKeyFile != "" {
+			base.AdminKeyFiles = []string{adminKeyFile}
+		}
+		if configFile == "" {
+			return base, nil
+		}
+		return ssh.LoadConfig(configFile, base)
+	}
+
 	return &cli.Command{
 		Name:  "gateway",
 		Usage: "Starts the SSH gateway",
-		Flags: []cli.Flag{
-			flagutil.String(&bind, "bind-addr", []string{"b"}, envPrefix, "Address to listen for incoming requests", false),
-			flagutil.String(&adminKeyFile, "admin-key-file", nil, envPrefix, "SSH public key file used for admin access", true),
-			flagutil.String(&kdbStoreDir, "keydb-store-dir", nil, envPrefix, "Directory where key database is kept", true),
-			flagutil.String(&bindHTTP, "bind-http-addr", []string{"bh"}, envPrefix, "Address to listen for HTTP Requests", false),
-			flagutil.StringSlice(&selfDomains, "self-domain", []string{"self"}, envPrefix, "Address (domain:port) of the gateway itself. Must be a value recognized by clients", true),
-			flagutil.StringSlice(&subdomains, "domain", []string{"d"}, envPrefix, "One or more sub-domains which can be authorized by this gateway", true),
-			caSeedFlag,
+		Flags: append([]cli.Flag{
+			flagutil.String(&configFile, "config-file", []string{"c"}, envPrefix, "JSON file with the gateway configuration, values in the file override flags", false),
+			flagutil.String(&cfg.Bindings.SSH, "bind-addr", []string{"b"}, envPrefix, "Address to listen for incoming requests", false),
+			flagutil.String(&adminKeyFile, "admin-key-file", nil, envPrefix, "SSH public key file used for admin access", false),
+			flagutil.String(&cfg.StoreDir, "keydb-store-dir", nil, envPrefix, "Directory where key database is kept", false),
+			flagutil.String(&cfg.Bindings.HTTP, "bind-http-addr", []string{"bh"}, envPrefix, "Address to listen for HTTP Requests", false),
+			flagutil.StringSlice(&selfDomains, "self-domain", []string{"self"}, envPrefix, "Address (domain:port) of the gateway itself. Must be a value recognized by clients", false),
+			flagutil.StringSlice(&subdomains, "domain", []string{"d"}, envPrefix, "One or more sub-domains which can be authorized by this gateway", false),
+			flagutil.Bool(&cfg.Policies.Egress.Enabled, "allow-egress", nil, envPrefix, "Allow direct-tcpip connections to real network destinations for keys with matching egress permissions", false),
+			flagutil.Duration((*time.Duration)(&cfg.Policies.Egress.DialTimeout), "egress-dial-timeout", nil, envPrefix, "Timeout used when dialing egress destinations", false),
+			flagutil.Duration((*time.Duration)(&cfg.Policies.WaitBackend), "wait-backend", nil, envPrefix, "How long direct-tcpip connections wait for a missing endpoint to (re)appear, zero disables waiting", false),
+			flagutil.Int(&cfg.Quotas.MaxWaitingPerEndpoint, "max-waiting-per-endpoint", nil, envPrefix, "Maximum number of connections waiting for a single endpoint", false),
+			flagutil.Int(&cfg.Quotas.EndpointQueueSize, "endpoint-queue-size", nil, envPrefix, "Number of connections that can be queued on each exposed endpoint", false),
+			flagutil.Duration((*time.Duration)(&cfg.Policies.EndpointOfferTimeout), "endpoint-offer-timeout", nil, envPrefix, "How long a connection waits for an endpoint to accept it", false),
+			flagutil.Bool(&cfg.Policies.EndpointSkipBusy, "endpoint-skip-busy", nil, envPrefix, "Prefer endpoints with room in their queue over busy ones", false),
+			flagutil.Duration((*time.Duration)(&cfg.Policies.Tokens.IdleExpiry), "token-idle-expiry", nil, envPrefix, "Expire API tokens which were not used for this long (eg.: 720h), zero disables it", false),
+			flagutil.Duration((*time.Duration)(&cfg.Policies.Tokens.CacheTTL), "token-cache-ttl", nil, envPrefix, "How long successful API token validations are cached, zero disables the cache", false),
+			flagutil.Int(&cfg.Policies.Tokens.CacheSize, "token-cache-size", nil, envPrefix, "Maximum number of cached API token validations", false),
+			flagutil.Duration((*time.Duration)(&cfg.Policies.Tokens.RotationOverlap), "token-rotation-overlap", nil, envPrefix, "Longest time a rotated API token remains valid, clients may ask for less", false),
+			flagutil.String(&cfg.Policies.Tokens.Hash.Algorithm, "token-hash", nil, envPrefix, "Algorithm used to hash API tokens (bcrypt or argon2id), weaker hashes are upgraded when tokens are used", false),
+			flagutil.Int(&cfg.Policies.Tokens.Hash.BcryptCost, "token-bcrypt-cost", nil, envPrefix, "bcrypt cost used to hash API tokens", false),
+			flagutil.Duration((*time.Duration)(&cfg.Network.Keepalive.Interval), "keepalive-interval", nil, envPrefix, "Interval between keepalive probes sent to clients, zero disables probing", false),
+			flagutil.Int(&cfg.Network.Keepalive.MaxMissed, "keepalive-max-missed", nil, envPrefix, "Number of unanswered keepalive probes before a connection is closed", false),
+			flagutil.Duration((*time.Duration)(&cfg.Network.Keepalive.TCP), "tcp-keepalive", nil, envPrefix, "TCP keepalive period for accepted connections, negative disables it", false),
+			flagutil.StringSlice(&proxyUpstreams, "proxy-protocol-upstream", nil, envPrefix, "CIDR of a trusted load balancer which sends PROXY protocol headers", false),
+			flagutil.Bool(&cfg.Network.ProxyProtocol.EmitToBackends, "proxy-protocol-backends", nil, envPrefix, "Send PROXY protocol v2 headers with the client address to tunnel backends", false),
+		}, append(caSeed.flags(), nextCASeed.flags()...)...),
+		Subcommands: []*cli.Command{
+			checkConfigCmd(loadConfig),
 		},
 		Action: func(ctx *cli.Context) error {
-			var buf [ed25519.SeedSize]byte
-			n, err := hex.Decode(buf[:], []byte(caSeed))
+			seed, _, err := caSeed.load()
 			if err != nil {
 				return err
-			} else if n != ed25519.SeedSize {
-				return errors.New("ca-seed should be 32-byte long, hex-encoded")
 			}
-			// clear the environment
-			for _, v := range caSeedFlag.EnvVars {
-				os.Setenv(v, "")
+			nextSeed, hasNext, err := nextCASeed.load()
+			if err != nil {
+				return err
 			}
 
-			key, err := ssh.ParseAuthorizedKey(adminKeyFile)
+			config, err := loadConfig()
 			if err != nil {
 				return err
 			}
-			kdbStore, err := store.Open(kdbStoreDir)
+			if err := config.Validate(); err != nil {
+				return err
+			}
+			kdbStore, err := store.Open(config.StoreDir)
 			if err != nil {
 				return err
 			}
 			gateway, err := ssh.NewGateway(
 				&ssh.DynKDB{Store: kdbStore},
 				&ssh.TokenDB{Store: *kdbStore},
-				key, ssh.GenerateCAKey(buf))
+				nil, ssh.GenerateCAKey(seed))
 			if err != nil {
 				return err
 			}
-			gateway.Binding.SSH = bind
-			gateway.Binding.HTTP = bindHTTP
-			gateway.Binding.Domains = selfDomains.Value()
-			ssh.WrapIP(gateway.Binding.Domains)
-
-			gateway.Subdomains = subdomains.Value()
-			ssh.WrapIP(gateway.Subdomains)
-
+			if hasNext {
+				if err := gateway.SetNextCA(ssh.GenerateCAKey(nextSeed)); err != nil {
+					return err
+				}
+			}
+			if err := gateway.Apply(config); err != nil {
+				return err
+			}
+			// registered before running, so an early SIGHUP reloads instead of killing the process
+			hangup := make(chan os.Signal, 1)
+			signal.Notify(hangup, syscall.SIGHUP)
+			defer signal.Stop(hangup)
+			go reloadOnHangup(ctx.Context, hangup, gateway, loadConfig)
 			return gateway.Run(ctx.Context)
 		},
 	}
 }
+
+func checkConfigCmd(loadConfig func() (ssh.Config, error)) *cli.Command {
+	return &cli.Command{
+		Name:  "check-config",
+		Usage: "Validates the gateway configuration (flags and config file) and prints the result",
+		Action: func(ctx *cli.Context) error {
+			config, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			if err := config.Validate(); err != nil {
+				return err
+			}
+			enc := json.NewEncoder(ctx.App.Writer)
+			enc.SetIndent("", "  ")
+			return enc.Encode(config)
+		},
+	}
+}
+
+// reloadOnHangup reloads the configuration of gateway every time a signal is received from sig
+func reloadOnHangup(ctx context.Context, sig <-chan os.Signal, gateway *ssh.Gateway, loadConfig func() (ssh.Config, error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+		config, err := loadConfig()
+		if err == nil {
+			err = gateway.Reload(config)
+		}
+		if err != nil {
+			slog.Error("Unable to reload configuration", "err", err)
+		}
+	}
+}
@@ -19,6 +19,7 @@ func configCmd() *cli.Command {
 	allowHTTP := false
 	var baseURL *url.URL
 	var token string
+	var tokenFile string
 
 	return &cli.Command{
 		Name:        "config",
@@ -27,6 +28,7 @@ func configCmd() *cli.Command {
 			flagutil.String(&gateway, "endpoint", []string{"gt"}, envPrefix, "URL of your gateway HTTP API", true),
 			flagutil.Bool(&allowHTTP, "allow-http", nil, envPrefix, "Allow HTTP connections to the gateway", false),
 			flagutil.String(&token, "token", nil, envPrefix, "Token to authenticate against the gateway", false),
+			flagutil.String(&tokenFile, "token-file", nil, envPrefix, "File with the token, used when token is empty (see 'vandrare ssh token rotate')", false),
 		},
 		Before: func(ctx *cli.Context) error {
 			var err error
@@ -37,7 +39,12 @@ func configCmd() *cli.Command {
 			if baseURL.Scheme == "http" && !allowHTTP {
 				return errors.New("HTTP access to gateway is not allowed")
 			}
-			println("token: ", token)
+			if token == "" && tokenFile != "" {
+				token, err = readTokenFile(tokenFile)
+				if err != nil {
+					return err
+				}
+			}
 			return nil
 		},
 		Subcommands: []*cli.Command{
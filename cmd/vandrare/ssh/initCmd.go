@@ -0,0 +1,233 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrebq/vandrare/gateway/ssh"
+	"github.com/andrebq/vandrare/internal/flagutil"
+	"github.com/andrebq/vandrare/internal/store"
+	"github.com/urfave/cli/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func initCmd() *cli.Command {
+	envPrefix := fmt.Sprintf("%v_%v", envPrefix, "INIT")
+	storeDir := ""
+	seedFile := ""
+	configFile := ""
+	adminKeyFile := ""
+	generateAdminKey := false
+	tokenTTL := time.Hour * 24
+	selfDomains := cli.NewStringSlice("127.0.0.1:2222")
+	subdomains := cli.NewStringSlice("example.com")
+	return &cli.Command{
+		Name:  "init",
+		Usage: "Bootstraps a new gateway: store, CA seed, admin key and the initial admin token",
+		Flags: []cli.Flag{
+			flagutil.String(&storeDir, "store-dir", nil, envPrefix, "Directory where the gateway keeps its data", true),
+			flagutil.String(&seedFile, "ca-seed-file", nil, envPrefix, "File where the CA seed is written, defaults to <store-dir>/ca.seed", false),
+			flagutil.String(&configFile, "config-file", nil, envPrefix, "Gateway config file to create, defaults to <store-dir>/gateway.json", false),
+			flagutil.String(&adminKeyFile, "admin-key-file", nil, envPrefix, "SSH public key file used for admin access, required unless generate-admin-key is set", false),
+			flagutil.Bool(&generateAdminKey, "generate-admin-key", nil, envPrefix, "Generate an admin key pair at <store-dir>/admin_ed25519", false),
+			flagutil.Duration(&tokenTTL, "token-ttl", nil, envPrefix, "How long the initial admin token is valid, zero or negative means it never expires", false),
+			flagutil.StringSlice(selfDomains, "self-domain", []string{"self"}, envPrefix, "Address (domain:port) of the gateway itself", false),
+			flagutil.StringSlice(subdomains, "domain", []string{"d"}, envPrefix, "One or more sub-domains which can be authorized by this gateway", false),
+		},
+		Action: func(ctx *cli.Context) error {
+			var err error
+			storeDir, err = filepath.Abs(storeDir)
+			if err != nil {
+				return err
+			}
+			if seedFile == "" {
+				seedFile = filepath.Join(storeDir, "ca.seed")
+			}
+			if configFile == "" {
+				configFile = filepath.Join(storeDir, "gateway.json")
+			}
+			switch {
+			case generateAdminKey && adminKeyFile != "":
+				return errors.New("admin-key-file and generate-admin-key cannot be used together")
+			case !generateAdminKey && adminKeyFile == "":
+				return errors.New("either admin-key-file or generate-admin-key is required")
+			}
+
+			if err := os.MkdirAll(storeDir, 0700); err != nil {
+				return fmt.Errorf("unable to create store directory: %w", err)
+			}
+			seed, created, err := initCASeed(seedFile)
+			if err != nil {
+				return err
+			}
+			if created {
+				fmt.Fprintf(ctx.App.Writer, "CA seed written to %v\n", seedFile)
+			} else {
+				fmt.Fprintf(ctx.App.Writer, "CA seed already exists at %v, reusing it\n", seedFile)
+			}
+
+			if generateAdminKey {
+				adminKeyFile, err = generateKeyPair(filepath.Join(storeDir, "admin_ed25519"), "vandrare-admin")
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(ctx.App.Writer, "Admin key pair written to %v\n", filepath.Join(storeDir, "admin_ed25519"))
+			}
+			adminKey, err := ssh.ParseAuthorizedKey(adminKeyFile)
+			if err != nil {
+				return err
+			}
+
+			cakey := ssh.GenerateCAKey(seed)
+			capub, err := cakey.PublicKey()
+			if err != nil {
+				return err
+			}
+
+			if err := initAdminToken(ctx.Context, ctx.App.Writer, storeDir, adminKey, cakey, tokenTTL); err != nil {
+				return err
+			}
+
+			cfg := ssh.DefaultConfig()
+			cfg.StoreDir = storeDir
+			cfg.AdminKeyFiles = []string{adminKeyFile}
+			cfg.Domains = selfDomains.Value()
+			cfg.Subdomains = subdomains.Value()
+			created, err = writeNewFile(configFile, 0644, func(w io.Writer) error {
+				enc := json.NewEncoder(w)
+				enc.SetIndent("", "  ")
+				return enc.Encode(cfg)
+			})
+			if err != nil {
+				return err
+			}
+			if created {
+				fmt.Fprintf(ctx.App.Writer, "Gateway config written to %v\n", configFile)
+			} else {
+				fmt.Fprintf(ctx.App.Writer, "Gateway config already exists at %v, keeping it\n", configFile)
+			}
+
+			fmt.Fprintf(ctx.App.Writer, "\nCA fingerprint: %v\n", gossh.FingerprintSHA256(capub))
+			fmt.Fprintf(ctx.App.Writer, "CA public key: %s\n", bytes.TrimSpace(gossh.MarshalAuthorizedKey(capub)))
+			fmt.Fprintf(ctx.App.Writer, "Next steps:\n")
+			fmt.Fprintf(ctx.App.Writer, "  1. Review the domains in %v\n", configFile)
+			fmt.Fprintf(ctx.App.Writer, "  2. Start the gateway:\n")
+			fmt.Fprintf(ctx.App.Writer, "     vandrare ssh gateway --ca-seed-file %v --config-file %v\n", seedFile, configFile)
+			fmt.Fprintf(ctx.App.Writer, "  3. Use the admin token with the HTTP API or the admin key with 'ssh <gateway> vandrare gateway ssh admin'\n")
+			return nil
+		},
+	}
+}
+
+func initCASeed(file string) ([ed25519.SeedSize]byte, bool, error) {
+	var seed [ed25519.SeedSize]byte
+	buf, err := os.ReadFile(file)
+	if err == nil {
+		n, err := hex.Decode(seed[:], bytes.TrimSpace(buf))
+		if err != nil || n != ed25519.SeedSize {
+			return seed, false, fmt.Errorf("%v does not contain a valid CA seed", file)
+		}
+		return seed, false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return seed, false, fmt.Errorf("unable to read CA seed: %w", err)
+	}
+	if _, err := rand.Read(seed[:]); err != nil {
+		return seed, false, err
+	}
+	_, err = writeNewFile(file, 0600, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%v\n", hex.EncodeToString(seed[:]))
+		return err
+	})
+	return seed, true, err
+}
+
+// generateKeyPair writes a new ed25519 private key to file and its public key to file.pub,
+// returns the name of the public key file
+func generateKeyPair(file, comment string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	block, err := gossh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return "", err
+	}
+	sshpub, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	created, err := writeNewFile(file, 0600, func(w io.Writer) error {
+		return pem.Encode(w, block)
+	})
+	if err != nil {
+		return "", err
+	} else if !created {
+		return "", fmt.Errorf("%v already exists, refusing to overwrite it", file)
+	}
+	pubfile := file + ".pub"
+	_, err = writeNewFile(pubfile, 0644, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%v %v\n", string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(sshpub))), comment)
+		return err
+	})
+	return pubfile, err
+}
+
+func initAdminToken(ctx context.Context, out io.Writer, storeDir string, adminKey gossh.PublicKey, cakey ssh.CAKey, ttl time.Duration) error {
+	kdbStore, err := store.Open(storeDir)
+	if err != nil {
+		return err
+	}
+	gateway, err := ssh.NewGateway(
+		&ssh.DynKDB{Store: kdbStore},
+		&ssh.TokenDB{Store: *kdbStore},
+		adminKey, cakey)
+	if err != nil {
+		return err
+	}
+	var token [32]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return err
+	}
+	issued, err := gateway.SetAdminToken(ctx, &token, ttl)
+	if err != nil {
+		return err
+	}
+	if !issued {
+		fmt.Fprintf(out, "Initial admin token was already issued, use the admin session to issue new tokens\n")
+		return nil
+	}
+	fmt.Fprintf(out, "Initial admin token (shown only once): %v\n", base64.URLEncoding.EncodeToString(token[:]))
+	return nil
+}
+
+// writeNewFile creates file with the given permissions and fills it with write,
+// returns false (and no error) if the file already exists.
+func writeNewFile(file string, perm os.FileMode, write func(io.Writer) error) (bool, error) {
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if errors.Is(err, os.ErrExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	err = write(fd)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file)
+		return false, fmt.Errorf("unable to write %v: %w", file, err)
+	}
+	return true, nil
+}
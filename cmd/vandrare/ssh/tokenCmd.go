@@ -0,0 +1,97 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/andrebq/vandrare/gateway"
+	"github.com/andrebq/vandrare/internal/flagutil"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+func tokenCmd() *cli.Command {
+	envPrefix := fmt.Sprintf("%v_%v", envPrefix, "TOKEN")
+	endpoint := "http://localhost:8222/"
+	allowHTTP := false
+	var baseURL *url.URL
+	return &cli.Command{
+		Name:  "token",
+		Usage: "Manage the API token used to talk to the gateway",
+		Flags: []cli.Flag{
+			flagutil.String(&endpoint, "endpoint", []string{"gt"}, envPrefix, "URL of your gateway HTTP API", true),
+			flagutil.Bool(&allowHTTP, "allow-http", nil, envPrefix, "Allow HTTP connections to the gateway", false),
+		},
+		Before: func(ctx *cli.Context) error {
+			var err error
+			baseURL, err = url.Parse(endpoint)
+			if err != nil {
+				return err
+			}
+			if baseURL.Scheme == "http" && !allowHTTP {
+				return errors.New("HTTP access to gateway is not allowed")
+			}
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			tokenRotateCmd(&baseURL),
+		},
+	}
+}
+
+func tokenRotateCmd(base **url.URL) *cli.Command {
+	envPrefix := fmt.Sprintf("%v_%v", envPrefix, "TOKEN_ROTATE")
+	tokenFile := ""
+	identity := ""
+	overlap := time.Duration(-1)
+	return &cli.Command{
+		Name:  "rotate",
+		Usage: "Replaces the token in token-file with a new one, with the same owner, description and scopes",
+		Flags: []cli.Flag{
+			flagutil.String(&tokenFile, "token-file", nil, envPrefix, "File with the current token, it is replaced atomically with the new token", true),
+			flagutil.Duration(&overlap, "overlap", nil, envPrefix, "How long the current token remains valid, negative uses the maximum allowed by the gateway", false),
+			flagutil.String(&identity, "identity", []string{"i"}, envPrefix, "Private key used to sign requests, required if the token is bound to a key", false),
+		},
+		Action: func(ctx *cli.Context) error {
+			token, err := gateway.ReadTokenFile(tokenFile)
+			if err != nil {
+				return err
+			}
+			var signer ssh.Signer
+			if identity != "" {
+				if signer, err = gateway.ReadSignerFile(identity); err != nil {
+					return err
+				}
+			}
+			rotated, err := gateway.RotateToken(ctx.Context, *base, token, overlap, signer)
+			if err != nil {
+				return err
+			}
+			if err := gateway.WriteTokenFile(tokenFile, rotated.Token); err != nil {
+				// do not lose the new token, the previous one might be revoked already
+				fmt.Fprintf(ctx.App.ErrWriter, "New token %v (save it manually): %v\n", rotated.ID, rotated.Token)
+				return fmt.Errorf("unable to save the new token to %v: %w", tokenFile, err)
+			}
+			fmt.Fprintf(ctx.App.Writer, "Token %v written to %v\n", rotated.ID, tokenFile)
+			if rotated.BoundKey != "" {
+				fmt.Fprintf(ctx.App.Writer, "Bound to key: %v\n", rotated.BoundKey)
+			}
+			if rotated.ExpiresAt > 0 {
+				fmt.Fprintf(ctx.App.Writer, "Expires at: %v\n", time.UnixMilli(rotated.ExpiresAt).Format(time.RFC3339))
+			}
+			if rotated.PreviousExpiresAt > 0 {
+				fmt.Fprintf(ctx.App.Writer, "Previous token %v remains valid until %v\n", rotated.PreviousID, time.UnixMilli(rotated.PreviousExpiresAt).Format(time.RFC3339))
+			} else {
+				fmt.Fprintf(ctx.App.Writer, "Previous token %v was revoked\n", rotated.PreviousID)
+			}
+			return nil
+		},
+	}
+}
+
+func readTokenFile(file string) (string, error) {
+	token, err := gateway.ReadTokenFile(file)
+	return string(token), err
+}
@@ -24,7 +24,7 @@ oldTokens := tokenset.listActive("server1")
 for tk in oldTokens {
     tokenset.revoke(tk.ID)
 }
-token := tokenset.issue("server1", "Server 1 - API Token", "8766h")
+token := tokenset.issue("server1", "Server 1 - API Token", "8766h", "known-hosts:read", "keys:register")
 echo.printJSON({
     pubkey: pubkey,
     apiToken: token
@@ -49,7 +49,7 @@ IFS='' read -r -d '' command <<"EOF"
 echo := import("echo")
 tokenset := import("tokenset")
 
-token := tokenset.issueLifetime("${user}", "${user} Token")
+token := tokenset.issueLifetime("${user}", "${user} Token", "admin")
 echo.printJSON({
     apiToken: token
 })
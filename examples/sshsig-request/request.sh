@@ -0,0 +1,44 @@
+#!/usr/bin/env bash
+
+# Calls the gateway HTTP API authenticated by a registered ssh key instead of a token,
+# the key needs http-api permissions, eg.: keyset.addPermission(pubkey, "http-api", "keys:register", "allow")
+#
+# usage: request.sh <private key> <method> <url> [body]
+
+set -eou pipefail
+
+declare -r priv_key_file="${1}"
+declare -r method="${2}"
+declare -r url="${3}"
+declare -r body="${4:-}"
+
+# path and query, as seen by the gateway
+declare uri
+uri="/${url#*://*/}"
+readonly uri
+
+declare ts
+ts=$(date +%s)
+readonly ts
+
+# unique per request, the gateway rejects nonces it has already seen
+declare nonce
+nonce=$(head -c 16 /dev/urandom | base64 | tr '+/' '-_' | tr -d '=')
+readonly nonce
+
+declare body_hash
+body_hash=$(printf '%s' "${body}" | sha256sum | cut -d ' ' -f 1)
+readonly body_hash
+
+declare signature
+signature=$(printf '%s\n%s\n%s\n%s\n%s\n' "${method}" "${uri}" "${ts}" "${nonce}" "${body_hash}" |
+    ssh-keygen -q -Y sign -n vandrare-auth -f "${priv_key_file}" |
+    grep -v -- '-----' | tr -d '\n')
+readonly signature
+
+curl -sf -X "${method}" \
+    -H "Authorization: SSHSig ${signature}" \
+    -H "X-Vandrare-Timestamp: ${ts}" \
+    -H "X-Vandrare-Nonce: ${nonce}" \
+    ${body:+-H "Content-Type: application/json" --data-binary "${body}"} \
+    "${url}"
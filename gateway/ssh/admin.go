@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/andrebq/vandrare/internal/appshell"
 	"github.com/andrebq/vandrare/internal/pattern"
+	"github.com/andrebq/vandrare/internal/policy"
+	"github.com/andrebq/vandrare/internal/store"
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -40,7 +43,7 @@ func (g *Gateway) runAdminSession(s ssh.Session) {
 	sh := appshell.New(true)
 
 	echoMod := appshell.EchoModule(s, "echo")
-	sh.AddModules(echoMod, g.keyManagementModule(s.Context()), g.tokenManagement(s.Context()))
+	sh.AddModules(echoMod, g.keyManagementModule(s.Context()), g.tokenManagement(s.Context()), g.userManagement(s.Context()), g.groupManagement(s.Context()), g.policyManagement(s.Context()), g.endpointsModule())
 
 	err := sh.EvalInteractive(s.Context(), s)
 	if err != nil {
@@ -62,7 +65,7 @@ func (g *Gateway) tokenManagement(ctx context.Context) *appshell.Module {
 		} else if ttl <= 0 {
 			return "", errors.New("TTL must be positive, for lifetime access use issueLifetime")
 		}
-		token, err := g.tdb.Issue(ctx, owner, description, ttl)
+		token, err := g.tdb.Issue(ctx, owner, description, ttl, args[3:]...)
 		if err != nil {
 			return "", err
 		}
@@ -71,10 +74,7 @@ func (g *Gateway) tokenManagement(ctx context.Context) *appshell.Module {
 	mod.AddFuncRaw("issueLifetime", appshell.FuncNR1(func(args ...string) (string, error) {
 		owner := args[0]
 		description := args[1]
-		if len(args) != 2 {
-			return "", errors.New("lifetime expects only two arguments")
-		}
-		token, err := g.tdb.Issue(ctx, owner, description, -1)
+		token, err := g.tdb.Issue(ctx, owner, description, -1, args[2:]...)
 		if err != nil {
 			return "", err
 		}
@@ -92,6 +92,257 @@ func (g *Gateway) tokenManagement(ctx context.Context) *appshell.Module {
 		id := args[0]
 		return g.tdb.Revoke(ctx, id)
 	}))
+	mod.AddFuncRaw("bind", appshell.FuncNR0(func(args ...string) error {
+		if len(args) != 2 {
+			return errors.New("bind expects the token id and the fingerprint of a registered key")
+		}
+		err := g.bindToken(ctx, args[0], args[1])
+		slog.Info("Token bound", "id", args[0], "fingerprint", args[1], "err", err)
+		return err
+	}))
+	mod.AddFuncRaw("unbind", appshell.FuncNR0(func(args ...string) error {
+		err := g.tdb.Bind(ctx, args[0], "")
+		slog.Info("Token unbound", "id", args[0], "err", err)
+		return err
+	}))
+	mod.AddFuncRaw("owners", appshell.FuncNR1Cast(func(args ...string) ([]string, error) {
+		return g.tdb.Owners(ctx)
+	}, appshell.FromInterfaceSlice[string, []string](appshell.FromInterface[string]())))
+	mod.AddFuncRaw("search", appshell.FuncNR1Cast(func(args ...string) ([]TokenInfo, error) {
+		filter, err := tokenFilterArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return g.tdb.Search(ctx, filter)
+	}, appshell.FromInterfaceSlice[TokenInfo, []TokenInfo](appshell.ToFlatMap[TokenInfo]())))
+	mod.AddFuncRaw("revokeOwner", appshell.FuncNR1(func(args ...string) (int64, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return 0, errors.New("revokeOwner expects the owner and an optional description")
+		}
+		filter := store.TokenFilter{Owner: args[0]}
+		if len(args) > 1 {
+			filter.Description = args[1]
+		}
+		n, err := g.tdb.RevokeWhere(ctx, filter)
+		slog.Info("Tokens revoked", "owner", filter.Owner, "description", filter.Description, "count", n, "err", err)
+		return n, err
+	}))
+	mod.AddFuncRaw("revokeExpiringAfter", appshell.FuncNR1(func(args ...string) (int64, error) {
+		if len(args) != 1 {
+			return 0, errors.New("revokeExpiringAfter expects a duration, tokens valid for longer than that (or forever) are revoked")
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return 0, err
+		}
+		n, err := g.tdb.RevokeWhere(ctx, store.TokenFilter{ExpiresAfter: time.Now().Add(d)})
+		slog.Info("Tokens revoked", "expiringAfter", d, "count", n, "err", err)
+		return n, err
+	}))
+	mod.AddFuncRaw("purge", appshell.FuncNR1(func(args ...string) (int64, error) {
+		var olderThan time.Duration
+		if len(args) > 0 {
+			var err error
+			if olderThan, err = time.ParseDuration(args[0]); err != nil {
+				return 0, err
+			}
+		}
+		n, err := g.tdb.Purge(ctx, olderThan)
+		slog.Info("Expired tokens purged", "olderThan", olderThan, "count", n, "err", err)
+		return n, err
+	}))
+	mod.AddFuncRaw("cacheStats", appshell.FuncNR1Cast(func(args ...string) (TokenCacheStats, error) {
+		return g.tdb.CacheStats(), nil
+	}, appshell.ToFlatMap[TokenCacheStats]()))
+	return mod
+}
+
+// tokenFilterArgs parses the arguments of tokenset.search:
+// owner, description, status (active, expired or all), after and limit,
+// empty values match everything
+func tokenFilterArgs(args []string) (store.TokenFilter, error) {
+	var filter store.TokenFilter
+	if len(args) > 5 {
+		return filter, errors.New("search expects owner, description, status, after and limit")
+	}
+	args = append(args, make([]string, 5-len(args))...)
+	filter.Owner, filter.Description, filter.Status, filter.After = args[0], args[1], store.TokenStatus(args[2]), args[3]
+	if filter.Status == "all" {
+		filter.Status = ""
+	}
+	if args[4] != "" {
+		limit, err := strconv.Atoi(args[4])
+		if err != nil {
+			return filter, fmt.Errorf("invalid limit: %w", err)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+func (g *Gateway) userManagement(ctx context.Context) *appshell.Module {
+	mod := appshell.NewModule("userset")
+	toMap := appshell.ToFlatMap[userInfo]()
+	mod.AddFuncRaw("put", appshell.FuncNR0(func(args ...string) error {
+		if len(args) < 2 || len(args)%2 != 0 {
+			return errors.New("put expects the user id, display name and optional metadata key/value pairs")
+		}
+		user := store.User{ID: args[0], DisplayName: args[1], Metadata: map[string]string{}}
+		for i := 2; i < len(args); i += 2 {
+			user.Metadata[args[i]] = args[i+1]
+		}
+		err := g.kdb.PutUser(ctx, user)
+		slog.Info("User updated", "user", user.ID, "err", err)
+		return err
+	}))
+	mod.AddFuncRaw("get", appshell.FuncNR1Cast(func(args ...string) (userInfo, error) {
+		user, err := g.kdb.GetUser(ctx, args[0])
+		return newUserInfo(user), err
+	}, toMap))
+	mod.AddFuncRaw("list", appshell.FuncNR1Cast(func(args ...string) ([]userInfo, error) {
+		users, err := g.kdb.ListUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]userInfo, len(users))
+		for i, u := range users {
+			ret[i] = newUserInfo(u)
+		}
+		return ret, nil
+	}, appshell.FromInterfaceSlice[userInfo, []userInfo](toMap)))
+	mod.AddFuncRaw("suspend", appshell.FuncNR0(func(args ...string) error {
+		return g.setUserStatus(ctx, args[0], store.UserSuspended)
+	}))
+	mod.AddFuncRaw("activate", appshell.FuncNR0(func(args ...string) error {
+		return g.setUserStatus(ctx, args[0], store.UserActive)
+	}))
+	mod.AddFuncRaw("owned", appshell.FuncNR1Cast(func(args ...string) (ownedInfo, error) {
+		assets, err := g.userAssets(ctx, args[0])
+		if err != nil {
+			return ownedInfo{}, err
+		}
+		return newOwnedInfo(assets), nil
+	}, appshell.ToFlatMap[ownedInfo]()))
+	return mod
+}
+
+func (g *Gateway) groupManagement(ctx context.Context) *appshell.Module {
+	mod := appshell.NewModule("groupset")
+	toMap := appshell.ToFlatMap[groupInfo]()
+	mod.AddFuncRaw("put", appshell.FuncNR1Cast(func(args ...string) (groupInfo, error) {
+		if len(args) < 1 {
+			return groupInfo{}, errors.New("put expects the group name and an optional description")
+		}
+		group, err := g.kdb.PutGroup(ctx, args[0], strings.Join(args[1:], " "))
+		slog.Info("Group updated", "group", args[0], "err", err)
+		return newGroupInfo(group), err
+	}, toMap))
+	mod.AddFuncRaw("get", appshell.FuncNR1Cast(func(args ...string) (groupInfo, error) {
+		group, err := g.kdb.GetGroup(ctx, args[0])
+		return newGroupInfo(group), err
+	}, toMap))
+	mod.AddFuncRaw("list", appshell.FuncNR1Cast(func(args ...string) ([]groupInfo, error) {
+		groups, err := g.kdb.ListGroups(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]groupInfo, len(groups))
+		for i, gr := range groups {
+			ret[i] = newGroupInfo(gr)
+		}
+		return ret, nil
+	}, appshell.FromInterfaceSlice[groupInfo, []groupInfo](toMap)))
+	mod.AddFuncRaw("delete", appshell.FuncNR0(func(args ...string) error {
+		err := g.kdb.DeleteGroup(ctx, args[0])
+		slog.Info("Group deleted", "group", args[0], "err", err)
+		return err
+	}))
+	mod.AddFuncRaw("addPermission", appshell.FuncNR1Cast(func(args ...string) (groupInfo, error) {
+		if len(args) != 4 {
+			return groupInfo{}, errors.New("addPermission expects the group name, operation, resource and action")
+		}
+		operation, resource, action := args[1], args[2], strings.ToLower(args[3])
+		if err := validatePermission(operation, resource, action); err != nil {
+			return groupInfo{}, err
+		}
+		group, err := g.kdb.SetGroupPermission(ctx, args[0], operation, resource, action)
+		slog.Info("Group authorization", "group", args[0], "operation", operation, "resource", resource, "action", action, "err", err)
+		return newGroupInfo(group), err
+	}, toMap))
+	mod.AddFuncRaw("addKey", appshell.FuncNR1Cast(func(args ...string) (groupInfo, error) {
+		group, err := g.kdb.AddGroupKey(ctx, args[0], args[1])
+		slog.Info("Group member added", "group", args[0], "fingerprint", args[1], "err", err)
+		return newGroupInfo(group), err
+	}, toMap))
+	mod.AddFuncRaw("addUser", appshell.FuncNR1Cast(func(args ...string) (groupInfo, error) {
+		group, err := g.kdb.AddGroupUser(ctx, args[0], args[1])
+		slog.Info("Group member added", "group", args[0], "user", args[1], "err", err)
+		return newGroupInfo(group), err
+	}, toMap))
+	mod.AddFuncRaw("removeKey", appshell.FuncNR1Cast(func(args ...string) (groupInfo, error) {
+		group, err := g.kdb.RemoveGroupMember(ctx, args[0], args[1], "")
+		slog.Info("Group member removed", "group", args[0], "fingerprint", args[1], "err", err)
+		return newGroupInfo(group), err
+	}, toMap))
+	mod.AddFuncRaw("removeUser", appshell.FuncNR1Cast(func(args ...string) (groupInfo, error) {
+		group, err := g.kdb.RemoveGroupMember(ctx, args[0], "", args[1])
+		slog.Info("Group member removed", "group", args[0], "user", args[1], "err", err)
+		return newGroupInfo(group), err
+	}, toMap))
+	return mod
+}
+
+// policyManagement manages policy scripts, put takes the name, the source and
+// an optional mode: "dry-run" (the default) or "enforce"
+func (g *Gateway) policyManagement(ctx context.Context) *appshell.Module {
+	mod := appshell.NewModule("policyset")
+	toMap := appshell.ToFlatMap[policyScriptInfo]()
+	mod.AddFuncRaw("put", appshell.FuncNR1Cast(func(args ...string) (policyScriptInfo, error) {
+		if len(args) < 2 || len(args) > 3 {
+			return policyScriptInfo{}, errors.New("put expects the script name, its source and an optional mode")
+		}
+		var enforce bool
+		if len(args) > 2 {
+			switch args[2] {
+			case "enforce":
+				enforce = true
+			case "dry-run":
+			default:
+				return policyScriptInfo{}, fmt.Errorf("invalid mode %q, use dry-run or enforce", args[2])
+			}
+		}
+		script, err := g.kdb.PutPolicyScript(ctx, args[0], args[1], enforce)
+		slog.Info("Policy script updated", "script", args[0], "enforce", enforce, "err", err)
+		return newPolicyScriptInfo(script), err
+	}, toMap))
+	mod.AddFuncRaw("get", appshell.FuncNR1Cast(func(args ...string) (policyScriptInfo, error) {
+		script, err := g.kdb.GetPolicyScript(ctx, args[0])
+		return newPolicyScriptInfo(script), err
+	}, toMap))
+	mod.AddFuncRaw("list", appshell.FuncNR1Cast(func(args ...string) ([]policyScriptInfo, error) {
+		scripts, err := g.kdb.ListPolicyScripts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]policyScriptInfo, len(scripts))
+		for i, s := range scripts {
+			ret[i] = newPolicyScriptInfo(s)
+		}
+		return ret, nil
+	}, appshell.FromInterfaceSlice[policyScriptInfo, []policyScriptInfo](toMap)))
+	mod.AddFuncRaw("delete", appshell.FuncNR0(func(args ...string) error {
+		err := g.kdb.DeletePolicyScript(ctx, args[0])
+		slog.Info("Policy script deleted", "script", args[0], "err", err)
+		return err
+	}))
+	return mod
+}
+
+func (g *Gateway) endpointsModule() *appshell.Module {
+	mod := appshell.NewModule("endpoints")
+	mod.AddFuncRaw("stats", appshell.FuncNR1Cast(func(args ...string) ([]EndpointStats, error) {
+		return g.endpointStats(), nil
+	}, appshell.FromInterfaceSlice[EndpointStats, []EndpointStats](appshell.ToFlatMap[EndpointStats]())))
 	return mod
 }
 
@@ -114,8 +365,12 @@ func (g *Gateway) keyManagementModule(ctx context.Context) *appshell.Module {
 		if len(hostname) == 0 {
 			return errors.New("invalid hostname")
 		}
-		err = g.kdb.RegisterKey(ctx, key, time.Now().Add(validFromDur), time.Now().Add(expiresInDur), []string{hostname})
-		slog.Info("Key registration", "key", string(gossh.MarshalAuthorizedKey(key)), "hostname", hostname, "err", err)
+		var owner string
+		if len(args) > 4 {
+			owner = args[4]
+		}
+		err = g.kdb.RegisterKey(ctx, key, owner, time.Now().Add(validFromDur), time.Now().Add(expiresInDur), []string{hostname})
+		slog.Info("Key registration", "key", string(gossh.MarshalAuthorizedKey(key)), "hostname", hostname, "owner", owner, "err", err)
 		return err
 	}))
 
@@ -127,14 +382,240 @@ func (g *Gateway) keyManagementModule(ctx context.Context) *appshell.Module {
 		operation := args[1]
 		resource := args[2]
 		action := strings.ToLower(args[3])
-		switch action {
-		case "allow", "deny":
-		default:
-			return fmt.Errorf("invalid action: %v", action)
+		if err := validatePermission(operation, resource, action); err != nil {
+			return err
 		}
 		err = g.kdb.SetPermission(ctx, key, operation, resource, action)
 		slog.Info("Key authorization", "key", string(gossh.MarshalAuthorizedKey(key)), "operation", operation, "resource", resource, "action", action, "err", err)
 		return err
 	}))
+
+	mod.AddFuncRaw("explain", appshell.FuncNR1Cast(func(args ...string) (decisionInfo, error) {
+		if len(args) != 3 {
+			return decisionInfo{}, errors.New("explain expects the public key, operation and resource")
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(args[0]))
+		if err != nil {
+			return decisionInfo{}, err
+		}
+		decision, err := g.kdb.Explain(ctx, key, args[1], args[2])
+		return newDecisionInfo(decision), err
+	}, appshell.ToFlatMap[decisionInfo]()))
+
+	registrationToMap := appshell.ToFlatMap[registrationInfo]()
+	mod.AddFuncRaw("listRegistrations", appshell.FuncNR1Cast(func(args ...string) ([]registrationInfo, error) {
+		var status RegistrationStatus
+		if len(args) > 0 {
+			status = RegistrationStatus(args[0])
+		}
+		regs, err := g.kdb.ListKeyRegistrations(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]registrationInfo, len(regs))
+		for i, r := range regs {
+			ret[i] = newRegistrationInfo(r)
+		}
+		return ret, nil
+	}, appshell.FromInterfaceSlice[registrationInfo, []registrationInfo](registrationToMap)))
+	mod.AddFuncRaw("getRegistration", appshell.FuncNR1Cast(func(args ...string) (registrationInfo, error) {
+		if len(args) != 1 {
+			return registrationInfo{}, errors.New("getRegistration expects the key fingerprint")
+		}
+		reg, err := g.kdb.KeyRegistration(ctx, args[0])
+		return newRegistrationInfo(reg), err
+	}, registrationToMap))
+	mod.AddFuncRaw("approve", appshell.FuncNR1Cast(func(args ...string) (registrationInfo, error) {
+		if len(args) != 2 {
+			return registrationInfo{}, errors.New("approve expects the key fingerprint and for how long the key is valid")
+		}
+		validFor, err := time.ParseDuration(args[1])
+		if err != nil {
+			return registrationInfo{}, err
+		}
+		reg, err := g.kdb.ApproveKeyRegistration(ctx, args[0], adminSessionActor(ctx), validFor)
+		slog.Info("Key registration approved", "fingerprint", args[0], "validFor", validFor, "err", err)
+		return newRegistrationInfo(reg), err
+	}, registrationToMap))
+	mod.AddFuncRaw("reject", appshell.FuncNR1Cast(func(args ...string) (registrationInfo, error) {
+		if len(args) < 1 {
+			return registrationInfo{}, errors.New("reject expects the key fingerprint and an optional reason")
+		}
+		reason := strings.Join(args[1:], " ")
+		reg, err := g.kdb.RejectKeyRegistration(ctx, args[0], adminSessionActor(ctx), reason)
+		slog.Info("Key registration rejected", "fingerprint", args[0], "reason", reason, "err", err)
+		return newRegistrationInfo(reg), err
+	}, registrationToMap))
 	return mod
 }
+
+// validatePermission checks a permission before it is stored, operation and resource
+// can be globs (see policy.Glob) and action is allow, deny or remove
+func validatePermission(operation, resource, action string) error {
+	if _, err := policy.ParseEffect(action); err != nil && action != removeAction {
+		return fmt.Errorf("%w: invalid action %q, use allow, deny or %v", errInvalidRequest, action, removeAction)
+	}
+	switch {
+	case operation == "" || resource == "":
+		return fmt.Errorf("%w: operation and resource are required", errInvalidRequest)
+	case resource == "*":
+	case operation == egressOperation:
+		if _, err := parseEgressRule(resource); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidRequest, err)
+		}
+	case operation == httpAPIOperation && !policy.IsGlob(resource):
+		return validateScopes([]string{resource})
+	}
+	return nil
+}
+
+// registrationInfo is the flat version of KeyRegistration used by admin sessions
+type registrationInfo struct {
+	Fingerprint string
+	PublicKey   string
+	Owner       string
+	Description string
+	Status      string
+	UseCases    string
+	Hosts       string
+	RequestedAt time.Time
+	DecidedAt   time.Time
+	DecidedBy   string
+	Reason      string
+}
+
+func newRegistrationInfo(reg KeyRegistration) registrationInfo {
+	info := registrationInfo{
+		Fingerprint: reg.Fingerprint,
+		Owner:       reg.Owner,
+		Description: reg.Description,
+		Status:      string(reg.Status),
+		UseCases:    strings.Join(reg.UseCases, ","),
+		Hosts:       strings.Join(reg.Hosts, ","),
+		RequestedAt: reg.RequestedAt,
+		DecidedAt:   reg.DecidedAt,
+		DecidedBy:   reg.DecidedBy,
+		Reason:      reg.Reason,
+	}
+	if reg.PublicKey.PublicKey != nil {
+		info.PublicKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(reg.PublicKey)))
+	}
+	return info
+}
+
+// adminSessionActor identifies the admin key of the session for audit purposes
+func adminSessionActor(ctx context.Context) string {
+	if key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey); ok && key != nil {
+		return fmt.Sprintf("key:%v", gossh.FingerprintSHA256(key))
+	}
+	return "admin"
+}
+
+// userInfo is the flat version of store.User used by admin sessions
+type userInfo struct {
+	ID          string
+	DisplayName string
+	Status      string
+	Metadata    map[string]any
+	CreatedAt   time.Time
+}
+
+func newUserInfo(u store.User) userInfo {
+	info := userInfo{
+		ID:          u.ID,
+		DisplayName: u.DisplayName,
+		Status:      string(u.Status),
+		Metadata:    make(map[string]any, len(u.Metadata)),
+		CreatedAt:   u.CreatedAt,
+	}
+	for k, v := range u.Metadata {
+		info.Metadata[k] = v
+	}
+	return info
+}
+
+// ownedInfo is the flat version of UserAssets used by admin sessions,
+// keys and registrations are listed by fingerprint and tokens by id
+type ownedInfo struct {
+	ID            string
+	Status        string
+	Keys          string
+	Tokens        string
+	Registrations string
+}
+
+func newOwnedInfo(assets UserAssets) ownedInfo {
+	info := ownedInfo{ID: assets.User.ID, Status: string(assets.User.Status)}
+	var keys, tokens, registrations []string
+	for _, k := range assets.Keys {
+		keys = append(keys, k.Fingerprint)
+	}
+	for _, t := range assets.Tokens {
+		tokens = append(tokens, t.ID)
+	}
+	for _, r := range assets.Registrations {
+		registrations = append(registrations, r.Fingerprint)
+	}
+	info.Keys = strings.Join(keys, ",")
+	info.Tokens = strings.Join(tokens, ",")
+	info.Registrations = strings.Join(registrations, ",")
+	return info
+}
+
+// groupInfo is the flat version of Group used by admin sessions,
+// permissions are listed as "operation resource action"
+type groupInfo struct {
+	Name        string
+	Description string
+	Permissions string
+	Keys        string
+	Users       string
+}
+
+func newGroupInfo(group Group) groupInfo {
+	var permissions []string
+	for _, p := range group.Permissions {
+		permissions = append(permissions, fmt.Sprintf("%v %v %v", p.Operation, p.Resource, p.Action))
+	}
+	return groupInfo{
+		Name:        group.Name,
+		Description: group.Description,
+		Permissions: strings.Join(permissions, ","),
+		Keys:        strings.Join(group.Keys, ","),
+		Users:       strings.Join(group.Users, ","),
+	}
+}
+
+// decisionInfo is the flat version of policy.Decision used by admin sessions,
+// the rule fields are empty if no rule matched
+type decisionInfo struct {
+	Allowed   bool
+	Reason    string
+	Operation string
+	Resource  string
+	Effect    string
+	Source    string
+}
+
+func newDecisionInfo(d policy.Decision) decisionInfo {
+	info := decisionInfo{Allowed: d.Allowed, Reason: d.Reason}
+	if d.Rule != nil {
+		info.Operation = d.Rule.Operation
+		info.Resource = d.Rule.Resource
+		info.Effect = string(d.Rule.Effect)
+		info.Source = d.Rule.Source
+	}
+	return info
+}
+
+// policyScriptInfo is the flat version of PolicyScript used by admin sessions
+type policyScriptInfo struct {
+	Name      string
+	Source    string
+	Enforce   bool
+	UpdatedAt time.Time
+}
+
+func newPolicyScriptInfo(s PolicyScript) policyScriptInfo {
+	return policyScriptInfo{Name: s.Name, Source: s.Source, Enforce: s.Enforce, UpdatedAt: s.UpdatedAt}
+}
@@ -0,0 +1,838 @@
+package ssh
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/store"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type (
+	apiKey struct {
+		Fingerprint  string          `json:"fingerprint"`
+		PublicKey    string          `json:"pubkey"`
+		ValidFrom    time.Time       `json:"validFrom"`
+		ExpiresAt    time.Time       `json:"expiresAt"`
+		AllowedHosts []string        `json:"allowedHosts"`
+		Owner        string          `json:"owner,omitempty"`
+		Permissions  []apiPermission `json:"permissions"`
+	}
+
+	apiPermission struct {
+		Operation string `json:"operation"`
+		Resource  string `json:"resource"`
+		Action    string `json:"action"`
+	}
+
+	apiToken struct {
+		ID          string   `json:"id"`
+		Owner       string   `json:"owner"`
+		Description string   `json:"description"`
+		ExpiresAt   int64    `json:"expiresAt"`
+		Active      bool     `json:"active"`
+		Scopes      []string `json:"scopes"`
+		IssuedAt    int64    `json:"issuedAt"`
+		LastUsedAt  int64    `json:"lastUsedAt"`
+		LastUsedIP  string   `json:"lastUsedIP"`
+		UseCount    int64    `json:"useCount"`
+		HashScheme  string   `json:"hashScheme,omitempty"`
+		BoundKey    string   `json:"boundKey,omitempty"`
+		Token       string   `json:"token,omitempty"`
+	}
+
+	apiUser struct {
+		ID          string            `json:"id"`
+		DisplayName string            `json:"displayName"`
+		Status      string            `json:"status"`
+		Metadata    map[string]string `json:"metadata"`
+		CreatedAt   time.Time         `json:"createdAt"`
+	}
+
+	apiUserAssets struct {
+		apiUser
+		Keys          []apiKey          `json:"keys"`
+		Tokens        []apiToken        `json:"tokens"`
+		Registrations []KeyRegistration `json:"registrations"`
+	}
+
+	apiDecision struct {
+		Allowed bool           `json:"allowed"`
+		Reason  string         `json:"reason"`
+		Rule    *apiPermission `json:"rule,omitempty"`
+		Source  string         `json:"source,omitempty"`
+	}
+
+	apiPolicyScript struct {
+		Name      string    `json:"name"`
+		Source    string    `json:"source"`
+		Enforce   bool      `json:"enforce"`
+		UpdatedAt time.Time `json:"updatedAt"`
+	}
+
+	apiGroup struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Permissions []apiPermission `json:"permissions"`
+		Keys        []string        `json:"keys"`
+		Users       []string        `json:"users"`
+	}
+
+	// apiGroupMember identifies either a key, by its fingerprint, or a user
+	apiGroupMember struct {
+		Fingerprint string `json:"fingerprint,omitempty"`
+		User        string `json:"user,omitempty"`
+	}
+)
+
+// adminRoutes mirrors the keyset, tokenset, userset, groupset and policyset modules of admin sessions,
+// fingerprints are passed as query parameters (or in the body) since they may contain slashes
+func (g *Gateway) adminRoutes(mux *http.ServeMux) {
+	const prefix = "/gateway/ssh/admin"
+	handle := func(pattern string, fn http.HandlerFunc) {
+		method, path, _ := strings.Cut(pattern, " ")
+		mux.HandleFunc(fmt.Sprintf("%v %v%v", method, prefix, path), g.protectHttpFunc(ScopeAdmin, fn))
+	}
+	handle("GET /keys", g.listKeys)
+	handle("POST /keys", g.registerKeyAdmin)
+	handle("GET /key", g.getKey)
+	handle("DELETE /key", g.deleteKey)
+	handle("POST /key/extend", g.extendKey)
+	handle("POST /key/permissions", g.setPermission)
+	handle("GET /key/explain", g.explainKey)
+
+	handle("GET /tokens", g.listTokens)
+	handle("POST /tokens", g.issueToken)
+	handle("DELETE /tokens/{id}", g.revokeToken)
+	handle("POST /tokens/{id}/bind", g.bindTokenAPI)
+	handle("POST /tokens/revoke", g.revokeTokens)
+	handle("POST /tokens/purge", g.purgeTokens)
+	handle("GET /token-owners", g.listTokenOwners)
+	handle("GET /token-cache", g.tokenCacheStats)
+
+	handle("GET /registrations", g.listRegistrations)
+	handle("GET /registration", g.getRegistration)
+	handle("POST /registrations/approve", g.approveRegistration)
+	handle("POST /registrations/reject", g.rejectRegistration)
+
+	handle("GET /users", g.listUsers)
+	handle("POST /users", g.putUser)
+	handle("GET /users/{id}", g.getUserAssets)
+	handle("POST /users/{id}/suspend", g.changeUserStatus(store.UserSuspended))
+	handle("POST /users/{id}/activate", g.changeUserStatus(store.UserActive))
+
+	handle("GET /groups", g.listGroups)
+	handle("POST /groups", g.putGroup)
+	handle("GET /groups/{name}", g.getGroup)
+	handle("DELETE /groups/{name}", g.deleteGroup)
+	handle("POST /groups/{name}/permissions", g.setGroupPermission)
+	handle("POST /groups/{name}/members", g.addGroupMember)
+	handle("POST /groups/{name}/members/remove", g.removeGroupMember)
+
+	handle("GET /policy-scripts", g.listPolicyScripts)
+	handle("POST /policy-scripts", g.putPolicyScript)
+	handle("GET /policy-scripts/{name}", g.getPolicyScript)
+	handle("DELETE /policy-scripts/{name}", g.deletePolicyScript)
+}
+
+func newAPIKey(entry KeyEntry) apiKey {
+	ret := apiKey{
+		Fingerprint:  entry.Fingerprint,
+		PublicKey:    strings.TrimSpace(string(gossh.MarshalAuthorizedKey(entry.PublicKey))),
+		ValidFrom:    entry.Config.ValidFrom,
+		ExpiresAt:    entry.Config.ExpiresAt,
+		AllowedHosts: entry.Config.AllowedHosts,
+		Owner:        entry.Config.Owner,
+		Permissions:  []apiPermission{},
+	}
+	for _, p := range entry.Permissions {
+		if p == (Permission{}) {
+			continue
+		}
+		ret.Permissions = append(ret.Permissions, apiPermission{Operation: p.Operation, Resource: p.Resource, Action: p.Action})
+	}
+	return ret
+}
+
+func (g *Gateway) listKeys(w http.ResponseWriter, req *http.Request) {
+	entries, err := g.kdb.ListKeys(req.Context())
+	if err != nil {
+		slog.Error("Unable to list keys", "err", err)
+		writeError(w, err)
+		return
+	}
+	ret := make([]apiKey, len(entries))
+	for i, e := range entries {
+		ret[i] = newAPIKey(e)
+	}
+	writeJSON(w, ret)
+}
+
+func (g *Gateway) getKey(w http.ResponseWriter, req *http.Request) {
+	entry, err := g.kdb.GetKey(req.Context(), req.URL.Query().Get("fingerprint"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newAPIKey(entry))
+}
+
+// explainKey reports which rule decides if the key can perform operation on resource,
+// all of them are query parameters. Policy scripts see the address of the caller as sourceIP.
+func (g *Gateway) explainKey(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	entry, err := g.kdb.GetKey(req.Context(), query.Get("fingerprint"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	decision, err := g.kdb.Explain(req.Context(), entry.PublicKey, query.Get("operation"), query.Get("resource"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ret := apiDecision{Allowed: decision.Allowed, Reason: decision.Reason}
+	if r := decision.Rule; r != nil {
+		ret.Rule = &apiPermission{Operation: r.Operation, Resource: r.Resource, Action: string(r.Effect)}
+		ret.Source = r.Source
+	}
+	writeJSON(w, ret)
+}
+
+func (g *Gateway) registerKeyAdmin(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		PublicKey    SSHPubKey `json:"pubkey"`
+		ValidFrom    time.Time `json:"validFrom"`
+		ExpiresAt    time.Time `json:"expiresAt"`
+		ValidFor     Duration  `json:"validFor"`
+		AllowedHosts []string  `json:"allowedHosts"`
+		Owner        string    `json:"owner"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	if body.ValidFrom.IsZero() {
+		body.ValidFrom = time.Now()
+	}
+	if body.ExpiresAt.IsZero() && body.ValidFor > 0 {
+		body.ExpiresAt = body.ValidFrom.Add(time.Duration(body.ValidFor))
+	}
+	switch {
+	case body.PublicKey.PublicKey == nil:
+		writeError(w, fmt.Errorf("%w: pubkey is required", errInvalidRequest))
+		return
+	case !body.ExpiresAt.After(body.ValidFrom):
+		writeError(w, fmt.Errorf("%w: expiresAt or validFor is required and must be after validFrom", errInvalidRequest))
+		return
+	case len(body.AllowedHosts) == 0:
+		writeError(w, fmt.Errorf("%w: at least one allowed host is required", errInvalidRequest))
+		return
+	}
+	err := g.kdb.RegisterKey(req.Context(), body.PublicKey, body.Owner, body.ValidFrom, body.ExpiresAt, body.AllowedHosts)
+	fingerprint := gossh.FingerprintSHA256(body.PublicKey)
+	slog.Info("Key registration", "fingerprint", fingerprint, "hostnames", body.AllowedHosts, "owner", body.Owner, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	entry, err := g.kdb.GetKey(req.Context(), fingerprint)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newAPIKey(entry))
+}
+
+func (g *Gateway) deleteKey(w http.ResponseWriter, req *http.Request) {
+	fingerprint := req.URL.Query().Get("fingerprint")
+	err := g.kdb.DeleteKey(req.Context(), fingerprint)
+	slog.Info("Key removed", "fingerprint", fingerprint, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) extendKey(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Fingerprint string    `json:"fingerprint"`
+		ExpiresAt   time.Time `json:"expiresAt"`
+		ExtendBy    Duration  `json:"extendBy"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	if body.ExpiresAt.IsZero() {
+		if body.ExtendBy <= 0 {
+			writeError(w, fmt.Errorf("%w: expiresAt or a positive extendBy is required", errInvalidRequest))
+			return
+		}
+		entry, err := g.kdb.GetKey(req.Context(), body.Fingerprint)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		// expired keys are extended from now
+		base := entry.Config.ExpiresAt
+		if now := time.Now(); base.Before(now) {
+			base = now
+		}
+		body.ExpiresAt = base.Add(time.Duration(body.ExtendBy))
+	}
+	entry, err := g.kdb.ExtendKey(req.Context(), body.Fingerprint, body.ExpiresAt)
+	slog.Info("Key extended", "fingerprint", body.Fingerprint, "expiresAt", body.ExpiresAt, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newAPIKey(entry))
+}
+
+func (g *Gateway) setPermission(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Fingerprint string `json:"fingerprint"`
+		apiPermission
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	body.Action = strings.ToLower(body.Action)
+	if err := validatePermission(body.Operation, body.Resource, body.Action); err != nil {
+		writeError(w, err)
+		return
+	}
+	entry, err := g.kdb.GetKey(req.Context(), body.Fingerprint)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = g.kdb.SetPermission(req.Context(), entry.PublicKey, body.Operation, body.Resource, body.Action)
+	slog.Info("Key authorization", "fingerprint", body.Fingerprint, "operation", body.Operation, "resource", body.Resource, "action", body.Action, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	entry, err = g.kdb.GetKey(req.Context(), body.Fingerprint)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newAPIKey(entry))
+}
+
+// listTokens returns one page of tokens, by default only active ones,
+// use status=all or status=expired to include expired tokens
+func (g *Gateway) listTokens(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := store.TokenFilter{
+		Owner:       query.Get("owner"),
+		Description: query.Get("description"),
+		Status:      store.TokenActive,
+		After:       query.Get("after"),
+	}
+	switch status := query.Get("status"); status {
+	case "":
+	case "all":
+		filter.Status = ""
+	default:
+		filter.Status = store.TokenStatus(status)
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			writeError(w, fmt.Errorf("%w: invalid limit", errInvalidRequest))
+			return
+		}
+	}
+	tokens, err := g.tdb.Search(req.Context(), filter)
+	if err != nil {
+		slog.Error("Unable to list tokens", "owner", filter.Owner, "err", err)
+		writeError(w, err)
+		return
+	}
+	ret := make([]apiToken, len(tokens))
+	for i, t := range tokens {
+		ret[i] = newAPIToken(t)
+	}
+	writeJSON(w, ret)
+}
+
+func newAPIToken(t TokenInfo) apiToken {
+	return apiToken{
+		ID:          t.ID,
+		Owner:       t.Owner,
+		Description: t.Description,
+		ExpiresAt:   t.ExpiresAt,
+		Active:      t.Active,
+		Scopes:      strings.Fields(t.Scopes),
+		IssuedAt:    t.IssuedAt,
+		LastUsedAt:  t.LastUsedAt,
+		LastUsedIP:  t.LastUsedIP,
+		UseCount:    t.UseCount,
+		HashScheme:  t.HashScheme,
+		BoundKey:    t.BoundKey,
+	}
+}
+
+func (g *Gateway) listTokenOwners(w http.ResponseWriter, req *http.Request) {
+	owners, err := g.tdb.Owners(req.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if owners == nil {
+		owners = []string{}
+	}
+	writeJSON(w, owners)
+}
+
+// revokeTokens revokes every active token of an owner (optionally with a given
+// description) or every token which expires after expiresAfter from now
+func (g *Gateway) revokeTokens(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Owner        string    `json:"owner"`
+		Description  string    `json:"description"`
+		ExpiresAfter *Duration `json:"expiresAfter"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	filter := store.TokenFilter{Owner: body.Owner, Description: body.Description}
+	if body.ExpiresAfter != nil {
+		filter.ExpiresAfter = time.Now().Add(time.Duration(*body.ExpiresAfter))
+	}
+	n, err := g.tdb.RevokeWhere(req.Context(), filter)
+	slog.Info("Tokens revoked", "owner", body.Owner, "description", body.Description, "expiresAfter", body.ExpiresAfter, "count", n, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, struct {
+		Revoked int64 `json:"revoked"`
+	}{Revoked: n})
+}
+
+func (g *Gateway) purgeTokens(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		OlderThan Duration `json:"olderThan"`
+	}
+	if req.ContentLength != 0 {
+		if err := readJSON(&body, req, w); err != nil {
+			return
+		}
+	}
+	n, err := g.tdb.Purge(req.Context(), time.Duration(body.OlderThan))
+	slog.Info("Expired tokens purged", "olderThan", body.OlderThan, "count", n, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, struct {
+		Purged int64 `json:"purged"`
+	}{Purged: n})
+}
+
+func (g *Gateway) issueToken(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Owner       string   `json:"owner"`
+		Description string   `json:"description"`
+		TTL         Duration `json:"ttl"`
+		Lifetime    bool     `json:"lifetime"`
+		Scopes      []string `json:"scopes"`
+		BoundKey    string   `json:"boundKey"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	ttl := time.Duration(body.TTL)
+	switch {
+	case body.Owner == "":
+		writeError(w, fmt.Errorf("%w: owner is required", errInvalidRequest))
+		return
+	case body.Lifetime:
+		ttl = -1
+	case ttl <= 0:
+		writeError(w, fmt.Errorf("%w: ttl must be positive, for lifetime access use lifetime", errInvalidRequest))
+		return
+	}
+	if err := g.checkBindableKey(req.Context(), body.BoundKey); err != nil {
+		writeError(w, err)
+		return
+	}
+	token, err := g.tdb.IssueBound(req.Context(), body.Owner, body.Description, ttl, body.BoundKey, body.Scopes...)
+	slog.Info("Token issued", "owner", body.Owner, "ttl", ttl, "scopes", body.Scopes, "boundKey", body.BoundKey, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	id, _ := TokenID(token)
+	writeJSON(w, apiToken{ID: id, Owner: body.Owner, Description: body.Description, Active: true, Scopes: body.Scopes, BoundKey: body.BoundKey, Token: token})
+}
+
+// bindTokenAPI binds the token to the key in the fingerprint field of the body,
+// an empty fingerprint removes the binding
+func (g *Gateway) bindTokenAPI(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	id := req.PathValue("id")
+	err := g.bindToken(req.Context(), id, body.Fingerprint)
+	slog.Info("Token bound", "id", id, "fingerprint", body.Fingerprint, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) revokeToken(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	err := g.tdb.Revoke(req.Context(), id)
+	slog.Info("Token revoked", "id", id, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) tokenCacheStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, g.tdb.CacheStats())
+}
+
+func (g *Gateway) getRegistration(w http.ResponseWriter, req *http.Request) {
+	reg, err := g.kdb.KeyRegistration(req.Context(), req.URL.Query().Get("fingerprint"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &reg)
+}
+
+func (g *Gateway) listRegistrations(w http.ResponseWriter, req *http.Request) {
+	status := RegistrationStatus(req.URL.Query().Get("status"))
+	regs, err := g.kdb.ListKeyRegistrations(req.Context(), status)
+	if err != nil {
+		slog.Error("Unable to list key registrations", "err", err)
+		writeError(w, err)
+		return
+	}
+	if regs == nil {
+		regs = []KeyRegistration{}
+	}
+	writeJSON(w, regs)
+}
+
+func (g *Gateway) approveRegistration(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Fingerprint string   `json:"fingerprint"`
+		ValidFor    Duration `json:"validFor"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	user, _ := getUser(req)
+	reg, err := g.kdb.ApproveKeyRegistration(req.Context(), body.Fingerprint, user, time.Duration(body.ValidFor))
+	slog.Info("Key registration approved", "fingerprint", body.Fingerprint, "validFor", time.Duration(body.ValidFor), "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &reg)
+}
+
+func (g *Gateway) rejectRegistration(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Fingerprint string `json:"fingerprint"`
+		Reason      string `json:"reason"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	user, _ := getUser(req)
+	reg, err := g.kdb.RejectKeyRegistration(req.Context(), body.Fingerprint, user, body.Reason)
+	slog.Info("Key registration rejected", "fingerprint", body.Fingerprint, "reason", body.Reason, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &reg)
+}
+
+func newAPIUser(u store.User) apiUser {
+	ret := apiUser{ID: u.ID, DisplayName: u.DisplayName, Status: string(u.Status), Metadata: u.Metadata, CreatedAt: u.CreatedAt}
+	if ret.Metadata == nil {
+		ret.Metadata = map[string]string{}
+	}
+	return ret
+}
+
+func (g *Gateway) listUsers(w http.ResponseWriter, req *http.Request) {
+	users, err := g.kdb.ListUsers(req.Context())
+	if err != nil {
+		slog.Error("Unable to list users", "err", err)
+		writeError(w, err)
+		return
+	}
+	ret := make([]apiUser, len(users))
+	for i, u := range users {
+		ret[i] = newAPIUser(u)
+	}
+	writeJSON(w, ret)
+}
+
+// putUser creates or updates the display name and metadata of a user, the status is kept
+func (g *Gateway) putUser(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		ID          string            `json:"id"`
+		DisplayName string            `json:"displayName"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	err := g.kdb.PutUser(req.Context(), store.User{ID: body.ID, DisplayName: body.DisplayName, Metadata: body.Metadata})
+	slog.Info("User updated", "user", body.ID, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	user, err := g.kdb.GetUser(req.Context(), body.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newAPIUser(user))
+}
+
+// getUserAssets returns the user with every key, token and registration they own
+func (g *Gateway) getUserAssets(w http.ResponseWriter, req *http.Request) {
+	assets, err := g.userAssets(req.Context(), req.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ret := apiUserAssets{
+		apiUser:       newAPIUser(assets.User),
+		Keys:          make([]apiKey, len(assets.Keys)),
+		Tokens:        make([]apiToken, len(assets.Tokens)),
+		Registrations: assets.Registrations,
+	}
+	for i, k := range assets.Keys {
+		ret.Keys[i] = newAPIKey(k)
+	}
+	for i, t := range assets.Tokens {
+		ret.Tokens[i] = newAPIToken(t)
+	}
+	if ret.Registrations == nil {
+		ret.Registrations = []KeyRegistration{}
+	}
+	writeJSON(w, ret)
+}
+
+func (g *Gateway) changeUserStatus(status store.UserStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := req.PathValue("id")
+		if err := g.setUserStatus(req.Context(), id, status); err != nil {
+			writeError(w, err)
+			return
+		}
+		user, err := g.kdb.GetUser(req.Context(), id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, newAPIUser(user))
+	}
+}
+
+func newAPIGroup(group Group) apiGroup {
+	ret := apiGroup{
+		Name:        group.Name,
+		Description: group.Description,
+		Permissions: make([]apiPermission, len(group.Permissions)),
+		Keys:        group.Keys,
+		Users:       group.Users,
+	}
+	for i, p := range group.Permissions {
+		ret.Permissions[i] = apiPermission{Operation: p.Operation, Resource: p.Resource, Action: p.Action}
+	}
+	if ret.Keys == nil {
+		ret.Keys = []string{}
+	}
+	if ret.Users == nil {
+		ret.Users = []string{}
+	}
+	return ret
+}
+
+func writeGroup(w http.ResponseWriter, group Group, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newAPIGroup(group))
+}
+
+func (g *Gateway) listGroups(w http.ResponseWriter, req *http.Request) {
+	groups, err := g.kdb.ListGroups(req.Context())
+	if err != nil {
+		slog.Error("Unable to list groups", "err", err)
+		writeError(w, err)
+		return
+	}
+	ret := make([]apiGroup, len(groups))
+	for i, gr := range groups {
+		ret[i] = newAPIGroup(gr)
+	}
+	writeJSON(w, ret)
+}
+
+// putGroup creates a group or changes its description, permissions and members are kept
+func (g *Gateway) putGroup(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	group, err := g.kdb.PutGroup(req.Context(), body.Name, body.Description)
+	slog.Info("Group updated", "group", body.Name, "err", err)
+	writeGroup(w, group, err)
+}
+
+func (g *Gateway) getGroup(w http.ResponseWriter, req *http.Request) {
+	group, err := g.kdb.GetGroup(req.Context(), req.PathValue("name"))
+	writeGroup(w, group, err)
+}
+
+func (g *Gateway) deleteGroup(w http.ResponseWriter, req *http.Request) {
+	err := g.kdb.DeleteGroup(req.Context(), req.PathValue("name"))
+	slog.Info("Group deleted", "group", req.PathValue("name"), "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) setGroupPermission(w http.ResponseWriter, req *http.Request) {
+	var body apiPermission
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	body.Action = strings.ToLower(body.Action)
+	if err := validatePermission(body.Operation, body.Resource, body.Action); err != nil {
+		writeError(w, err)
+		return
+	}
+	name := req.PathValue("name")
+	group, err := g.kdb.SetGroupPermission(req.Context(), name, body.Operation, body.Resource, body.Action)
+	slog.Info("Group authorization", "group", name, "operation", body.Operation, "resource", body.Resource, "action", body.Action, "err", err)
+	writeGroup(w, group, err)
+}
+
+func readGroupMember(w http.ResponseWriter, req *http.Request) (apiGroupMember, bool) {
+	var body apiGroupMember
+	if err := readJSON(&body, req, w); err != nil {
+		return body, false
+	}
+	if (body.Fingerprint == "") == (body.User == "") {
+		writeError(w, fmt.Errorf("%w: either fingerprint or user is required", errInvalidRequest))
+		return body, false
+	}
+	return body, true
+}
+
+func (g *Gateway) addGroupMember(w http.ResponseWriter, req *http.Request) {
+	body, ok := readGroupMember(w, req)
+	if !ok {
+		return
+	}
+	name := req.PathValue("name")
+	var group Group
+	var err error
+	if body.Fingerprint != "" {
+		group, err = g.kdb.AddGroupKey(req.Context(), name, body.Fingerprint)
+	} else {
+		group, err = g.kdb.AddGroupUser(req.Context(), name, body.User)
+	}
+	slog.Info("Group member added", "group", name, "fingerprint", body.Fingerprint, "user", body.User, "err", err)
+	writeGroup(w, group, err)
+}
+
+func (g *Gateway) removeGroupMember(w http.ResponseWriter, req *http.Request) {
+	body, ok := readGroupMember(w, req)
+	if !ok {
+		return
+	}
+	name := req.PathValue("name")
+	group, err := g.kdb.RemoveGroupMember(req.Context(), name, body.Fingerprint, body.User)
+	slog.Info("Group member removed", "group", name, "fingerprint", body.Fingerprint, "user", body.User, "err", err)
+	writeGroup(w, group, err)
+}
+
+func newAPIPolicyScript(s PolicyScript) apiPolicyScript {
+	return apiPolicyScript{Name: s.Name, Source: s.Source, Enforce: s.Enforce, UpdatedAt: s.UpdatedAt}
+}
+
+func (g *Gateway) listPolicyScripts(w http.ResponseWriter, req *http.Request) {
+	scripts, err := g.kdb.ListPolicyScripts(req.Context())
+	if err != nil {
+		slog.Error("Unable to list policy scripts", "err", err)
+		writeError(w, err)
+		return
+	}
+	ret := make([]apiPolicyScript, len(scripts))
+	for i, s := range scripts {
+		ret[i] = newAPIPolicyScript(s)
+	}
+	writeJSON(w, ret)
+}
+
+// putPolicyScript compiles and stores a policy script, scripts are dry-run unless enforce is set
+func (g *Gateway) putPolicyScript(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name    string `json:"name"`
+		Source  string `json:"source"`
+		Enforce bool   `json:"enforce"`
+	}
+	if err := readJSON(&body, req, w); err != nil {
+		return
+	}
+	script, err := g.kdb.PutPolicyScript(req.Context(), body.Name, body.Source, body.Enforce)
+	slog.Info("Policy script updated", "script", body.Name, "enforce", body.Enforce, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newAPIPolicyScript(script))
+}
+
+func (g *Gateway) getPolicyScript(w http.ResponseWriter, req *http.Request) {
+	script, err := g.kdb.GetPolicyScript(req.Context(), req.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, newAPIPolicyScript(script))
+}
+
+func (g *Gateway) deletePolicyScript(w http.ResponseWriter, req *http.Request) {
+	err := g.kdb.DeletePolicyScript(req.Context(), req.PathValue("name"))
+	slog.Info("Policy script deleted", "script", req.PathValue("name"), "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
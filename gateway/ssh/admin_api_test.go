@@ -0,0 +1,72 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/store"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestExplainSourceIP(t *testing.T) {
+	ctx := context.Background()
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdb := &DynKDB{Store: st}
+	g, err := NewGateway(kdb, &TokenDB{Store: *st}, nil, GenerateCAKey([ed25519.SeedSize]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := g.tdb.Issue(ctx, AdminTokenOwner, "test", time.Hour, ScopeAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kdb.RegisterKey(ctx, key, "alice", time.Now().Add(-time.Minute), time.Now().Add(time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kdb.PutPolicyScript(ctx, "office-only", `return input.sourceIP == "192.0.2.1"`, true); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	g.adminRoutes(mux)
+
+	explain := func(remoteAddr string) apiDecision {
+		t.Helper()
+		query := url.Values{"fingerprint": {gossh.FingerprintSHA256(key)}, "operation": {exposeEndpointOperation}, "resource": {"svc.example.com"}}
+		req := httptest.NewRequest("GET", "/gateway/ssh/admin/key/explain?"+query.Encode(), nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %v: %v", w.Code, w.Body)
+		}
+		var decision apiDecision
+		if err := json.Unmarshal(w.Body.Bytes(), &decision); err != nil {
+			t.Fatal(err)
+		}
+		return decision
+	}
+	if d := explain("192.0.2.1:1234"); !d.Allowed || d.Source != "script:office-only" {
+		t.Fatalf("Script should see the client address, got %#v", d)
+	}
+	if d := explain("198.51.100.7:1234"); d.Allowed {
+		t.Fatalf("Script should deny other addresses, got %#v", d)
+	}
+}
@@ -0,0 +1,191 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/store"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type (
+	// caSet holds the CAs known by the gateway, during a rotation
+	// next is published alongside current and takes over after the cutover
+	caSet struct {
+		current gossh.Signer
+		next    gossh.Signer
+		retired map[string]bool
+	}
+
+	// RetiredCA is a CA which is no longer published or used to sign certificates
+	RetiredCA struct {
+		Fingerprint string `json:"fingerprint"`
+		RetiredAt   int64  `json:"retiredAt"`
+	}
+)
+
+const (
+	retiredCAPrefix = "gateway:ca-retired:"
+
+	// caCheckInterval is how often the gateway looks for retired CAs
+	// and checks if the host certificate must be signed by another CA
+	caCheckInterval = time.Minute
+)
+
+// SetNextCA configures the CA which replaces the current one after
+// Settings.CACutover, both are published until one of them is retired.
+func (g *Gateway) SetNextCA(key CAKey) error {
+	signer, err := genCASigner(key)
+	if err != nil {
+		return err
+	}
+	cas := *g.cas.Load()
+	cas.next = signer
+	g.cas.Store(&cas)
+	return nil
+}
+
+// signingCA returns the CA used for new certificates, the next CA is used
+// after the cutover or as soon as the current one is retired
+func (g *Gateway) signingCA() gossh.Signer {
+	cas := g.cas.Load()
+	if cas.next == nil {
+		return cas.current
+	}
+	cutover := g.settings().CACutover
+	switch {
+	case cas.retired[gossh.FingerprintSHA256(cas.current.PublicKey())]:
+		return cas.next
+	case !cutover.IsZero() && !time.Now().Before(cutover):
+		return cas.next
+	}
+	return cas.current
+}
+
+// trustedCAs returns the CAs which clients should trust, the one used to sign
+// new certificates is always included
+func (g *Gateway) trustedCAs() []gossh.PublicKey {
+	cas := g.cas.Load()
+	signing := g.signingCA()
+	ret := []gossh.PublicKey{signing.PublicKey()}
+	for _, s := range []gossh.Signer{cas.current, cas.next} {
+		if s == nil || s == signing || cas.retired[gossh.FingerprintSHA256(s.PublicKey())] {
+			continue
+		}
+		ret = append(ret, s.PublicKey())
+	}
+	return ret
+}
+
+// RetireCA marks the CA with the given fingerprint as retired, running gateways
+// stop publishing it within a minute. The fingerprint must be the one of current
+// or next (nil if there is no rotation in progress), and the current CA can only be
+// retired in favor of the next one.
+func RetireCA(ctx context.Context, st *store.Store, fingerprint string, current CAKey, next *CAKey) error {
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		return errors.New("gateway: CA fingerprint should be in the SHA256:<base64> format")
+	}
+	currentFP, err := caFingerprint(current)
+	if err != nil {
+		return err
+	}
+	nextFP := ""
+	if next != nil {
+		if nextFP, err = caFingerprint(*next); err != nil {
+			return err
+		}
+	}
+	var other string
+	switch fingerprint {
+	case currentFP:
+		if next == nil {
+			return fmt.Errorf("gateway: refusing to retire the current CA %v without a next CA to replace it", fingerprint)
+		}
+		other = nextFP
+	case nextFP:
+		other = currentFP
+	default:
+		if next == nil {
+			return fmt.Errorf("gateway: %v is not the current CA (%v)", fingerprint, currentFP)
+		}
+		return fmt.Errorf("gateway: %v is neither the current CA (%v) nor the next CA (%v)", fingerprint, currentFP, nextFP)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+	var entry RetiredCA
+	if err := store.GetJSON(ctx, &entry, ops.KV(), retiredCAPrefix+other); err == nil {
+		return fmt.Errorf("gateway: refusing to retire %v, the other CA (%v) is already retired", fingerprint, other)
+	} else if !store.IsNotFound(err) {
+		return err
+	}
+	ops.Fail(store.PutJSON(ctx, ops.KV(), retiredCAPrefix+fingerprint, RetiredCA{
+		Fingerprint: fingerprint,
+		RetiredAt:   time.Now().UnixMilli(),
+	}))
+	return ops.Commit()
+}
+
+func caFingerprint(key CAKey) (string, error) {
+	pub, err := key.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	return gossh.FingerprintSHA256(pub), nil
+}
+
+func (g *Gateway) loadRetiredCAs(ctx context.Context) error {
+	cas := *g.cas.Load()
+	retired := map[string]bool{}
+	ops := g.kdb.Store.Ops(false)
+	defer ops.Close()
+	for _, s := range []gossh.Signer{cas.current, cas.next} {
+		if s == nil {
+			continue
+		}
+		fingerprint := gossh.FingerprintSHA256(s.PublicKey())
+		var entry RetiredCA
+		err := store.GetJSON(ctx, &entry, ops.KV(), retiredCAPrefix+fingerprint)
+		if store.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("gateway: unable to check if CA %v is retired: %w", fingerprint, err)
+		}
+		retired[fingerprint] = true
+	}
+	if cas.next == nil && len(retired) > 0 {
+		slog.Error("Current CA is retired but there is no next CA, it will still be used")
+	}
+	cas.retired = retired
+	g.cas.Store(&cas)
+	return nil
+}
+
+// watchCAs refreshes the list of retired CAs and renews the host
+// certificate once it is no longer signed by the signing CA
+func (g *Gateway) watchCAs(ctx context.Context) {
+	ticker := time.NewTicker(caCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.loadRetiredCAs(ctx); err != nil {
+			slog.Error("Unable to load retired CAs", "err", err)
+		}
+		host := g.host.Load()
+		signing := gossh.FingerprintSHA256(g.signingCA().PublicKey())
+		if host == nil || gossh.FingerprintSHA256(host.cert.SignatureKey) == signing {
+			continue
+		}
+		slog.Info("Signing CA changed, renewing host certificate", "ca", signing)
+		if err := g.renewHostKey(g.settings().Domains); err != nil {
+			slog.Error("Unable to renew host certificate", "err", err)
+		}
+	}
+}
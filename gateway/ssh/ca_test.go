@@ -0,0 +1,46 @@
+package ssh_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/andrebq/vandrare/gateway/ssh"
+	"github.com/andrebq/vandrare/internal/store"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func testCAKey(t *testing.T, b byte) (ssh.CAKey, string) {
+	var seed [ed25519.SeedSize]byte
+	seed[0] = b
+	key := ssh.GenerateCAKey(seed)
+	pub, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, gossh.FingerprintSHA256(pub)
+}
+
+func TestRetireCA(t *testing.T) {
+	ctx := context.Background()
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, currentFP := testCAKey(t, 1)
+	next, nextFP := testCAKey(t, 2)
+	_, otherFP := testCAKey(t, 3)
+
+	if err := ssh.RetireCA(ctx, st, currentFP, current, nil); err == nil {
+		t.Fatal("Current CA should not be retired without a next CA")
+	}
+	if err := ssh.RetireCA(ctx, st, otherFP, current, &next); err == nil {
+		t.Fatal("Unknown CAs should not be retired")
+	}
+	if err := ssh.RetireCA(ctx, st, currentFP, current, &next); err != nil {
+		t.Fatal(err)
+	}
+	if err := ssh.RetireCA(ctx, st, nextFP, current, &next); err == nil {
+		t.Fatal("Both CAs should not be retired")
+	}
+}
@@ -0,0 +1,347 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/loadbalancer"
+	"github.com/andrebq/vandrare/internal/proxyproto"
+	"github.com/andrebq/vandrare/internal/store"
+	"github.com/gliderlabs/ssh"
+)
+
+type (
+	// Duration is a time.Duration encoded as a string (eg.: "10s") in JSON
+	Duration time.Duration
+
+	// Config has every setting of the gateway, see LoadConfig.
+	//
+	// Bindings, StoreDir, Network.ProxyProtocol.TrustedUpstreams and
+	// Network.Keepalive.TCP are only read at startup, everything else
+	// can be changed with Gateway.Reload.
+	Config struct {
+		Bindings struct {
+			SSH  string `json:"ssh"`
+			HTTP string `json:"http"`
+		} `json:"bindings"`
+		StoreDir string `json:"storeDir"`
+
+		// Domains are the addresses (domain:port) of the gateway itself
+		Domains []string `json:"domains"`
+		// Subdomains which can be authorized by this gateway
+		Subdomains []string `json:"subdomains"`
+
+		// AdminKeys are entries in the authorized_keys format
+		AdminKeys []string `json:"adminKeys"`
+		// AdminKeyFiles are files with a single public key each
+		AdminKeyFiles []string `json:"adminKeyFiles"`
+
+		CA struct {
+			// NextCutover is when certificates start to be signed by
+			// the next CA (RFC3339), empty means never
+			NextCutover string `json:"nextCutover"`
+		} `json:"ca"`
+
+		Quotas struct {
+			EndpointQueueSize     int `json:"endpointQueueSize"`
+			MaxWaitingPerEndpoint int `json:"maxWaitingPerEndpoint"`
+		} `json:"quotas"`
+
+		Policies struct {
+			Egress struct {
+				Enabled     bool     `json:"enabled"`
+				DialTimeout Duration `json:"dialTimeout"`
+			} `json:"egress"`
+			WaitBackend          Duration `json:"waitBackend"`
+			EndpointOfferTimeout Duration `json:"endpointOfferTimeout"`
+			EndpointSkipBusy     bool     `json:"endpointSkipBusy"`
+			Tokens               struct {
+				// IdleExpiry expires tokens unused for that long, zero disables it
+				IdleExpiry Duration `json:"idleExpiry"`
+				// CacheTTL is how long successful validations are cached, zero disables it
+				CacheTTL  Duration `json:"cacheTTL"`
+				CacheSize int      `json:"cacheSize"`
+				// RotationOverlap is the longest a rotated token remains valid
+				RotationOverlap Duration `json:"rotationOverlap"`
+				// Hash is how token secrets are hashed, tokens with weaker
+				// hashes are rehashed when used
+				Hash struct {
+					Algorithm  string `json:"algorithm"`
+					BcryptCost int    `json:"bcryptCost"`
+					Argon2     struct {
+						Time      uint32 `json:"time"`
+						MemoryKiB uint32 `json:"memoryKiB"`
+						Threads   uint8  `json:"threads"`
+					} `json:"argon2"`
+				} `json:"hash"`
+			} `json:"tokens"`
+		} `json:"policies"`
+
+		Network struct {
+			Keepalive struct {
+				Interval  Duration `json:"interval"`
+				MaxMissed int      `json:"maxMissed"`
+				TCP       Duration `json:"tcp"`
+			} `json:"keepalive"`
+			ProxyProtocol struct {
+				TrustedUpstreams []string `json:"trustedUpstreams"`
+				EmitToBackends   bool     `json:"emitToBackends"`
+			} `json:"proxyProtocol"`
+		} `json:"network"`
+	}
+)
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var str string
+	if err := json.Unmarshal(buf, &str); err != nil {
+		return err
+	}
+	val, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(val)
+	return nil
+}
+
+// DefaultConfig returns the configuration used when nothing else is provided
+func DefaultConfig() Config {
+	var cfg Config
+	cfg.Bindings.SSH = "127.0.0.1:2222"
+	cfg.Bindings.HTTP = "127.0.0.1:8222"
+
+	lbopts := loadbalancer.DefaultOptions()
+	cfg.Quotas.EndpointQueueSize = lbopts.QueueSize
+	cfg.Quotas.MaxWaitingPerEndpoint = 16
+	cfg.Policies.EndpointOfferTimeout = Duration(lbopts.OfferTimeout)
+	cfg.Policies.EndpointSkipBusy = lbopts.SkipBusy
+	cfg.Policies.Egress.DialTimeout = Duration(time.Second * 10)
+	cfg.Policies.Tokens.CacheTTL = Duration(defaultTokenCacheTTL)
+	cfg.Policies.Tokens.CacheSize = defaultTokenCacheSize
+	cfg.Policies.Tokens.RotationOverlap = Duration(time.Minute * 5)
+	bcryptPolicy, argon2Policy := store.DefaultHashPolicy(), store.DefaultArgon2idPolicy()
+	cfg.Policies.Tokens.Hash.Algorithm = bcryptPolicy.Algorithm
+	cfg.Policies.Tokens.Hash.BcryptCost = bcryptPolicy.BcryptCost
+	cfg.Policies.Tokens.Hash.Argon2.Time = argon2Policy.Argon2Time
+	cfg.Policies.Tokens.Hash.Argon2.MemoryKiB = argon2Policy.Argon2Memory
+	cfg.Policies.Tokens.Hash.Argon2.Threads = argon2Policy.Argon2Threads
+
+	cfg.Network.Keepalive.Interval = Duration(time.Second * 30)
+	cfg.Network.Keepalive.MaxMissed = 3
+	cfg.Network.Keepalive.TCP = Duration(time.Second * 15)
+	return cfg
+}
+
+// LoadConfig reads file and decodes it on top of base, so fields which
+// are absent from the file keep the values from base.
+func LoadConfig(file string, base Config) (Config, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return Config{}, fmt.Errorf("gateway: unable to read config file: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewBuffer(buf))
+	dec.DisallowUnknownFields()
+	cfg := base
+	// slices are replaced, not merged, with whatever is in the file
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("gateway: invalid config file %v: %w", file, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks if the configuration can be used to start a gateway,
+// all problems are reported at once.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Bindings.SSH == "" && c.Bindings.HTTP == "" {
+		errs = append(errs, errors.New("at least one of bindings.ssh or bindings.http is required"))
+	}
+	if c.StoreDir == "" {
+		errs = append(errs, errors.New("storeDir is required"))
+	}
+	if len(c.Domains) == 0 {
+		errs = append(errs, errors.New("at least one entry in domains is required"))
+	}
+	if len(c.Subdomains) == 0 {
+		errs = append(errs, errors.New("at least one entry in subdomains is required"))
+	}
+	if keys, err := c.adminKeys(); err != nil {
+		errs = append(errs, err)
+	} else if len(keys) == 0 {
+		errs = append(errs, errors.New("at least one admin key is required"))
+	}
+	if c.CA.NextCutover != "" {
+		if _, err := time.Parse(time.RFC3339, c.CA.NextCutover); err != nil {
+			errs = append(errs, fmt.Errorf("ca.nextCutover: %w", err))
+		}
+	}
+	if c.Quotas.EndpointQueueSize < 0 {
+		errs = append(errs, errors.New("quotas.endpointQueueSize cannot be negative"))
+	}
+	if c.Quotas.MaxWaitingPerEndpoint < 0 {
+		errs = append(errs, errors.New("quotas.maxWaitingPerEndpoint cannot be negative"))
+	}
+	if c.Policies.Tokens.CacheSize < 0 {
+		errs = append(errs, errors.New("policies.tokens.cacheSize cannot be negative"))
+	}
+	if err := c.tokenHash().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("policies.tokens.hash: %w", err))
+	}
+	for name, d := range map[string]Duration{
+		"policies.egress.dialTimeout":     c.Policies.Egress.DialTimeout,
+		"policies.waitBackend":            c.Policies.WaitBackend,
+		"policies.endpointOfferTimeout":   c.Policies.EndpointOfferTimeout,
+		"policies.tokens.idleExpiry":      c.Policies.Tokens.IdleExpiry,
+		"policies.tokens.cacheTTL":        c.Policies.Tokens.CacheTTL,
+		"policies.tokens.rotationOverlap": c.Policies.Tokens.RotationOverlap,
+		"network.keepalive.interval":      c.Network.Keepalive.Interval,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%v cannot be negative", name))
+		}
+	}
+	if _, err := proxyproto.ParseCIDRs(c.Network.ProxyProtocol.TrustedUpstreams); err != nil {
+		errs = append(errs, fmt.Errorf("network.proxyProtocol.trustedUpstreams: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (c Config) adminKeys() ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, k := range c.AdminKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin key %q: %w", k, err)
+		}
+		keys = append(keys, key)
+	}
+	for _, f := range c.AdminKeyFiles {
+		key, err := ParseAuthorizedKey(f)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (c Config) tokenHash() store.HashPolicy {
+	hash := c.Policies.Tokens.Hash
+	return store.HashPolicy{
+		Algorithm:     hash.Algorithm,
+		BcryptCost:    hash.BcryptCost,
+		Argon2Time:    hash.Argon2.Time,
+		Argon2Memory:  hash.Argon2.MemoryKiB,
+		Argon2Threads: hash.Argon2.Threads,
+	}
+}
+
+func (c Config) settings() (Settings, error) {
+	var s Settings
+	var err error
+	s.Domains = slices.Clone(c.Domains)
+	WrapIP(s.Domains)
+	s.Subdomains = slices.Clone(c.Subdomains)
+	WrapIP(s.Subdomains)
+	s.AdminKeys, err = c.adminKeys()
+	if err != nil {
+		return Settings{}, err
+	}
+
+	if c.CA.NextCutover != "" {
+		s.CACutover, err = time.Parse(time.RFC3339, c.CA.NextCutover)
+		if err != nil {
+			return Settings{}, err
+		}
+	}
+
+	s.Egress.Enabled = c.Policies.Egress.Enabled
+	s.Egress.DialTimeout = time.Duration(c.Policies.Egress.DialTimeout)
+
+	s.Keepalive.Interval = time.Duration(c.Network.Keepalive.Interval)
+	s.Keepalive.MaxMissed = c.Network.Keepalive.MaxMissed
+	s.Keepalive.TCP = time.Duration(c.Network.Keepalive.TCP)
+
+	s.ProxyProtocol.TrustedUpstreams, err = proxyproto.ParseCIDRs(c.Network.ProxyProtocol.TrustedUpstreams)
+	if err != nil {
+		return Settings{}, err
+	}
+	s.ProxyProtocol.EmitToBackends = c.Network.ProxyProtocol.EmitToBackends
+
+	s.Balancer = loadbalancer.Options{
+		QueueSize:    c.Quotas.EndpointQueueSize,
+		OfferTimeout: time.Duration(c.Policies.EndpointOfferTimeout),
+		SkipBusy:     c.Policies.EndpointSkipBusy,
+	}
+	s.WaitBackend.Grace = time.Duration(c.Policies.WaitBackend)
+	s.WaitBackend.MaxWaiting = c.Quotas.MaxWaitingPerEndpoint
+	s.TokenIdleExpiry = time.Duration(c.Policies.Tokens.IdleExpiry)
+	s.TokenCache.TTL = time.Duration(c.Policies.Tokens.CacheTTL)
+	s.TokenCache.Size = c.Policies.Tokens.CacheSize
+	s.TokenHash = c.tokenHash()
+	s.TokenRotationOverlap = time.Duration(c.Policies.Tokens.RotationOverlap)
+	return s, nil
+}
+
+// Apply the configuration to a gateway which is not running yet
+func (g *Gateway) Apply(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	settings, err := cfg.settings()
+	if err != nil {
+		return err
+	}
+	g.Binding.SSH = cfg.Bindings.SSH
+	g.Binding.HTTP = cfg.Bindings.HTTP
+	g.Settings = settings
+	return nil
+}
+
+// Reload replaces the settings of a running gateway, settings
+// which require new listeners are ignored (with a warning).
+//
+// The host certificate is regenerated to match the new list of domains.
+func (g *Gateway) Reload(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	next, err := cfg.settings()
+	if err != nil {
+		return err
+	}
+	current := g.settings()
+	if cfg.Bindings.SSH != g.Binding.SSH || cfg.Bindings.HTTP != g.Binding.HTTP {
+		slog.Warn("Bindings cannot be changed without a restart, ignoring")
+	}
+	if !slices.EqualFunc(next.ProxyProtocol.TrustedUpstreams, current.ProxyProtocol.TrustedUpstreams, func(a, b *net.IPNet) bool { return a.String() == b.String() }) {
+		slog.Warn("Trusted upstreams cannot be changed without a restart, ignoring")
+	}
+	next.ProxyProtocol.TrustedUpstreams = current.ProxyProtocol.TrustedUpstreams
+	next.Keepalive.TCP = current.Keepalive.TCP
+
+	// settings are only published once everything derived from them is ready
+	if err := g.tdb.SetHashPolicy(next.TokenHash); err != nil {
+		return err
+	}
+	if g.Binding.SSH != "" {
+		if err := g.renewHostKey(next.Domains); err != nil {
+			return err
+		}
+	}
+	g.tdb.SetCache(next.TokenCache.TTL, next.TokenCache.Size)
+	g.live.Store(&next)
+	slog.Info("Configuration reloaded", "domains", next.Domains, "subdomains", next.Subdomains, "adminKeys", len(next.AdminKeys))
+	return nil
+}
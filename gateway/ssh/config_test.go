@@ -0,0 +1,49 @@
+package ssh_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/gateway/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestReloadBeforeRun(t *testing.T) {
+	kdb := newTestKDB(t)
+	g, err := ssh.NewGateway(kdb, &ssh.TokenDB{Store: *kdb.Store}, nil, ssh.GenerateCAKey([ed25519.SeedSize]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := ssh.DefaultConfig()
+	cfg.Bindings.SSH = ""
+	cfg.Bindings.HTTP = "127.0.0.1:0"
+	cfg.StoreDir = t.TempDir()
+	cfg.Domains = []string{"localhost:2222"}
+	cfg.Subdomains = []string{"example.com"}
+	cfg.AdminKeys = []string{string(gossh.MarshalAuthorizedKey(newTestKey(t)))}
+	if err := g.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	// SIGHUP is handled as soon as the process starts, so a reload may happen before Run
+	cfg.Subdomains = []string{"example.org"}
+	if err := g.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.Run(ctx) }()
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("Gateway did not stop")
+	}
+	if live := g.LiveSettings(); !slices.Equal(live.Subdomains, cfg.Subdomains) {
+		t.Fatalf("Run should keep the reloaded settings, got %v", live.Subdomains)
+	}
+}
@@ -3,6 +3,7 @@ package ssh
 import (
 	"fmt"
 	"net"
+	"strings"
 )
 
 // WrapIP updates entries and rewrites any IPv4 pair IP:Port
@@ -20,3 +21,16 @@ func wrapIP(v string) string {
 	}
 	return fmt.Sprintf("[%v]:%v", host, port)
 }
+
+// isEndpointHost returns true if host is one of the subdomains, or a name under one of them,
+// so it could be exposed by a tunnel
+func (g *Gateway) isEndpointHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range g.settings().Subdomains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
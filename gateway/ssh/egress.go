@@ -0,0 +1,228 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/andrebq/vandrare/internal/policy"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	egressOperation = "egress"
+)
+
+var (
+	errEgressDisabled = errors.New("ssh: egress is disabled")
+)
+
+// egressRule is the parsed form of the resource of an egress permission,
+// it can be either "<cidr>:<port>" or "<hostname>:<port>", where port
+// might be "*" to allow any port and hostname a glob like "*.example.com".
+type egressRule struct {
+	network  *net.IPNet
+	hostname string
+	port     uint32
+	anyPort  bool
+}
+
+func parseEgressRule(resource string) (egressRule, error) {
+	host, port, err := net.SplitHostPort(resource)
+	if err != nil {
+		return egressRule{}, fmt.Errorf("ssh: invalid egress rule %q: %w", resource, err)
+	}
+	var rule egressRule
+	if port == "*" {
+		rule.anyPort = true
+	} else {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return egressRule{}, fmt.Errorf("ssh: invalid egress port %q: %w", port, err)
+		}
+		rule.port = uint32(p)
+	}
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		rule.network = network
+	} else if ip := net.ParseIP(host); ip != nil {
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+	} else {
+		rule.hostname = strings.ToLower(host)
+	}
+	return rule, nil
+}
+
+// matches returns true if host:port is covered by this rule. CIDR rules
+// only ever match literal IP addresses, hostnames must be resolved
+// by the caller before checking them against a CIDR rule.
+func (r egressRule) matches(host string, port uint32) bool {
+	if !r.anyPort && r.port != port {
+		return false
+	}
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
+	}
+	return policy.Glob(r.hostname, strings.ToLower(host))
+}
+
+// matchEgress is the policy.Matcher of egress rules, resource must be host:port
+func matchEgress(pattern, resource string) bool {
+	if pattern == "*" {
+		return true
+	}
+	rule, err := parseEgressRule(pattern)
+	if err != nil {
+		slog.Warn("Ignoring invalid egress rule", "resource", pattern, "err", err)
+		return false
+	}
+	host, portStr, err := net.SplitHostPort(resource)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return false
+	}
+	return rule.matches(host, uint32(port))
+}
+
+// egressTargets checks if the key in ctx is allowed to reach host:port and
+// returns the addresses that can be dialed. Hostnames are resolved once and only
+// the resolved addresses are dialed, so a rule cannot be bypassed by
+// a DNS answer that changes between authorization and dial.
+//
+// Hostnames are only resolved if the name is allowed or if the key has an
+// egress allow rule for addresses (see allowsEgressByAddress).
+func (g *Gateway) egressTargets(ctx ssh.Context, host string, port uint32) ([]net.IP, error) {
+	if !g.settings().Egress.Enabled {
+		return nil, errEgressDisabled
+	}
+	key, _ := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if key == nil {
+		return nil, errNotAuthorized
+	}
+
+	explain := func(host string) (policy.Decision, error) {
+		return g.kdb.Explain(ctx, key, egressOperation, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+	var candidates []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		if d, err := explain(ip.String()); err != nil {
+			return nil, err
+		} else if !d.Allowed {
+			return nil, errNotAuthorized
+		}
+		return append(candidates, ip), nil
+	}
+	byName, err := explain(host)
+	if err != nil {
+		return nil, err
+	} else if !byName.Allowed && byName.Rule != nil {
+		// explicitly denied
+		return nil, errNotAuthorized
+	} else if !byName.Allowed {
+		// only address rules could allow it, don't resolve names for keys without them
+		if ok, err := g.kdb.allowsEgressByAddress(ctx, key, port); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, errNotAuthorized
+		}
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: unable to resolve %v: %w", host, err)
+	}
+	for _, a := range addrs {
+		byAddr, err := explain(a.IP.String())
+		if err != nil {
+			return nil, err
+		}
+		// addresses explicitly denied cannot be reached even if the name is allowed
+		if byAddr.Allowed || (byName.Allowed && byAddr.Rule == nil) {
+			candidates = append(candidates, a.IP)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errNotAuthorized
+	}
+	return candidates, nil
+}
+
+// allowsEgressByAddress returns true if any egress allow rule of key
+// is an IP or CIDR rule which covers port.
+func (d *DynKDB) allowsEgressByAddress(ctx context.Context, key ssh.PublicKey, port uint32) (bool, error) {
+	cfg, err := d.lookupAndVerifyConfig(ctx, key)
+	if errors.Is(err, errNotAuthorized) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	rules, err := d.effectiveRules(ctx, key, cfg)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rules {
+		if r.Effect != policy.Allow || !policy.Glob(r.Operation, egressOperation) {
+			continue
+		}
+		if r.Resource == "*" {
+			return true, nil
+		}
+		rule, err := parseEgressRule(r.Resource)
+		if err == nil && rule.network != nil && (rule.anyPort || rule.port == port) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (g *Gateway) dialEgress(ctx ssh.Context, targets []net.IP, port uint32) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: g.settings().Egress.DialTimeout}
+	var lastErr error
+	for _, ip := range targets {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (g *Gateway) egressAudit(ctx ssh.Context, data remoteForwardChannelData) *slog.Logger {
+	dest := net.JoinHostPort(data.DestAddr, strconv.Itoa(int(data.DestPort)))
+	audit := slog.With("user", ctx.User(), "remoteAddr", ctx.RemoteAddr(), "dest", dest)
+	if key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey); ok && key != nil {
+		audit = audit.With("fingerprint", gossh.FingerprintSHA256(key))
+	}
+	return audit
+}
+
+// handleEgress dials one of the authorized targets for newChan and pipes
+// the channel to it, every decision is logged for auditing purposes.
+func (g *Gateway) handleEgress(ctx ssh.Context, newChan gossh.NewChannel, data remoteForwardChannelData, targets []net.IP) bool {
+	audit := g.egressAudit(ctx, data)
+	conn, err := g.dialEgress(ctx, targets, data.DestPort)
+	if err != nil {
+		audit.Info("Egress failed", "err", err)
+		newChan.Reject(gossh.ConnectionFailed, "unable to connect")
+		return false
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		audit.Error("Unable to accept egress channel", "err", err)
+		conn.Close()
+		return false
+	}
+	audit.Info("Egress allowed", "dialed", conn.RemoteAddr())
+	go gossh.DiscardRequests(reqs)
+	go pipeAndLog(audit, ch, conn)
+	return true
+}
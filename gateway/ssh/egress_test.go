@@ -0,0 +1,46 @@
+package ssh_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/gateway/ssh"
+)
+
+func TestAllowsEgressByAddress(t *testing.T) {
+	ctx := context.Background()
+	kdb := newTestKDB(t)
+	key := newTestKey(t)
+	if err := kdb.RegisterKey(ctx, key, "alice", time.Now().Add(-time.Minute), time.Now().Add(time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	check := func(port uint32, expected bool) {
+		t.Helper()
+		if ok, err := ssh.AllowsEgressByAddress(kdb, ctx, key, port); err != nil {
+			t.Fatal(err)
+		} else if ok != expected {
+			t.Fatalf("Port %v: expected %v got %v", port, expected, ok)
+		}
+	}
+	check(22, false)
+	for _, p := range [][3]string{
+		{"egress", "*.example.com:*", "allow"},
+		{"egress", "10.0.0.0/8:*", "deny"},
+	} {
+		if err := kdb.SetPermission(ctx, key, p[0], p[1], p[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// names and denies never require resolving other names
+	check(22, false)
+	if err := kdb.SetPermission(ctx, key, "egress", "192.168.0.0/16:22", "allow"); err != nil {
+		t.Fatal(err)
+	}
+	check(22, true)
+	check(443, false)
+
+	if ok, err := ssh.AllowsEgressByAddress(kdb, ctx, newTestKey(t), 22); err != nil || ok {
+		t.Fatalf("Unknown keys should not be allowed, got %v %v", ok, err)
+	}
+}
@@ -0,0 +1,10 @@
+package ssh
+
+// AllowsEgressByAddress exposes allowsEgressByAddress to tests
+var AllowsEgressByAddress = (*DynKDB).allowsEgressByAddress
+
+// AuthorizeEndpoint exposes authorizeEndpoint to tests
+var AuthorizeEndpoint = (*Gateway).authorizeEndpoint
+
+// LiveSettings returns a copy of the settings used by the running gateway
+func (g *Gateway) LiveSettings() Settings { return *g.settings() }
@@ -1,8 +1,10 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
@@ -19,39 +21,70 @@ func (g *Gateway) handleDirectTCPIP(srv *ssh.Server, conn *gossh.ServerConn, new
 	}()
 
 	slog.Debug("Direct TCP/IP connection", "conn", conn.RemoteAddr(), "channel", newChan.ChannelType())
-	data := struct {
-		DestAddr string
-		DestPort uint32
-
-		OriginAddr string
-		OriginPort uint32
-	}{}
-
+	var data remoteForwardChannelData
 	if err := gossh.Unmarshal(newChan.ExtraData(), &data); err != nil {
 		slog.Error("Unable to parse connection target", "err", err)
 		newChan.Reject(gossh.ConnectionFailed, "invalid data from client")
 		return
 	}
 
-	ch, reqs, err := newChan.Accept()
-	if err != nil {
-		slog.Error("Unable to accept channel", "err", err)
-		newChan.Reject(gossh.ConnectionFailed, "invalid data from client")
-		return
-	}
-
-	go gossh.DiscardRequests(reqs)
 	slog.Debug("Attempting local connection", "data", data)
 	identity := fmt.Sprintf("%v:%v", data.DestAddr, data.DestPort)
 	lb := g.getLB(identity)
+	var egressErr error
+	if lb == nil && g.settings().Egress.Enabled {
+		var targets []net.IP
+		targets, egressErr = g.egressTargets(ctx, data.DestAddr, data.DestPort)
+		if egressErr == nil {
+			if g.handleEgress(ctx, newChan, data, targets) {
+				conn = nil
+			}
+			return
+		}
+	}
+	if lb == nil && egressErr != nil && !g.isEndpointHost(data.DestAddr) {
+		// authorizeEndpoint only registers names under the subdomains,
+		// no point in waiting for anything else
+		g.egressAudit(ctx, data).Info("Egress denied", "err", egressErr)
+		newChan.Reject(gossh.ConnectionFailed, "listener not found")
+		return
+	}
+	if lb == nil && g.settings().WaitBackend.Grace > 0 {
+		var err error
+		lb, err = g.waitLB(ctx, identity)
+		if err != nil {
+			slog.Debug("Unable to wait for listener", "identity", identity, "err", err)
+			if egressErr != nil {
+				g.egressAudit(ctx, data).Info("Egress denied", "err", egressErr, "waitErr", err)
+			}
+			if errors.Is(err, errTooManyWaiting) {
+				newChan.Reject(gossh.ResourceShortage, "too many pending connections")
+			} else {
+				newChan.Reject(gossh.ConnectionFailed, "listener not found")
+			}
+			return
+		}
+	}
 	if lb == nil {
+		if egressErr != nil {
+			g.egressAudit(ctx, data).Info("Egress denied", "err", egressErr)
+		}
 		slog.Debug("Listener not found", "identity", identity)
 		newChan.Reject(gossh.ConnectionFailed, "listener not found")
-		ch.Close()
 		return
 	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		slog.Error("Unable to accept channel", "err", err)
+		return
+	}
+
+	go gossh.DiscardRequests(reqs)
 	wrapConn := connData{
-		io: ch,
+		io:     ch,
+		remote: ctx.RemoteAddr(),
+		local:  ctx.LocalAddr(),
 	}
 	wrapConn.from.host = data.OriginAddr
 	wrapConn.from.port = data.OriginPort
@@ -12,11 +12,14 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/andrebq/maestro"
 	"github.com/andrebq/vandrare/internal/loadbalancer"
 	"github.com/andrebq/vandrare/internal/pattern"
+	"github.com/andrebq/vandrare/internal/proxyproto"
+	"github.com/andrebq/vandrare/internal/store"
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -25,27 +28,126 @@ type (
 	Gateway struct {
 		l         sync.Mutex
 		accepting map[string]*loadbalancer.LB[connData]
+		waiting   map[string]*backendWaiter
 		cleanup   map[*gossh.ServerConn]func()
 		kdb       *DynKDB
 		tdb       *TokenDB
-		adminKey  ssh.PublicKey
-		host      struct {
-			key  ssh.Signer
-			cert *gossh.Certificate
-		}
-		cakey    CAKey
-		casigner gossh.Signer
-		Binding  struct {
-			SSH     string
-			HTTP    string
-			Domains []string
+		hostKey   ed25519.PrivateKey
+		host      atomic.Pointer[hostIdentity]
+		cas       atomic.Pointer[caSet]
+		nonces    seenNonces
+		Binding   struct {
+			SSH  string
+			HTTP string
 		}
+
+		// Settings can be changed before calling Run,
+		// after that use Reload
+		Settings
+		live atomic.Pointer[Settings]
+	}
+
+	// Settings groups everything that can be changed while the gateway is running
+	Settings struct {
+		// Domains are the addresses (domain:port) of the gateway itself
+		Domains    []string
 		Subdomains []string
+		AdminKeys  []ssh.PublicKey
+
+		// CACutover is when certificates start to be signed
+		// by the next CA (see SetNextCA)
+		CACutover time.Time
+
+		// Egress allows direct-tcpip requests that do not match any
+		// exposed endpoint to be dialed to the real network destination,
+		// as long as the key has an "egress" permission covering it.
+		Egress struct {
+			Enabled     bool
+			DialTimeout time.Duration
+		}
+
+		// Keepalive probes clients every Interval, connections which
+		// miss MaxMissed probes in a row are closed. TCP is the keepalive
+		// period of accepted TCP connections (negative disables it).
+		Keepalive struct {
+			Interval  time.Duration
+			MaxMissed int
+			TCP       time.Duration
+		}
+
+		// ProxyProtocol enables parsing of PROXY headers on connections
+		// coming from TrustedUpstreams (eg.: a TCP load balancer), and
+		// if EmitToBackends is set, a PROXY v2 header with the address of
+		// the client is sent to tunnel backends before any other data.
+		ProxyProtocol struct {
+			TrustedUpstreams []*net.IPNet
+			EmitToBackends   bool
+		}
+
+		// Balancer controls how connections are queued on each
+		// endpoint, see loadbalancer.Options
+		Balancer loadbalancer.Options
+
+		// WaitBackend holds direct-tcpip requests for up to Grace while
+		// the endpoint they target is not registered (eg.: during deploys),
+		// at most MaxWaiting requests are held per endpoint.
+		WaitBackend struct {
+			Grace      time.Duration
+			MaxWaiting int
+		}
+
+		// TokenIdleExpiry expires tokens which were not used for that long,
+		// zero disables it
+		TokenIdleExpiry time.Duration
+		// TokenCache keeps up to Size successful token validations
+		// for TTL, zero disables it (see TokenDB.SetCache)
+		TokenCache struct {
+			TTL  time.Duration
+			Size int
+		}
+		// TokenHash is used for new tokens and to rehash weaker ones
+		TokenHash store.HashPolicy
+		// TokenRotationOverlap is the longest a token remains valid after
+		// being rotated
+		TokenRotationOverlap time.Duration
+	}
+
+	hostIdentity struct {
+		signer gossh.Signer
+		cert   *gossh.Certificate
+	}
+
+	// hostSigner always signs with the latest host identity,
+	// which allows the certificate to be renewed without restarting the server
+	hostSigner struct {
+		g *Gateway
+	}
+
+	// EndpointStats summarizes the load balancer of an exposed endpoint
+	EndpointStats struct {
+		Identity  string
+		Workers   int
+		Queued    int
+		Offered   int64
+		Delivered int64
+		Rejected  int64
+		Skipped   int64
+		AvgWaitMs int64
+		MaxWaitMs int64
+	}
+
+	backendWaiter struct {
+		ready   chan struct{}
+		pending int
 	}
 
 	connData struct {
 		io io.ReadWriteCloser
-		to struct {
+		// remote and local are the addresses of the ssh connection
+		// which requested this connection
+		remote net.Addr
+		local  net.Addr
+		to     struct {
 			host string
 			port uint32
 		}
@@ -66,16 +168,31 @@ type (
 	}
 
 	ctxKey byte
+
+	// sourceIPCtxKey has its own type, so it never collides with the ctxKey values
+	sourceIPCtxKey struct{}
 )
 
 const (
 	pubkeyAuthKey = ctxKey(iota + 1)
 )
 
+const (
+	// AdminTokenOwner is the owner of the token issued by SetAdminToken
+	AdminTokenOwner = "admin"
+)
+
 var (
+	errTooManyWaiting = errors.New("gateway: too many connections waiting for endpoint")
+
 	vandrareAdminCommand = pattern.Prefix([]string{"vandrare", "gateway", "ssh", "admin"}, nil)
 )
 
+// PublicKey of the CA, which clients should trust
+func (c CAKey) PublicKey() (ssh.PublicKey, error) {
+	return gossh.NewPublicKey(c.actual.Public())
+}
+
 func GenerateCAKey(seed [ed25519.SeedSize]byte) CAKey {
 	pk := ed25519.NewKeyFromSeed(seed[:])
 	return CAKey{actual: pk}
@@ -98,24 +215,64 @@ func NewGateway(keydb *DynKDB, tkdb *TokenDB, adminKey ssh.PublicKey, cakey CAKe
 		kdb:       keydb,
 		tdb:       tkdb,
 		accepting: make(map[string]*loadbalancer.LB[connData]),
+		waiting:   make(map[string]*backendWaiter),
 		cleanup:   make(map[*gossh.ServerConn]func()),
+	}
+	g.cas.Store(&caSet{current: casigner})
+	if adminKey != nil {
+		g.AdminKeys = []ssh.PublicKey{adminKey}
+	}
+	g.Balancer = loadbalancer.DefaultOptions()
+	return g, nil
+}
 
-		cakey:    cakey,
-		casigner: casigner,
+// settings returns the current settings, the returned value must not be modified
+func (g *Gateway) settings() *Settings {
+	if s := g.live.Load(); s != nil {
+		return s
+	}
+	return &g.Settings
+}
 
-		adminKey: adminKey,
+func (g *Gateway) isAdminKey(key ssh.PublicKey) bool {
+	for _, k := range g.settings().AdminKeys {
+		if bytes.Equal(key.Marshal(), k.Marshal()) {
+			return true
+		}
 	}
-	return g, nil
+	return false
 }
 
-// SetAdminToken sets the initial admin token if this is the first the token is being set,
-// otherwise nothing happens
+// SetAdminToken sets the initial admin token, with ScopeAdmin, if this is the first the token
+// is being set, otherwise nothing happens
 func (g *Gateway) SetAdminToken(ctx context.Context, token *[32]byte, ttl time.Duration) (bool, error) {
-	return false, errors.New("not implemented")
+	return g.tdb.IssueOnce(ctx, "gateway:admin-token", AdminTokenOwner, "Initial admin token", token, ttl, ScopeAdmin)
 }
 
 func (g *Gateway) Run(ctx context.Context) error {
+	initial := g.Settings
+	// a reload which arrived before Run already has the newer settings
+	g.live.CompareAndSwap(nil, &initial)
+	settings := g.settings()
+	g.tdb.SetCache(settings.TokenCache.TTL, settings.TokenCache.Size)
+	if err := g.tdb.SetHashPolicy(settings.TokenHash); err != nil {
+		return err
+	}
+	if err := g.loadRetiredCAs(ctx); err != nil {
+		return err
+	}
+	if err := g.kdb.SyncUsers(ctx); err != nil {
+		return err
+	}
 	mctx := maestro.New(ctx)
+	mctx.Spawn(func(ctx maestro.Context) error {
+		g.watchCAs(ctx)
+		return nil
+	})
+	mctx.Spawn(func(ctx maestro.Context) error {
+		g.watchIdleTokens(ctx)
+		return nil
+	})
 	if g.Binding.SSH != "" {
 		mctx.Spawn(func(ctx maestro.Context) error {
 			defer mctx.Shutdown()
@@ -133,19 +290,25 @@ func (g *Gateway) Run(ctx context.Context) error {
 }
 
 func (g *Gateway) runSSHD(ctx maestro.Context) error {
-	var err error
-	g.host.key, err = g.genHostKey()
-	if err != nil {
+	if err := g.renewHostKey(g.settings().Domains); err != nil {
 		return err
 	}
 	srv := ssh.Server{
 		Addr: g.Binding.SSH,
 	}
+	listener, err := g.listen(ctx, srv.Addr)
+	if err != nil {
+		return err
+	}
 	go func() {
 		<-ctx.Done()
 		srv.Close()
 	}()
-	srv.AddHostKey(g.host.key)
+	srv.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		go g.watchConn(ctx)
+		return conn
+	}
+	srv.AddHostKey(hostSigner{g})
 	srv.ChannelHandlers = map[string]ssh.ChannelHandler{
 		"session":      ssh.DefaultSessionHandler,
 		"direct-tcpip": g.handleDirectTCPIP,
@@ -162,7 +325,7 @@ func (g *Gateway) runSSHD(ctx maestro.Context) error {
 		if perm.Extensions == nil {
 			perm.Extensions = make(map[string]string)
 		}
-		if bytes.Equal(key.Marshal(), g.adminKey.Marshal()) {
+		if g.isAdminKey(key) {
 			ctx.SetValue(pubkeyAuthKey, true)
 			perm.Extensions["allow_admin"] = "true"
 			return true
@@ -182,27 +345,52 @@ func (g *Gateway) runSSHD(ctx maestro.Context) error {
 	srv.PtyCallback = func(ctx ssh.Context, pty ssh.Pty) bool { return false }
 	srv.Handler = g.sessionHandler
 	slog.Info("Starting SSHD server", "addr", srv.Addr)
-	err = srv.ListenAndServe()
+	err = srv.Serve(listener)
 	ctx.Shutdown()
 	return err
 }
 
-func (g *Gateway) genHostKey() (gossh.Signer, error) {
-	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+// listen on addr wrapping the listener to parse PROXY headers
+// if there are any trusted upstreams
+func (g *Gateway) listen(ctx context.Context, addr string) (net.Listener, error) {
+	settings := g.settings()
+	lc := net.ListenConfig{KeepAlive: settings.Keepalive.TCP}
+	listener, err := lc.Listen(ctx, "tcp", addr)
 	if err != nil {
-		return nil, fmt.Errorf("gateway: unable to generate host key: %w", err)
+		return nil, err
+	}
+	if len(settings.ProxyProtocol.TrustedUpstreams) == 0 {
+		return listener, nil
 	}
-	sshpubKey, err := gossh.NewPublicKey(pubkey)
+	return &proxyproto.Listener{
+		Listener: listener,
+		Trusted:  settings.ProxyProtocol.TrustedUpstreams,
+	}, nil
+}
+
+// renewHostKey signs a new host certificate for domains,
+// the host key itself is generated only once.
+func (g *Gateway) renewHostKey(domains []string) error {
+	g.l.Lock()
+	defer g.l.Unlock()
+	if g.hostKey == nil {
+		_, privkey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("gateway: unable to generate host key: %w", err)
+		}
+		g.hostKey = privkey
+	}
+	keysigner, err := gossh.NewSignerFromKey(g.hostKey)
 	if err != nil {
-		return nil, fmt.Errorf("gateway: unable to generate host pub key: %w", err)
+		return fmt.Errorf("gateway: unable to generate host-key signer: %w", err)
 	}
 	principals := map[string]struct{}{}
-	for _, d := range g.Binding.Domains {
+	for _, d := range domains {
 		principals[d] = struct{}{}
 	}
 	cert := &gossh.Certificate{
-		KeyId:       g.Binding.Domains[0],
-		Key:         sshpubKey,
+		KeyId:       domains[0],
+		Key:         keysigner.PublicKey(),
 		CertType:    gossh.HostCert,
 		ValidAfter:  uint64(time.Now().Add(1 - time.Second).Unix()),
 		ValidBefore: uint64(time.Now().Add(time.Hour * 24 * 365).Unix()),
@@ -221,25 +409,40 @@ func (g *Gateway) genHostKey() (gossh.Signer, error) {
 	}
 	sort.Strings(cert.ValidPrincipals)
 
-	if err := cert.SignCert(rand.Reader, g.casigner); err != nil {
-		return nil, fmt.Errorf("gateway: unable to sign host certificate: %w", err)
+	if err := cert.SignCert(rand.Reader, g.signingCA()); err != nil {
+		return fmt.Errorf("gateway: unable to sign host certificate: %w", err)
 	}
 
-	g.host.cert = cert
-
-	keysigner, err := gossh.NewSignerFromKey(privkey)
-	if err != nil {
-		return nil, fmt.Errorf("gateway: unable to generate host-key signer: %w", err)
-	}
 	certsigner, err := gossh.NewCertSigner(cert, keysigner)
 	if err != nil {
-		return nil, fmt.Errorf("gateway: unable to generate cert host signer: %w", err)
+		return fmt.Errorf("gateway: unable to generate cert host signer: %w", err)
 	}
 
 	slog.Info("Host signer created", "cert", gossh.MarshalAuthorizedKey(cert),
 		"signkey", gossh.FingerprintSHA256(cert.SignatureKey),
 		"certkey", gossh.FingerprintSHA256(certsigner.PublicKey()))
-	return certsigner, nil
+	g.host.Store(&hostIdentity{signer: certsigner, cert: cert})
+	return nil
+}
+
+func (g *Gateway) hostCert() *gossh.Certificate {
+	return g.host.Load().cert
+}
+
+func (h hostSigner) PublicKey() gossh.PublicKey {
+	return h.g.host.Load().signer.PublicKey()
+}
+
+func (h hostSigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return h.g.host.Load().signer.Sign(rand, data)
+}
+
+func (h hostSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	signer := h.g.host.Load().signer
+	if as, ok := signer.(gossh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return signer.Sign(rand, data)
 }
 
 func (g *Gateway) ensurePubkeyAuth(ctx ssh.Context) bool {
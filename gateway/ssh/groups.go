@@ -0,0 +1,234 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/andrebq/vandrare/internal/policy"
+	"github.com/andrebq/vandrare/internal/store"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type (
+	// Group grants its permissions to its member keys and to every key owned by its member users
+	Group struct {
+		Name        string
+		Description string
+		Permissions []Permission
+		// Keys are fingerprints of member keys
+		Keys  []string
+		Users []string
+	}
+)
+
+const (
+	groupPrefix = "kdb:group:"
+)
+
+var (
+	errGroupNotFound = errors.New("ssh: group not found")
+
+	// validName restricts names of groups and policy scripts
+	validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+)
+
+func (d *DynKDB) computeGroupLookup(name string) string {
+	return groupPrefix + name
+}
+
+// PutGroup creates a group or changes its description
+func (d *DynKDB) PutGroup(ctx context.Context, name, description string) (Group, error) {
+	if !validName.MatchString(name) {
+		return Group{}, fmt.Errorf("%w: invalid group name %q, use letters, digits, '.', '_' or '-'", errInvalidRequest, name)
+	}
+	return d.updateGroup(ctx, name, true, func(_ context.Context, _ store.Ops, g *Group) error {
+		g.Description = description
+		return nil
+	})
+}
+
+func (d *DynKDB) GetGroup(ctx context.Context, name string) (Group, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	return d.getGroup(ctx, ops.KV(), name)
+}
+
+func (d *DynKDB) ListGroups(ctx context.Context) ([]Group, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	return d.listGroups(ctx, ops.KV())
+}
+
+func (d *DynKDB) DeleteGroup(ctx context.Context, name string) error {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	if _, err := d.getGroup(ctx, kv, name); err != nil {
+		return err
+	}
+	kv.Delete(ctx, d.computeGroupLookup(name))
+	ops.Fail(kv.Err())
+	err := ops.Commit()
+	d.groupList.invalidate()
+	return err
+}
+
+// SetGroupPermission works like SetPermission for every member of the group
+func (d *DynKDB) SetGroupPermission(ctx context.Context, name, operation, resource, action string) (Group, error) {
+	return d.updateGroup(ctx, name, false, func(_ context.Context, _ store.Ops, g *Group) error {
+		g.Permissions = setPermissionEntry(g.Permissions, operation, resource, action)
+		return nil
+	})
+}
+
+// AddGroupKey makes the registered key with the given fingerprint a member of the group
+func (d *DynKDB) AddGroupKey(ctx context.Context, name, fingerprint string) (Group, error) {
+	return d.updateGroup(ctx, name, false, func(ctx context.Context, ops store.Ops, g *Group) error {
+		if _, err := d.getKey(ctx, ops.KV(), fingerprint); err != nil {
+			return err
+		}
+		if !slices.Contains(g.Keys, fingerprint) {
+			g.Keys = append(g.Keys, fingerprint)
+		}
+		return nil
+	})
+}
+
+// AddGroupUser makes the user a member of the group, the user is created if needed
+func (d *DynKDB) AddGroupUser(ctx context.Context, name, user string) (Group, error) {
+	if user == "" {
+		return Group{}, fmt.Errorf("%w: user is required", errInvalidRequest)
+	}
+	return d.updateGroup(ctx, name, false, func(ctx context.Context, ops store.Ops, g *Group) error {
+		if err := ops.Users().Ensure(ctx, user); err != nil {
+			return err
+		}
+		if !slices.Contains(g.Users, user) {
+			g.Users = append(g.Users, user)
+		}
+		return nil
+	})
+}
+
+// RemoveGroupMember removes the key with the given fingerprint, or the user, from the group
+func (d *DynKDB) RemoveGroupMember(ctx context.Context, name, fingerprint, user string) (Group, error) {
+	return d.updateGroup(ctx, name, false, func(_ context.Context, _ store.Ops, g *Group) error {
+		g.Keys = slices.DeleteFunc(g.Keys, func(k string) bool { return fingerprint != "" && k == fingerprint })
+		g.Users = slices.DeleteFunc(g.Users, func(u string) bool { return user != "" && u == user })
+		return nil
+	})
+}
+
+// updateGroup applies fn to the group and stores it, missing groups are only created if create is true
+func (d *DynKDB) updateGroup(ctx context.Context, name string, create bool, fn func(context.Context, store.Ops, *Group) error) (Group, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	group, err := d.getGroup(ctx, kv, name)
+	if errors.Is(err, errGroupNotFound) && create {
+		group = Group{Name: name}
+	} else if err != nil {
+		return group, err
+	}
+	if err := fn(ctx, ops, &group); err != nil {
+		return group, err
+	}
+	ops.Fail(store.PutJSON(ctx, kv, d.computeGroupLookup(name), &group))
+	err = ops.Commit()
+	d.groupList.invalidate()
+	return group, err
+}
+
+func (d *DynKDB) getGroup(ctx context.Context, kv store.KVOps, name string) (Group, error) {
+	var group Group
+	err := store.GetJSON(ctx, &group, kv, d.computeGroupLookup(name))
+	if store.IsNotFound(err) {
+		return group, errGroupNotFound
+	}
+	return group, err
+}
+
+func (d *DynKDB) listGroups(ctx context.Context, kv store.KVOps) ([]Group, error) {
+	var ret []Group
+	for _, k := range kv.Keys(ctx, groupPrefix) {
+		group, err := d.getGroup(ctx, kv, strings.TrimPrefix(k, groupPrefix))
+		if err != nil {
+			slog.Error("Invalid group in database", "lookupKey", k, "err", err)
+			continue
+		}
+		ret = append(ret, group)
+	}
+	return ret, kv.Err()
+}
+
+// GroupsOf returns the groups the key is a member of, directly or through its owner
+func (d *DynKDB) GroupsOf(ctx context.Context, fingerprint, owner string) ([]Group, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	return d.groupsOf(ctx, ops.KV(), fingerprint, owner)
+}
+
+func (d *DynKDB) groupsOf(ctx context.Context, kv store.KVOps, fingerprint, owner string) ([]Group, error) {
+	groups, err := d.listGroups(ctx, kv)
+	if err != nil {
+		return nil, err
+	}
+	return memberOf(groups, fingerprint, owner), nil
+}
+
+// memberOf returns a new slice with the groups the key is a member of, see GroupsOf
+func memberOf(groups []Group, fingerprint, owner string) []Group {
+	var ret []Group
+	for _, g := range groups {
+		if slices.Contains(g.Keys, fingerprint) || (owner != "" && slices.Contains(g.Users, owner)) {
+			ret = append(ret, g)
+		}
+	}
+	return ret
+}
+
+// effectiveRules returns the rules from the config and permissions of the key
+// and from the groups it belongs to, cfg is the config of the key
+func (d *DynKDB) effectiveRules(ctx context.Context, key ssh.PublicKey, cfg KeyConfig) ([]policy.Rule, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	permissions := KeyPermissions{}
+	err := store.GetJSON(ctx, &permissions, kv, d.computeKeyPermissionLookup(key))
+	if err != nil && !store.IsNotFound(err) {
+		return nil, err
+	}
+	groups, err := d.groupList.get(func() ([]Group, error) { return d.listGroups(ctx, kv) })
+	if err != nil {
+		return nil, err
+	}
+	groups = memberOf(groups, gossh.FingerprintSHA256(key), cfg.Owner)
+	var ret []policy.Rule
+	for _, h := range cfg.AllowedHosts {
+		ret = append(ret, policy.Rule{Operation: exposeEndpointOperation, Resource: h, Effect: policy.Allow, Source: "allowed hosts"})
+	}
+	ret = appendRules(ret, "key", permissions.Entries)
+	for _, g := range groups {
+		ret = appendRules(ret, "group:"+g.Name, g.Permissions)
+	}
+	return ret, nil
+}
+
+// appendRules converts permissions to rules, invalid actions are treated as deny
+func appendRules(rules []policy.Rule, source string, permissions []Permission) []policy.Rule {
+	for _, p := range permissions {
+		effect, err := policy.ParseEffect(p.Action)
+		if err != nil {
+			slog.Warn("Invalid permission action, denying", "source", source, "operation", p.Operation, "resource", p.Resource, "err", err)
+			effect = policy.Deny
+		}
+		rules = append(rules, policy.Rule{Operation: p.Operation, Resource: p.Resource, Effect: effect, Source: source})
+	}
+	return rules
+}
@@ -0,0 +1,51 @@
+package ssh_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestAuthZSeesChanges(t *testing.T) {
+	ctx := context.Background()
+	kdb := newTestKDB(t)
+	key := newTestKey(t)
+	if err := kdb.RegisterKey(ctx, key, "alice", time.Now().Add(-time.Minute), time.Now().Add(time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	const resource = "db.example.com:22"
+	authz := func(expected bool) {
+		t.Helper()
+		// twice, so the second call is served from the cached lists
+		for i := 0; i < 2; i++ {
+			if err := kdb.AuthZ(ctx, key, "egress", resource); (err == nil) != expected {
+				t.Fatalf("Expected allowed=%v got %v", expected, err)
+			}
+		}
+	}
+	authz(false)
+	if _, err := kdb.PutGroup(ctx, "ops", ""); err != nil {
+		t.Fatal(err)
+	} else if _, err := kdb.SetGroupPermission(ctx, "ops", "egress", "*.example.com:22", "allow"); err != nil {
+		t.Fatal(err)
+	} else if _, err := kdb.AddGroupKey(ctx, "ops", gossh.FingerprintSHA256(key)); err != nil {
+		t.Fatal(err)
+	}
+	authz(true)
+
+	if _, err := kdb.PutPolicyScript(ctx, "deny-all", "return false", true); err != nil {
+		t.Fatal(err)
+	}
+	authz(false)
+	if err := kdb.DeletePolicyScript(ctx, "deny-all"); err != nil {
+		t.Fatal(err)
+	}
+	authz(true)
+
+	if _, err := kdb.RemoveGroupMember(ctx, "ops", gossh.FingerprintSHA256(key), ""); err != nil {
+		t.Fatal(err)
+	}
+	authz(false)
+}
@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/andrebq/maestro"
+	"github.com/andrebq/vandrare/internal/sshsig"
+	"github.com/andrebq/vandrare/internal/store"
 	gossh "golang.org/x/crypto/ssh"
 )
 
@@ -21,7 +25,9 @@ type (
 )
 
 var (
-	userCtxKey = ctxKey(1)
+	userCtxKey   = ctxKey(1)
+	scopesCtxKey = ctxKey(2)
+	tokenCtxKey  = ctxKey(3)
 )
 
 func (g *Gateway) runHTTPD(ctx maestro.Context) error {
@@ -45,18 +51,23 @@ func (g *Gateway) runHTTPD(ctx maestro.Context) error {
 		}{Now: time.Now()})
 	})
 	public.HandleFunc("GET /gateway/ssh/certificates/ca.pub", func(w http.ResponseWriter, r *http.Request) {
-		pubkeyTxt := gossh.MarshalAuthorizedKey(g.casigner.PublicKey())
+		var pubkeyTxt []byte
+		for _, ca := range g.trustedCAs() {
+			pubkeyTxt = append(pubkeyTxt, gossh.MarshalAuthorizedKey(ca)...)
+		}
 		w.Header().Add("Content-Type", "text/plain")
 		w.Header().Add("Content-Length", strconv.Itoa(len(pubkeyTxt)))
 		w.WriteHeader(http.StatusOK)
 		w.Write(pubkeyTxt)
 	})
 	public.HandleFunc("GET /gateway/ssh/certificates/hosts/gateway_known_hosts", func(w http.ResponseWriter, req *http.Request) {
-		pubkeyTxt := string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(g.casigner.PublicKey())))
 		buf := bytes.Buffer{}
-		fmt.Fprintf(&buf, "# vandrare gateway / CA fingerprint: %v\n", gossh.FingerprintSHA256(g.casigner.PublicKey()))
-		for _, p := range g.host.cert.ValidPrincipals {
-			fmt.Fprintf(&buf, "@cert-authority %v %v\n", p, pubkeyTxt)
+		for _, ca := range g.trustedCAs() {
+			pubkeyTxt := string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(ca)))
+			fmt.Fprintf(&buf, "# vandrare gateway / CA fingerprint: %v\n", gossh.FingerprintSHA256(ca))
+			for _, p := range g.hostCert().ValidPrincipals {
+				fmt.Fprintf(&buf, "@cert-authority %v %v\n", p, pubkeyTxt)
+			}
 		}
 		w.Header().Add("Content-Type", "text/plain")
 		w.Header().Add("Content-Length", strconv.Itoa(buf.Len()))
@@ -64,21 +75,23 @@ func (g *Gateway) runHTTPD(ctx maestro.Context) error {
 		io.Copy(w, &buf)
 	})
 	public.HandleFunc("GET /gateway/ssh/certificates/self-cert.pub", func(w http.ResponseWriter, r *http.Request) {
-		pubkeyTxt := gossh.MarshalAuthorizedKey(g.host.cert)
+		pubkeyTxt := gossh.MarshalAuthorizedKey(g.hostCert())
 		w.Header().Add("Content-Type", "text/plain")
 		w.Header().Add("Content-Length", strconv.Itoa(len(pubkeyTxt)))
 		w.WriteHeader(http.StatusOK)
 		w.Write(pubkeyTxt)
 	})
-	public.HandleFunc("GET /gateway/ssh/certificates/hosts/all_known_hosts", g.protectHttpFunc(func(w http.ResponseWriter, req *http.Request) {
-		pubkeyTxt := string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(g.casigner.PublicKey())))
+	public.HandleFunc("GET /gateway/ssh/certificates/hosts/all_known_hosts", g.protectHttpFunc(ScopeKnownHostsRead, func(w http.ResponseWriter, req *http.Request) {
 		buf := bytes.Buffer{}
-		fmt.Fprintf(&buf, "# vandrare gateway / CA fingerprint: %v\n", gossh.FingerprintSHA256(g.casigner.PublicKey()))
-		for _, p := range g.host.cert.ValidPrincipals {
-			fmt.Fprintf(&buf, "@cert-authority %v %v\n", p, pubkeyTxt)
-		}
-		for _, d := range g.Subdomains {
-			fmt.Fprintf(&buf, "@cert-authority *.%v %v\n", d, pubkeyTxt)
+		for _, ca := range g.trustedCAs() {
+			pubkeyTxt := string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(ca)))
+			fmt.Fprintf(&buf, "# vandrare gateway / CA fingerprint: %v\n", gossh.FingerprintSHA256(ca))
+			for _, p := range g.hostCert().ValidPrincipals {
+				fmt.Fprintf(&buf, "@cert-authority %v %v\n", p, pubkeyTxt)
+			}
+			for _, d := range g.settings().Subdomains {
+				fmt.Fprintf(&buf, "@cert-authority *.%v %v\n", d, pubkeyTxt)
+			}
 		}
 		w.Header().Add("Content-Type", "text/plain")
 		w.Header().Add("Content-Length", strconv.Itoa(buf.Len()))
@@ -86,11 +99,18 @@ func (g *Gateway) runHTTPD(ctx maestro.Context) error {
 		io.Copy(w, &buf)
 	}))
 
-	public.HandleFunc("POST /gateway/ssh/register-key", g.protectHttpFunc(g.registerKey))
+	public.HandleFunc("POST /gateway/ssh/register-key", g.protectHttpFunc(ScopeKeysRegister, g.registerKey))
+	public.HandleFunc("GET /gateway/ssh/register-key", g.protectHttpFunc(ScopeKeysRegister, g.registrationStatus))
+	public.HandleFunc("POST /gateway/tokens/rotate", g.protectHttpFunc("", g.rotateToken))
+	g.adminRoutes(public)
 
 	srv.Handler = public
+	listener, err := g.listen(ctx, srv.Addr)
+	if err != nil {
+		return err
+	}
 	slog.Info("Starting HTTPD server", "addr", srv.Addr)
-	err := srv.ListenAndServe()
+	err = srv.Serve(listener)
 	ctx.Shutdown()
 	return err
 }
@@ -104,18 +124,88 @@ func (g *Gateway) registerKey(w http.ResponseWriter, req *http.Request) {
 
 	key, err := g.kdb.RequestKeyRegistration(req.Context(), key)
 	if err != nil {
-		slog.Error("Unable to process key registration", "owner", key.Owner)
+		slog.Error("Unable to process key registration", "owner", key.Owner, "err", err)
+		writeError(w, err)
+		return
 	}
-	writeJSON(w, key)
+	writeJSON(w, &key)
 }
 
-func (g *Gateway) protectHttpFunc(fn http.HandlerFunc) http.HandlerFunc {
+// registrationStatus lets the requester poll the status of the registration
+// of the key informed in the fingerprint query parameter
+func (g *Gateway) registrationStatus(w http.ResponseWriter, req *http.Request) {
+	user, _ := getUser(req)
+	reg, err := g.kdb.KeyRegistration(req.Context(), req.URL.Query().Get("fingerprint"))
+	if err == nil && reg.Owner != user && !hasScope(getScopes(req), ScopeAdmin) {
+		// do not leak registrations from other users
+		err = errRegistrationNotFound
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &reg)
+}
+
+// rotateToken replaces the token used to authenticate the request, the overlap
+// requested in the body is capped by Settings.TokenRotationOverlap
+func (g *Gateway) rotateToken(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Overlap *Duration `json:"overlap"`
+	}
+	if req.ContentLength != 0 {
+		if err := readJSON(&body, req, w); err != nil {
+			return
+		}
+	}
+	if getToken(req) == "" {
+		writeError(w, fmt.Errorf("%w: only requests authenticated with a token can rotate it", errInvalidRequest))
+		return
+	}
+	overlap := g.settings().TokenRotationOverlap
+	if body.Overlap != nil {
+		if *body.Overlap < 0 {
+			writeError(w, fmt.Errorf("%w: overlap cannot be negative", errInvalidRequest))
+			return
+		}
+		overlap = min(overlap, time.Duration(*body.Overlap))
+	}
+	rotated, err := g.tdb.Rotate(req.Context(), getToken(req), overlap)
+	user, _ := getUser(req)
+	slog.Info("Token rotated", "owner", user, "previous", rotated.PreviousID, "id", rotated.ID, "overlap", overlap, "err", err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &rotated)
+}
+
+// protectHttpFunc only calls fn for requests with a valid token which was issued with scope
+// (or ScopeAdmin), an empty scope accepts any valid token. Requests with tokens bound to a key
+// must also be signed by that key.
+//
+// Requests signed by a registered key (see sshsig.AuthorizeRequest) are accepted
+// instead of tokens, with the scopes granted by the http-api permissions of the key.
+//
+// The owner, scopes and the token itself are available from the request context.
+func (g *Gateway) protectHttpFunc(scope string, fn http.HandlerFunc) http.HandlerFunc {
 	const bearer = "Bearer "
 	const basic = "Basic "
+	const sshSig = sshsig.AuthScheme + " "
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		var token string
-		if strings.HasPrefix(authHeader, basic) {
+		if strings.HasPrefix(authHeader, sshSig) {
+			owner, scopes, err := g.signatureAuth(r)
+			r.Header.Del("Authorization")
+			if err != nil {
+				slog.Info("Request without a valid signature", "clientIP", r.RemoteAddr, "err", err)
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+			g.serveAuthorized(w, r, fn, scope, owner, scopes, "")
+			return
+		} else if strings.HasPrefix(authHeader, basic) {
 			var ok bool
 			_, token, ok = r.BasicAuth()
 			if !ok {
@@ -131,15 +221,34 @@ func (g *Gateway) protectHttpFunc(fn http.HandlerFunc) http.HandlerFunc {
 		r.SetBasicAuth("", "")
 		r.Header.Del("Authorization")
 
-		valid, owner, err := g.tdb.Valid(r.Context(), token)
-		if err != nil || !valid {
+		clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+		auth, err := g.tdb.Check(r.Context(), token, clientIP, g.settings().TokenIdleExpiry)
+		if err != nil {
 			http.Error(w, "Not authorized", http.StatusUnauthorized)
 			return
 		}
-		fn(w, setUser(r, owner))
+		if auth.BoundKey != "" {
+			if err := g.verifyTokenBinding(r, auth.BoundKey); err != nil {
+				slog.Info("Request with a bound token without a valid signature", "id", auth.ID, "owner", auth.Owner, "clientIP", clientIP, "err", err)
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		g.serveAuthorized(w, r, fn, scope, auth.Owner, auth.Scopes, token)
 	}
 }
 
+// serveAuthorized calls fn if scopes contains scope, see protectHttpFunc
+func (g *Gateway) serveAuthorized(w http.ResponseWriter, r *http.Request, fn http.HandlerFunc, scope, owner string, scopes []string, token string) {
+	if scope != "" && !hasScope(scopes, scope) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	r = setUser(r, owner)
+	ctx := context.WithValue(withSourceIP(r.Context(), r.RemoteAddr), scopesCtxKey, scopes)
+	fn(w, r.WithContext(context.WithValue(ctx, tokenCtxKey, token)))
+}
+
 func readJSON(out any, req *http.Request, w http.ResponseWriter) error {
 	err := json.NewDecoder(req.Body).Decode(out)
 	if err != nil {
@@ -160,6 +269,24 @@ func writeJSON(out http.ResponseWriter, data any) error {
 	return err
 }
 
+// writeError maps errors from the gateway to HTTP status codes,
+// unknown errors are not exposed to the client
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errNotAuthorized):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, errRegistrationNotFound), errors.Is(err, errKeyNotFound), errors.Is(err, errUserNotFound),
+		errors.Is(err, errGroupNotFound), errors.Is(err, errPolicyScriptNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, errRegistrationDecided), errors.Is(err, store.ErrTokenRotated):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
 func getUser(req *http.Request) (string, bool) {
 	val := req.Context().Value(userCtxKey)
 	if val == nil {
@@ -168,6 +295,16 @@ func getUser(req *http.Request) (string, bool) {
 	return val.(string), true
 }
 
+func getToken(req *http.Request) string {
+	val, _ := req.Context().Value(tokenCtxKey).(string)
+	return val
+}
+
+func getScopes(req *http.Request) []string {
+	val, _ := req.Context().Value(scopesCtxKey).([]string)
+	return val
+}
+
 func setUser(req *http.Request, user string) *http.Request {
 	return req.WithContext(context.WithValue(req.Context(), userCtxKey, user))
 }
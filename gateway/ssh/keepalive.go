@@ -0,0 +1,82 @@
+package ssh
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	keepaliveRequest = "keepalive@openssh.com"
+)
+
+// watchConn runs for the lifetime of every connection accepted by the sshd,
+// it probes the client with keepalive requests (if enabled) and
+// releases any resource held by the connection once it is gone.
+func (g *Gateway) watchConn(ctx ssh.Context) {
+	var conn *gossh.ServerConn
+	defer func() {
+		if conn != nil {
+			g.dropCleanup(conn)
+		}
+	}()
+
+	// settings are read once, reloads only affect new connections
+	keepalive := g.settings().Keepalive
+	if keepalive.Interval <= 0 {
+		<-ctx.Done()
+		conn, _ = ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+		return
+	}
+
+	ticker := time.NewTicker(keepalive.Interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			conn, _ = ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+			return
+		case <-ticker.C:
+		}
+		conn, _ = ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+		if conn == nil {
+			// handshake is still running
+			continue
+		}
+		if probeConn(conn, keepalive.Interval) {
+			missed = 0
+			continue
+		}
+		missed++
+		if missed < keepalive.MaxMissed {
+			continue
+		}
+		slog.Info("Closing unresponsive connection", "remoteAddr", conn.RemoteAddr(), "user", conn.User(), "missed", missed)
+		if cleanup := g.getCleanup(conn); cleanup != nil {
+			cleanup()
+		}
+		conn.Close()
+		return
+	}
+}
+
+// probeConn sends a keepalive request and waits up to timeout for the reply,
+// any reply (even a failure) means the peer is alive.
+func probeConn(conn *gossh.ServerConn, timeout time.Duration) bool {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest(keepaliveRequest, true, nil)
+		reply <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/store"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type (
+	// KeyEntry is a registered key with its permissions
+	KeyEntry struct {
+		Fingerprint string
+		PublicKey   ssh.PublicKey
+		Config      KeyConfig
+		Permissions []Permission
+	}
+)
+
+const (
+	keyPrefix = "kdb:key:"
+)
+
+var (
+	errKeyNotFound = errors.New("ssh: key not found")
+)
+
+// ListKeys returns every registered key, including expired ones
+func (d *DynKDB) ListKeys(ctx context.Context) ([]KeyEntry, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	var ret []KeyEntry
+	for _, k := range kv.Keys(ctx, keyPrefix) {
+		entry, err := d.getKey(ctx, kv, strings.TrimPrefix(k, keyPrefix))
+		if err != nil {
+			slog.Error("Invalid key in database", "lookupKey", k, "err", err)
+			continue
+		}
+		ret = append(ret, entry)
+	}
+	return ret, kv.Err()
+}
+
+// GetKey returns the key with the given fingerprint
+func (d *DynKDB) GetKey(ctx context.Context, fingerprint string) (KeyEntry, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	return d.getKey(ctx, ops.KV(), fingerprint)
+}
+
+// DeleteKey removes the key, all its permissions and its group memberships
+func (d *DynKDB) DeleteKey(ctx context.Context, fingerprint string) error {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	if _, err := d.getKey(ctx, kv, fingerprint); err != nil {
+		return err
+	}
+	groups, err := d.groupsOf(ctx, kv, fingerprint, "")
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		g.Keys = slices.DeleteFunc(g.Keys, func(k string) bool { return k == fingerprint })
+		ops.Fail(store.PutJSON(ctx, kv, d.computeGroupLookup(g.Name), &g))
+	}
+	kv.Delete(ctx, d.computeFingerprintLookup(fingerprint))
+	kv.Delete(ctx, d.computeFingerprintPermissionLookup(fingerprint))
+	ops.Fail(kv.Err())
+	err = ops.Commit()
+	d.groupList.invalidate()
+	return err
+}
+
+// ExtendKey changes when the key expires
+func (d *DynKDB) ExtendKey(ctx context.Context, fingerprint string, expiresAt time.Time) (KeyEntry, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	entry, err := d.getKey(ctx, kv, fingerprint)
+	if err != nil {
+		return entry, err
+	}
+	entry.Config.ExpiresAt = expiresAt
+	ops.Fail(store.PutJSON(ctx, kv, d.computeFingerprintLookup(fingerprint), entry.Config))
+	return entry, ops.Commit()
+}
+
+func (d *DynKDB) getKey(ctx context.Context, kv store.KVOps, fingerprint string) (KeyEntry, error) {
+	entry := KeyEntry{Fingerprint: fingerprint}
+	buf := kv.GetBytes(ctx, nil, d.computeFingerprintLookup(fingerprint))
+	if buf == nil {
+		if err := kv.Err(); err != nil {
+			return entry, err
+		}
+		return entry, errKeyNotFound
+	}
+	if err := json.Unmarshal(buf, &entry.Config); err != nil {
+		return entry, fmt.Errorf("ssh: invalid key config: %w", err)
+	}
+	// the description has the key in the authorized_keys format
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(entry.Config.Description))
+	if err != nil {
+		return entry, fmt.Errorf("ssh: invalid public key in key config: %w", err)
+	}
+	entry.PublicKey = key
+
+	var permissions KeyPermissions
+	err = store.GetJSON(ctx, &permissions, kv, d.computeFingerprintPermissionLookup(fingerprint))
+	if err != nil && !store.IsNotFound(err) {
+		return entry, err
+	}
+	entry.Permissions = permissions.Entries
+	return entry, nil
+}
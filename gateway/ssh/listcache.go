@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// listCache keeps a list read from the store, so AuthZ does not read and decode
+	// every group and policy script on each call. Writers must call invalidate
+	// once their changes are committed.
+	listCache[T any] struct {
+		sync.Mutex
+		items    []T
+		loadedAt time.Time
+		valid    bool
+		// generation changes on every invalidation, lists loaded
+		// before it are not cached
+		generation int64
+	}
+)
+
+const (
+	// listCacheTTL limits how long a list is kept, in case the store
+	// is changed by another process
+	listCacheTTL = time.Minute
+)
+
+// get returns the cached list or the one returned by load, callers must not modify the items
+func (c *listCache[T]) get(load func() ([]T, error)) ([]T, error) {
+	c.Lock()
+	if c.valid && time.Since(c.loadedAt) < listCacheTTL {
+		items := c.items
+		c.Unlock()
+		return items, nil
+	}
+	generation := c.generation
+	c.Unlock()
+
+	items, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if generation == c.generation {
+		c.items, c.loadedAt, c.valid = items, time.Now(), true
+	}
+	return items, nil
+}
+
+// invalidate drops the cached list
+func (c *listCache[T]) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	c.items, c.valid = nil, false
+}
@@ -0,0 +1,255 @@
+package ssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/appshell"
+	"github.com/andrebq/vandrare/internal/policy"
+	"github.com/andrebq/vandrare/internal/store"
+	"github.com/gliderlabs/ssh"
+)
+
+type (
+	// PolicyScript is a Tengo script evaluated by AuthZ after the rules of the key (see applyScripts),
+	// scripts only log their decisions (dry-run) unless Enforce is set.
+	PolicyScript struct {
+		Name      string
+		Source    string
+		Enforce   bool
+		UpdatedAt time.Time
+	}
+
+	// scriptCache keeps compiled scripts by the hash of their source
+	scriptCache struct {
+		sync.Mutex
+		programs map[[sha256.Size]byte]*appshell.Program
+	}
+
+	scriptOutcome struct {
+		allow   bool
+		reason  string
+		decided bool
+	}
+)
+
+const (
+	policyScriptPrefix = "kdb:policy-script:"
+
+	// policyScriptTimeout limits how long a single script can take to decide
+	policyScriptTimeout = time.Millisecond * 100
+	// policyScriptMaxAllocs limits how many objects a single run can allocate
+	policyScriptMaxAllocs = 100_000
+)
+
+var (
+	errPolicyScriptNotFound = errors.New("ssh: policy script not found")
+
+	// policyScriptModules are the stdlib modules available to policy scripts
+	policyScriptModules = []string{"times", "text", "math", "enum", "json"}
+)
+
+func (d *DynKDB) computePolicyScriptLookup(name string) string {
+	return policyScriptPrefix + name
+}
+
+// PutPolicyScript compiles and stores a policy script, replacing any script with the same name
+func (d *DynKDB) PutPolicyScript(ctx context.Context, name, source string, enforce bool) (PolicyScript, error) {
+	if !validName.MatchString(name) {
+		return PolicyScript{}, fmt.Errorf("%w: invalid script name %q, use letters, digits, '.', '_' or '-'", errInvalidRequest, name)
+	}
+	if _, err := compilePolicyScript(source); err != nil {
+		return PolicyScript{}, fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+	script := PolicyScript{Name: name, Source: source, Enforce: enforce, UpdatedAt: time.Now()}
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	ops.Fail(store.PutJSON(ctx, ops.KV(), d.computePolicyScriptLookup(name), &script))
+	err := ops.Commit()
+	d.scriptList.invalidate()
+	d.scripts.clear()
+	return script, err
+}
+
+func (d *DynKDB) GetPolicyScript(ctx context.Context, name string) (PolicyScript, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	return d.getPolicyScript(ctx, ops.KV(), name)
+}
+
+// ListPolicyScripts returns every policy script, ordered by name
+func (d *DynKDB) ListPolicyScripts(ctx context.Context) ([]PolicyScript, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	var ret []PolicyScript
+	for _, k := range kv.Keys(ctx, policyScriptPrefix) {
+		script, err := d.getPolicyScript(ctx, kv, strings.TrimPrefix(k, policyScriptPrefix))
+		if err != nil {
+			slog.Error("Invalid policy script in database", "lookupKey", k, "err", err)
+			continue
+		}
+		ret = append(ret, script)
+	}
+	return ret, kv.Err()
+}
+
+func (d *DynKDB) DeletePolicyScript(ctx context.Context, name string) error {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	if _, err := d.getPolicyScript(ctx, kv, name); err != nil {
+		return err
+	}
+	kv.Delete(ctx, d.computePolicyScriptLookup(name))
+	ops.Fail(kv.Err())
+	err := ops.Commit()
+	d.scriptList.invalidate()
+	d.scripts.clear()
+	return err
+}
+
+func (d *DynKDB) getPolicyScript(ctx context.Context, kv store.KVOps, name string) (PolicyScript, error) {
+	var script PolicyScript
+	err := store.GetJSON(ctx, &script, kv, d.computePolicyScriptLookup(name))
+	if store.IsNotFound(err) {
+		return script, errPolicyScriptNotFound
+	}
+	return script, err
+}
+
+// applyScripts runs every policy script after the rules reached decision. Scripts receive an input map with
+// fingerprint, owner, operation, resource, sourceIP, time and allowed (the decision of the rules) and return
+// either undefined, to keep the decision, a bool or a map with allow (bool) and reason (string).
+//
+// A deny from any enforced script wins, an allow grants what no rule allowed but never overrides
+// an explicit deny. Enforced scripts which fail (eg.: by taking too long) deny.
+func (d *DynKDB) applyScripts(ctx context.Context, input map[string]any, decision policy.Decision) (policy.Decision, error) {
+	scripts, err := d.scriptList.get(func() ([]PolicyScript, error) { return d.ListPolicyScripts(ctx) })
+	if err != nil || len(scripts) == 0 {
+		return decision, err
+	}
+	var denied, allowed *policy.Decision
+	for _, s := range scripts {
+		log := slog.With("script", s.Name, "fingerprint", input["fingerprint"], "operation", input["operation"], "resource", input["resource"])
+		outcome, err := d.runScript(ctx, s, input)
+		switch {
+		case err != nil && !s.Enforce:
+			log.Warn("Policy script failed (dry-run)", "err", err)
+			continue
+		case err != nil:
+			log.Error("Policy script failed", "err", err)
+			outcome = scriptOutcome{reason: fmt.Sprintf("script failed: %v", err), decided: true}
+		case !outcome.decided:
+			continue
+		case !s.Enforce:
+			log.Info("Policy script decision (dry-run)", "allow", outcome.allow, "reason", outcome.reason, "allowedByRules", decision.Allowed)
+			continue
+		}
+		rule := &policy.Rule{Operation: fmt.Sprint(input["operation"]), Resource: fmt.Sprint(input["resource"]), Source: "script:" + s.Name}
+		if outcome.allow && allowed == nil {
+			rule.Effect = policy.Allow
+			allowed = &policy.Decision{Allowed: true, Rule: rule, Reason: fmt.Sprintf("allowed by %v: %v", rule.Source, outcome.reason)}
+		} else if !outcome.allow && denied == nil {
+			rule.Effect = policy.Deny
+			denied = &policy.Decision{Rule: rule, Reason: fmt.Sprintf("denied by %v: %v", rule.Source, outcome.reason)}
+		}
+	}
+	explicitDeny := !decision.Allowed && decision.Rule != nil
+	switch {
+	case denied != nil:
+		return *denied, nil
+	case allowed != nil && !decision.Allowed && !explicitDeny:
+		return *allowed, nil
+	}
+	return decision, nil
+}
+
+func (d *DynKDB) runScript(ctx context.Context, script PolicyScript, input map[string]any) (scriptOutcome, error) {
+	prog, err := d.scripts.program(script.Source)
+	if err != nil {
+		return scriptOutcome{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, policyScriptTimeout)
+	defer cancel()
+	output, err := prog.Run(ctx, map[string]any{"input": input})
+	if err != nil {
+		return scriptOutcome{}, err
+	}
+	switch output := output.(type) {
+	case nil:
+		return scriptOutcome{}, nil
+	case bool:
+		return scriptOutcome{allow: output, decided: true}, nil
+	case map[string]any:
+		allow, ok := output["allow"].(bool)
+		if !ok {
+			return scriptOutcome{}, errors.New("allow must be a bool")
+		}
+		reason, _ := output["reason"].(string)
+		return scriptOutcome{allow: allow, reason: reason, decided: true}, nil
+	}
+	return scriptOutcome{}, fmt.Errorf("unexpected output %T, return undefined, a bool or a map", output)
+}
+
+func compilePolicyScript(source string) (*appshell.Program, error) {
+	sh := appshell.New(false)
+	sh.AddStdlib(policyScriptModules...)
+	return sh.Compile(source, policyScriptMaxAllocs, "input")
+}
+
+// program returns the compiled version of source
+func (c *scriptCache) program(source string) (*appshell.Program, error) {
+	sum := sha256.Sum256([]byte(source))
+	c.Lock()
+	defer c.Unlock()
+	if prog, ok := c.programs[sum]; ok {
+		return prog, nil
+	}
+	prog, err := compilePolicyScript(source)
+	if err != nil {
+		return nil, err
+	}
+	if c.programs == nil {
+		c.programs = make(map[[sha256.Size]byte]*appshell.Program)
+	}
+	c.programs[sum] = prog
+	return prog, nil
+}
+
+// clear drops every program, so programs of deleted or changed scripts are not kept around
+func (c *scriptCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.programs = nil
+}
+
+// withSourceIP returns a copy of ctx where the client address is remoteAddr (host:port or host),
+// used by requests that do not come from the SSH server
+func withSourceIP(ctx context.Context, remoteAddr string) context.Context {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	return context.WithValue(ctx, sourceIPCtxKey{}, remoteAddr)
+}
+
+// sourceIP returns the address of the client, see withSourceIP
+func sourceIP(ctx context.Context) string {
+	if ip, ok := ctx.Value(sourceIPCtxKey{}).(string); ok {
+		return ip
+	}
+	if addr, ok := ctx.Value(ssh.ContextKeyRemoteAddr).(net.Addr); ok && addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+		return addr.String()
+	}
+	return ""
+}
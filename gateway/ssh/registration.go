@@ -0,0 +1,199 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/store"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type (
+	RegistrationStatus string
+)
+
+const (
+	RegistrationPending  = RegistrationStatus("pending")
+	RegistrationApproved = RegistrationStatus("approved")
+	RegistrationRejected = RegistrationStatus("rejected")
+
+	keyRegistrationPrefix = "kdb:key-reg:"
+)
+
+var (
+	errRegistrationNotFound = errors.New("ssh: key registration not found")
+	errRegistrationDecided  = errors.New("ssh: key registration is not pending")
+	errInvalidRequest       = errors.New("ssh: invalid request")
+
+	// registrationUseCases are the operations which can be requested by a key registration
+	registrationUseCases = []string{exposeEndpointOperation, egressOperation}
+)
+
+// validate checks if the registration can be approved as requested
+func (k *KeyRegistration) validate() error {
+	var errs []error
+	if k.PublicKey.PublicKey == nil {
+		errs = append(errs, errors.New("pubkey is required"))
+	}
+	if len(k.Hosts) == 0 {
+		errs = append(errs, errors.New("at least one host is required"))
+	}
+	for _, uc := range k.UseCases {
+		if !slices.Contains(registrationUseCases, uc) {
+			errs = append(errs, fmt.Errorf("invalid use case %q, expected one of %v", uc, registrationUseCases))
+			continue
+		}
+		if uc != egressOperation {
+			continue
+		}
+		for _, h := range k.Hosts {
+			if _, err := parseEgressRule(h); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", errInvalidRequest, errors.Join(errs...))
+	}
+	return nil
+}
+
+// RequestKeyRegistration stores a pending registration, requesting again
+// resets the status to pending. Keys can only be requested by the same owner.
+func (d *DynKDB) RequestKeyRegistration(ctx context.Context, key KeyRegistration) (KeyRegistration, error) {
+	if err := key.validate(); err != nil {
+		return key, err
+	}
+	key.Fingerprint = gossh.FingerprintSHA256(key.PublicKey)
+	regLookup := d.computeRegistrationLookup(key.Fingerprint)
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+
+	var oldreg KeyRegistration
+
+	err := store.GetJSON(ctx, &oldreg, kv, regLookup)
+	if err == nil && oldreg.PublicKey.PublicKey != nil {
+		oldLookup := d.computeKeyLookupRegistration(oldreg.PublicKey.PublicKey)
+		if oldLookup != regLookup {
+			slog.Error("Key registration on database does not match its body", "lookupKey", regLookup, "bodyKey", oldLookup)
+			return key, errors.New("unexpected state")
+		}
+	}
+	if err == nil {
+		if oldreg.Owner != key.Owner {
+			return key, errNotAuthorized
+		}
+	} else if !store.IsNotFound(err) {
+		return key, err
+	}
+	key.Status = RegistrationPending
+	key.RequestedAt = time.Now()
+	key.DecidedAt = time.Time{}
+	key.DecidedBy = ""
+	key.Reason = ""
+	ops.Fail(store.PutJSON(ctx, kv, regLookup, &key))
+	return key, ops.Commit()
+}
+
+// KeyRegistration returns the registration of the key with the given fingerprint
+func (d *DynKDB) KeyRegistration(ctx context.Context, fingerprint string) (KeyRegistration, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	return d.getRegistration(ctx, ops.KV(), fingerprint)
+}
+
+// ListKeyRegistrations returns every registration with the given status, or all if status is empty
+func (d *DynKDB) ListKeyRegistrations(ctx context.Context, status RegistrationStatus) ([]KeyRegistration, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	var ret []KeyRegistration
+	for _, k := range kv.Keys(ctx, keyRegistrationPrefix) {
+		reg, err := d.getRegistration(ctx, kv, strings.TrimPrefix(k, keyRegistrationPrefix))
+		if err != nil {
+			slog.Error("Invalid key registration in database", "lookupKey", k, "err", err)
+			continue
+		}
+		if status == "" || reg.Status == status {
+			ret = append(ret, reg)
+		}
+	}
+	return ret, kv.Err()
+}
+
+// ApproveKeyRegistration registers the key for the requested hosts and grants the
+// requested use cases for each host, the key is valid for validFor.
+func (d *DynKDB) ApproveKeyRegistration(ctx context.Context, fingerprint, approver string, validFor time.Duration) (KeyRegistration, error) {
+	if validFor <= 0 {
+		return KeyRegistration{}, fmt.Errorf("%w: approved keys must be valid for a positive duration", errInvalidRequest)
+	}
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	reg, err := d.getRegistration(ctx, kv, fingerprint)
+	if err != nil {
+		return reg, err
+	}
+	if reg.Status != RegistrationPending {
+		return reg, errRegistrationDecided
+	}
+	now := time.Now()
+	if reg.Owner != "" {
+		ops.Fail(ops.Users().Ensure(ctx, reg.Owner))
+	}
+	ops.Fail(d.registerKey(ctx, kv, reg.PublicKey, reg.Owner, now, now.Add(validFor), reg.Hosts))
+	for _, uc := range reg.UseCases {
+		for _, h := range reg.Hosts {
+			ops.Fail(d.setPermission(ctx, kv, reg.PublicKey, uc, h, "allow"))
+		}
+	}
+	reg.Status = RegistrationApproved
+	reg.DecidedAt = now
+	reg.DecidedBy = approver
+	ops.Fail(store.PutJSON(ctx, kv, d.computeRegistrationLookup(fingerprint), &reg))
+	return reg, ops.Commit()
+}
+
+// RejectKeyRegistration marks a pending registration as rejected
+func (d *DynKDB) RejectKeyRegistration(ctx context.Context, fingerprint, approver, reason string) (KeyRegistration, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	reg, err := d.getRegistration(ctx, kv, fingerprint)
+	if err != nil {
+		return reg, err
+	}
+	if reg.Status != RegistrationPending {
+		return reg, errRegistrationDecided
+	}
+	reg.Status = RegistrationRejected
+	reg.DecidedAt = time.Now()
+	reg.DecidedBy = approver
+	reg.Reason = reason
+	ops.Fail(store.PutJSON(ctx, kv, d.computeRegistrationLookup(fingerprint), &reg))
+	return reg, ops.Commit()
+}
+
+func (d *DynKDB) getRegistration(ctx context.Context, kv store.KVOps, fingerprint string) (KeyRegistration, error) {
+	var reg KeyRegistration
+	err := store.GetJSON(ctx, &reg, kv, d.computeRegistrationLookup(fingerprint))
+	if store.IsNotFound(err) {
+		return reg, errRegistrationNotFound
+	} else if err != nil {
+		return reg, err
+	}
+	if reg.Fingerprint == "" && reg.PublicKey.PublicKey != nil {
+		// registrations stored before the approval workflow
+		reg.Fingerprint = gossh.FingerprintSHA256(reg.PublicKey)
+	}
+	if reg.Status == "" {
+		reg.Status = RegistrationPending
+	}
+	return reg, nil
+}
@@ -3,12 +3,17 @@ package ssh
 import (
 	"context"
 	"fmt"
-	"io"
 	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/andrebq/vandrare/internal/loadbalancer"
+	"github.com/andrebq/vandrare/internal/pipe"
+	"github.com/andrebq/vandrare/internal/proxyproto"
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -48,6 +53,12 @@ func (g *Gateway) registerEndpoint(sshctx ssh.Context, req *gossh.Request) (cont
 	if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
 		return nil, nil, 0, nil, fmt.Errorf("ssh-gateway: remote forward parse error: %w", err)
 	}
+	key, _ := sshctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if err := g.authorizeEndpoint(sshctx, key, reqPayload.BindAddr); err != nil {
+		slog.Info("Endpoint denied", "user", sshctx.User(), "remoteAddr", sshctx.RemoteAddr(),
+			"bindAddr", reqPayload.BindAddr, "bindPort", reqPayload.BindPort, "err", err)
+		return nil, nil, 0, nil, err
+	}
 	identity := fmt.Sprintf("%v:%v", reqPayload.BindAddr, reqPayload.BindPort)
 
 	lb := g.acquireLB(identity)
@@ -62,6 +73,16 @@ func (g *Gateway) registerEndpoint(sshctx ssh.Context, req *gossh.Request) (cont
 			delete(g.accepting, identity)
 		}
 		g.l.Unlock()
+		// connections queued for this worker will never be picked up,
+		// Remove guarantees nothing else is queued once it returns
+		for drained := false; !drained; {
+			select {
+			case conn := <-connections:
+				conn.io.Close()
+			default:
+				drained = true
+			}
+		}
 		sshctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn).Close()
 		cancel()
 	})
@@ -71,6 +92,17 @@ func (g *Gateway) registerEndpoint(sshctx ssh.Context, req *gossh.Request) (cont
 	return ctx, connections, reqPayload.BindPort, cleanup, nil
 }
 
+// authorizeEndpoint checks if key can expose host, only the subdomains (and names under them)
+// can be exposed, so tunnels never shadow the destinations of egress connections
+func (g *Gateway) authorizeEndpoint(ctx context.Context, key ssh.PublicKey, host string) error {
+	if key == nil {
+		return errNotAuthorized
+	} else if !g.isEndpointHost(host) {
+		return fmt.Errorf("%w: %v is not under the subdomains", errNotAuthorized, host)
+	}
+	return g.kdb.AuthZ(ctx, key, exposeEndpointOperation, strings.ToLower(strings.TrimSuffix(host, ".")))
+}
+
 func (g *Gateway) handleCancelTCPForward(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
 	if !g.ensurePubkeyAuth(ctx) {
 		return false, nil
@@ -105,14 +137,33 @@ func (g *Gateway) handleReverseConnection(ctx context.Context, conn connData) {
 		return
 	}
 	go gossh.DiscardRequests(reqs)
-	go copyAndClose(ch, conn.io)
-	go copyAndClose(conn.io, ch)
+	if g.settings().ProxyProtocol.EmitToBackends {
+		if err := proxyproto.WriteV2(ch, conn.remote, conn.local); err != nil {
+			slog.Debug("Unable to send proxy header to backend", "err", err)
+			ch.Close()
+			conn.io.Close()
+			return
+		}
+	}
+	go pipeAndLog(slog.With("remoteAddr", conn.remote,
+		"from", net.JoinHostPort(conn.from.host, strconv.Itoa(int(conn.from.port))),
+		"to", net.JoinHostPort(conn.to.host, strconv.Itoa(int(conn.to.port)))), conn.io, ch)
+}
+
+// pipeAndLog copies data between client and backend until both sides
+// are done and logs how much data went through each direction
+func pipeAndLog(log *slog.Logger, client, backend pipe.Conn) {
+	st := pipe.Run(client, backend)
+	log.Info("Connection closed",
+		"bytesUp", st.Upstream.Bytes, "upReason", closeReason(st.Upstream.Reason),
+		"bytesDown", st.Downstream.Bytes, "downReason", closeReason(st.Downstream.Reason))
 }
 
-func copyAndClose(to io.WriteCloser, from io.ReadCloser) {
-	defer to.Close()
-	defer from.Close()
-	io.Copy(to, from)
+func closeReason(err error) string {
+	if err == nil {
+		return "eof"
+	}
+	return err.Error()
 }
 
 func (g *Gateway) acquireLB(endpoint string) *loadbalancer.LB[connData] {
@@ -120,12 +171,92 @@ func (g *Gateway) acquireLB(endpoint string) *loadbalancer.LB[connData] {
 	defer g.l.Unlock()
 	lb := g.accepting[endpoint]
 	if lb == nil {
-		lb = loadbalancer.NewLB[connData](context.Background(), time.Now().Unix())
+		lb = loadbalancer.NewLBWithOptions[connData](context.Background(), time.Now().Unix(), g.settings().Balancer)
 		g.accepting[endpoint] = lb
+		if w := g.waiting[endpoint]; w != nil {
+			close(w.ready)
+			delete(g.waiting, endpoint)
+		}
 	}
 	return lb
 }
 
+// waitLB waits up to WaitBackend.Grace for endpoint to be registered,
+// returns nil if the endpoint did not show up in time.
+func (g *Gateway) waitLB(ctx context.Context, endpoint string) (*loadbalancer.LB[connData], error) {
+	g.l.Lock()
+	if lb := g.accepting[endpoint]; lb != nil {
+		g.l.Unlock()
+		return lb, nil
+	}
+	w := g.waiting[endpoint]
+	if w == nil {
+		w = &backendWaiter{ready: make(chan struct{})}
+		g.waiting[endpoint] = w
+	}
+	settings := g.settings()
+	if settings.WaitBackend.MaxWaiting > 0 && w.pending >= settings.WaitBackend.MaxWaiting {
+		g.l.Unlock()
+		return nil, errTooManyWaiting
+	}
+	w.pending++
+	g.l.Unlock()
+
+	defer func() {
+		g.l.Lock()
+		w.pending--
+		if w.pending == 0 && g.waiting[endpoint] == w {
+			delete(g.waiting, endpoint)
+		}
+		g.l.Unlock()
+	}()
+
+	timer := time.NewTimer(settings.WaitBackend.Grace)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return g.getLB(endpoint), nil
+	case <-timer.C:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// endpointStats returns the load balancer statistics of every endpoint
+// currently exposed by the gateway
+func (g *Gateway) endpointStats() []EndpointStats {
+	g.l.Lock()
+	lbs := make(map[string]*loadbalancer.LB[connData], len(g.accepting))
+	for k, v := range g.accepting {
+		lbs[k] = v
+	}
+	g.l.Unlock()
+
+	ret := make([]EndpointStats, 0, len(lbs))
+	for identity, lb := range lbs {
+		st := lb.Stats()
+		es := EndpointStats{
+			Identity:  identity,
+			Workers:   len(st.QueueDepth),
+			Offered:   int64(st.Offered),
+			Delivered: int64(st.Delivered),
+			Rejected:  int64(st.Rejected),
+			Skipped:   int64(st.Skipped),
+			MaxWaitMs: st.MaxWait.Milliseconds(),
+		}
+		if st.Delivered > 0 {
+			es.AvgWaitMs = (st.TotalWait / time.Duration(st.Delivered)).Milliseconds()
+		}
+		for _, d := range st.QueueDepth {
+			es.Queued += d
+		}
+		ret = append(ret, es)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Identity < ret[j].Identity })
+	return ret
+}
+
 func (g *Gateway) getLB(endpoint string) *loadbalancer.LB[connData] {
 	g.l.Lock()
 	defer g.l.Unlock()
@@ -145,3 +276,9 @@ func (g *Gateway) getCleanup(conn *gossh.ServerConn) func() {
 	g.l.Unlock()
 	return cl
 }
+
+func (g *Gateway) dropCleanup(conn *gossh.ServerConn) {
+	g.l.Lock()
+	delete(g.cleanup, conn)
+	g.l.Unlock()
+}
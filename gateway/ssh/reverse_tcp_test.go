@@ -0,0 +1,49 @@
+package ssh_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/gateway/ssh"
+)
+
+func TestEndpointsCannotShadowEgress(t *testing.T) {
+	ctx := context.Background()
+	kdb := newTestKDB(t)
+	g, err := ssh.NewGateway(kdb, &ssh.TokenDB{Store: *kdb.Store}, nil, ssh.GenerateCAKey([ed25519.SeedSize]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Subdomains = []string{"example.com"}
+	g.Egress.Enabled = true
+
+	attacker := newTestKey(t)
+	if err := kdb.RegisterKey(ctx, attacker, "mallory", time.Now().Add(-time.Minute), time.Now().Add(time.Hour), []string{"svc.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// even a key allowed to expose anything only exposes names under the subdomains
+	if err := kdb.SetPermission(ctx, attacker, "expose-endpoint", "*", "allow"); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"10.0.0.5", "db.internal", "example.org", "notexample.com"} {
+		if err := ssh.AuthorizeEndpoint(g, ctx, attacker, host); err == nil {
+			t.Errorf("%v is an egress destination and cannot be exposed", host)
+		}
+	}
+	if err := ssh.AuthorizeEndpoint(g, ctx, attacker, "svc.example.com"); err != nil {
+		t.Fatalf("Allowed host should be exposed, got %v", err)
+	}
+
+	other := newTestKey(t)
+	if err := kdb.RegisterKey(ctx, other, "alice", time.Now().Add(-time.Minute), time.Now().Add(time.Hour), []string{"api.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ssh.AuthorizeEndpoint(g, ctx, other, "svc.example.com"); err == nil {
+		t.Fatal("Keys should only expose their allowed hosts")
+	}
+	if err := ssh.AuthorizeEndpoint(g, ctx, newTestKey(t), "svc.example.com"); err == nil {
+		t.Fatal("Unknown keys should not expose endpoints")
+	}
+}
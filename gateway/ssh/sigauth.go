@@ -0,0 +1,85 @@
+package ssh
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/sshsig"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// httpAPIOperation grants the token scope in the resource to requests
+	// signed by the key, see sshsig.AuthorizeRequest
+	httpAPIOperation = "http-api"
+)
+
+// HTTPScopes returns the scopes granted to key by the http-api rules of the key,
+// its groups and the policy scripts, expired or unknown keys are not authorized.
+func (d *DynKDB) HTTPScopes(ctx context.Context, key ssh.PublicKey) ([]string, error) {
+	cfg, err := d.lookupAndVerifyConfig(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := d.effectiveRules(ctx, key, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []string
+	for _, scope := range tokenScopes {
+		decision, err := d.decide(ctx, key, cfg, rules, httpAPIOperation, scope)
+		if err != nil {
+			return nil, err
+		} else if decision.Allowed {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// authorizeHTTPScope checks if key was granted scope (or ScopeAdmin) by its http-api permissions
+func (d *DynKDB) authorizeHTTPScope(ctx context.Context, key ssh.PublicKey, scope string) error {
+	scopes, err := d.HTTPScopes(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !hasScope(scopes, scope) {
+		return errNotAuthorized
+	}
+	return nil
+}
+
+// signatureAuth authenticates requests signed by a registered key (see sshsig.AuthorizeRequest),
+// returns the owner and the scopes granted to the key. The owner is the owner of the key, the one
+// who requested its registration or the key fingerprint if neither is known.
+//
+// Keys without any scope are not authorized, the nonce is only recorded for authorized keys.
+func (g *Gateway) signatureAuth(req *http.Request) (string, []string, error) {
+	body, err := readSignedBody(req)
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := sshsig.VerifyAuthorization(req, body, time.Now(), maxSignatureSkew)
+	if err != nil {
+		return "", nil, err
+	}
+	scopes, err := g.kdb.HTTPScopes(withSourceIP(req.Context(), req.RemoteAddr), key)
+	if err != nil {
+		return "", nil, err
+	} else if len(scopes) == 0 {
+		return "", nil, errNotAuthorized
+	}
+	if err := g.checkReplay(req, key); err != nil {
+		return "", nil, err
+	}
+	fingerprint := gossh.FingerprintSHA256(key)
+	owner := fingerprint
+	if entry, err := g.kdb.GetKey(req.Context(), fingerprint); err == nil && entry.Config.Owner != "" {
+		owner = entry.Config.Owner
+	} else if reg, err := g.kdb.KeyRegistration(req.Context(), fingerprint); err == nil && reg.Owner != "" {
+		owner = reg.Owner
+	}
+	return owner, scopes, nil
+}
@@ -6,9 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"sort"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/andrebq/vandrare/internal/policy"
 	"github.com/andrebq/vandrare/internal/store"
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
@@ -17,6 +19,11 @@ import (
 type (
 	DynKDB struct {
 		Store *store.Store
+
+		scripts scriptCache
+		// groupList and scriptList keep the groups and policy scripts used by AuthZ
+		groupList  listCache[Group]
+		scriptList listCache[PolicyScript]
 	}
 
 	KeyConfig struct {
@@ -24,6 +31,8 @@ type (
 		ValidFrom    time.Time
 		AllowedHosts []string
 		Description  string
+		// Owner is the user who owns the key, keys of suspended users cannot be used
+		Owner string `json:",omitempty"`
 	}
 
 	KeyPermissions struct {
@@ -42,6 +51,13 @@ type (
 		Hosts       []string  `json:"hosts"`
 		Description string    `json:"description"`
 		Owner       string    `json:"owner"`
+
+		Fingerprint string             `json:"fingerprint"`
+		Status      RegistrationStatus `json:"status"`
+		RequestedAt time.Time          `json:"requestedAt"`
+		DecidedAt   time.Time          `json:"decidedAt"`
+		DecidedBy   string             `json:"decidedBy,omitempty"`
+		Reason      string             `json:"reason,omitempty"`
 	}
 
 	SSHPubKey struct {
@@ -51,7 +67,7 @@ type (
 
 func (s *SSHPubKey) MarshalJSON() ([]byte, error) {
 	if s.PublicKey == nil {
-		return nil, nil
+		return []byte("null"), nil
 	}
 	return json.Marshal(string(gossh.MarshalAuthorizedKey(*s)))
 }
@@ -62,6 +78,8 @@ func (s *SSHPubKey) UnmarshalJSON(buf []byte) error {
 	err := json.Unmarshal(buf, &str)
 	if err != nil {
 		return err
+	} else if str == "" {
+		return nil
 	}
 	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(str))
 	if err != nil {
@@ -71,78 +89,88 @@ func (s *SSHPubKey) UnmarshalJSON(buf []byte) error {
 	return nil
 }
 
+const (
+	exposeEndpointOperation = "expose-endpoint"
+
+	// removeAction deletes a permission entry instead of storing it
+	removeAction = "remove"
+)
+
 var (
 	errNotAuthorized = errors.New("ssh: not authorized")
 )
 
-func (d *DynKDB) RegisterKey(ctx context.Context, key ssh.PublicKey, validFrom, expiresAt time.Time, allowedHosts []string) error {
-	lookupKey := d.computeKeyLookup(key)
+// RegisterKey stores key owned by owner, an empty owner keeps the owner of a key registered before
+func (d *DynKDB) RegisterKey(ctx context.Context, key ssh.PublicKey, owner string, validFrom, expiresAt time.Time, allowedHosts []string) error {
 	ops := d.Store.Ops(false)
 	defer ops.Close()
+	if owner != "" {
+		ops.Fail(ops.Users().Ensure(ctx, owner))
+	}
+	ops.Fail(d.registerKey(ctx, ops.KV(), key, owner, validFrom, expiresAt, allowedHosts))
+	return ops.Commit()
+}
+
+func (d *DynKDB) registerKey(ctx context.Context, kv store.KVOps, key ssh.PublicKey, owner string, validFrom, expiresAt time.Time, allowedHosts []string) error {
+	lookupKey := d.computeKeyLookup(key)
+	if owner == "" {
+		var previous KeyConfig
+		if err := store.GetJSON(ctx, &previous, kv, lookupKey); err == nil {
+			owner = previous.Owner
+		} else if !store.IsNotFound(err) {
+			return err
+		}
+	}
 	cfg := KeyConfig{
 		ExpiresAt:    expiresAt,
 		ValidFrom:    validFrom,
 		AllowedHosts: allowedHosts,
 		Description:  string(gossh.MarshalAuthorizedKey(key)),
+		Owner:        owner,
 	}
-	kv := ops.KV()
 	buf, err := json.Marshal(cfg)
 	if err != nil {
 		return err
 	}
 	kv.SetBytes(ctx, lookupKey, buf)
-	ops.Fail(kv.Err())
-	return ops.Commit()
+	return kv.Err()
 }
 
 func (d *DynKDB) SetPermission(ctx context.Context, key ssh.PublicKey, operation, resource, action string) error {
-	lookupKey := d.computeKeyPermissionLookup(key)
 	ops := d.Store.Ops(false)
 	defer ops.Close()
+	ops.Fail(d.setPermission(ctx, ops.KV(), key, operation, resource, action))
+	return ops.Commit()
+}
 
-	kv := ops.KV()
+func (d *DynKDB) setPermission(ctx context.Context, kv store.KVOps, key ssh.PublicKey, operation, resource, action string) error {
+	lookupKey := d.computeKeyPermissionLookup(key)
 	permissions := KeyPermissions{}
 	err := store.GetJSON(ctx, &permissions, kv, lookupKey)
-	if store.IsNotFound(err) {
-		err = nil
-	} else if err != nil {
+	if err != nil && !store.IsNotFound(err) {
 		return err
 	}
-	foundIdx := -1
-	for i, perm := range permissions.Entries {
-		if perm.Operation == operation && perm.Resource == resource {
-			if action == "deny" {
-				permissions.Entries[i] = Permission{}
-				foundIdx = i
-				break
-			}
-		}
+	permissions.Entries = setPermissionEntry(permissions.Entries, operation, resource, action)
+	return store.PutJSON(ctx, kv, lookupKey, permissions)
+}
+
+// setPermissionEntry adds or replaces the entry for operation and resource,
+// the remove action deletes the entry instead. Actions are stored in lower case.
+func setPermissionEntry(entries []Permission, operation, resource, action string) []Permission {
+	action = strings.ToLower(action)
+	idx := slices.IndexFunc(entries, func(p Permission) bool {
+		return p.Operation == operation && p.Resource == resource
+	})
+	switch {
+	case action == removeAction && idx >= 0:
+		return slices.Delete(entries, idx, idx+1)
+	case action == removeAction:
+		return entries
+	case idx >= 0:
+		entries[idx].Action = action
+		return entries
 	}
-	if foundIdx == -1 && action != "deny" {
-		permissions.Entries = append(permissions.Entries, Permission{
-			Action:    action,
-			Operation: operation,
-			Resource:  resource,
-		})
-	} else if foundIdx != -1 {
-		switch {
-		case foundIdx == len(permissions.Entries)-1:
-			permissions.Entries = permissions.Entries[:foundIdx-1]
-		case foundIdx == 0:
-			permissions.Entries = permissions.Entries[1:]
-		default:
-			permissions.Entries[foundIdx] = permissions.Entries[len(permissions.Entries)-1]
-			permissions.Entries = permissions.Entries[:len(permissions.Entries)-1]
-		}
-		sort.Slice(permissions.Entries, func(i, j int) bool {
-			pi, pj := permissions.Entries[i], permissions.Entries[j]
-			return pi.Resource < pj.Resource &&
-				pi.Operation < pj.Operation &&
-				pi.Action < pj.Action
-		})
-	}
-	ops.Fail(store.PutJSON(ctx, kv, lookupKey, permissions))
-	return ops.Commit()
+	return append(entries, Permission{Operation: operation, Resource: resource, Action: action})
 }
 
 func (d *DynKDB) AuthN(ctx context.Context, key ssh.PublicKey) error {
@@ -151,41 +179,53 @@ func (d *DynKDB) AuthN(ctx context.Context, key ssh.PublicKey) error {
 }
 
 func (d *DynKDB) AuthZ(ctx context.Context, key ssh.PublicKey, operation, resource string) error {
-	if operation != "expose-endpoint" {
-		// for now, this is the only action, other than admin, that can run
-		// and admin sessions are authorized by a different key
+	decision, err := d.Explain(ctx, key, operation, resource)
+	if err != nil {
+		return err
+	} else if !decision.Allowed {
 		return errNotAuthorized
 	}
+	return nil
+}
+
+// Explain evaluates the rules of the key and its groups, and then the policy scripts,
+// for operation on resource and reports which rule or script decided the outcome.
+func (d *DynKDB) Explain(ctx context.Context, key ssh.PublicKey, operation, resource string) (policy.Decision, error) {
+	switch operation {
+	case exposeEndpointOperation, egressOperation, httpAPIOperation:
+	default:
+		// admin sessions are authorized by a different key
+		return policy.Decision{Reason: fmt.Sprintf("%v cannot be authorized by keys", operation)}, nil
+	}
 	cfg, err := d.lookupAndVerifyConfig(ctx, key)
-	if err != nil {
-		return err
+	if errors.Is(err, errNotAuthorized) {
+		return policy.Decision{Reason: "key is unknown, not valid yet, expired or its owner is suspended"}, nil
+	} else if err != nil {
+		return policy.Decision{}, err
 	}
-	for _, s := range cfg.AllowedHosts {
-		if s == resource {
-			return nil
-		}
+	rules, err := d.effectiveRules(ctx, key, cfg)
+	if err != nil {
+		return policy.Decision{}, err
 	}
-	return errNotAuthorized
+	return d.decide(ctx, key, cfg, rules, operation, resource)
 }
 
-func (d *DynKDB) RequestKeyRegistration(ctx context.Context, key KeyRegistration) (KeyRegistration, error) {
-	regLookup := d.computeKeyLookupRegistration(key.PublicKey)
-	ops := d.Store.Ops(false)
-	defer ops.Close()
-	kv := ops.KV()
-
-	var oldreg KeyRegistration
-
-	err := store.GetJSON(ctx, &oldreg, kv, regLookup)
-	if err == nil {
-		oldLookup := d.computeKeyLookupRegistration(oldreg.PublicKey.PublicKey)
-		if oldLookup != regLookup {
-			slog.Error("Key registration on database does not match its body", "lookupKey", regLookup, "bodyKey", oldLookup)
-			return key, errors.New("unexpected state")
-		}
+// decide evaluates rules, see policy.Evaluate, and then the policy scripts, see applyScripts
+func (d *DynKDB) decide(ctx context.Context, key ssh.PublicKey, cfg KeyConfig, rules []policy.Rule, operation, resource string) (policy.Decision, error) {
+	var match policy.Matcher
+	if operation == egressOperation {
+		match = matchEgress
 	}
-	ops.Fail(store.PutJSON(ctx, kv, regLookup, key))
-	return key, ops.Commit()
+	decision := policy.Evaluate(rules, operation, resource, match)
+	return d.applyScripts(ctx, map[string]any{
+		"fingerprint": gossh.FingerprintSHA256(key),
+		"owner":       cfg.Owner,
+		"operation":   operation,
+		"resource":    resource,
+		"sourceIP":    sourceIP(ctx),
+		"time":        time.Now(),
+		"allowed":     decision.Allowed,
+	}, decision)
 }
 
 func (d *DynKDB) lookupAndVerifyConfig(ctx context.Context, key ssh.PublicKey) (KeyConfig, error) {
@@ -205,18 +245,36 @@ func (d *DynKDB) lookupAndVerifyConfig(ctx context.Context, key ssh.PublicKey) (
 	if cfg.ValidFrom.After(now) || cfg.ExpiresAt.Before(now) {
 		return KeyConfig{}, errNotAuthorized
 	}
+	if cfg.Owner != "" {
+		if active, err := ops.Users().Active(ctx, cfg.Owner); err != nil {
+			return KeyConfig{}, err
+		} else if !active {
+			return KeyConfig{}, errNotAuthorized
+		}
+	}
 	return cfg, nil
 }
 
 func (d *DynKDB) computeKeyLookup(key ssh.PublicKey) string {
-	sig := gossh.FingerprintSHA256(key)
-	return fmt.Sprintf("kdb:key:%v", sig)
+	return d.computeFingerprintLookup(gossh.FingerprintSHA256(key))
+}
+
+func (d *DynKDB) computeFingerprintLookup(fingerprint string) string {
+	return fmt.Sprintf("%v%v", keyPrefix, fingerprint)
 }
 
 func (d *DynKDB) computeKeyPermissionLookup(key ssh.PublicKey) string {
-	return fmt.Sprintf("kdb:key-perm:%v", gossh.FingerprintSHA256(key))
+	return d.computeFingerprintPermissionLookup(gossh.FingerprintSHA256(key))
+}
+
+func (d *DynKDB) computeFingerprintPermissionLookup(fingerprint string) string {
+	return fmt.Sprintf("kdb:key-perm:%v", fingerprint)
 }
 
 func (d *DynKDB) computeKeyLookupRegistration(key ssh.PublicKey) string {
-	return fmt.Sprintf("kdb:key-reg:%v", gossh.FingerprintSHA256(key))
+	return d.computeRegistrationLookup(gossh.FingerprintSHA256(key))
+}
+
+func (d *DynKDB) computeRegistrationLookup(fingerprint string) string {
+	return fmt.Sprintf("%v%v", keyRegistrationPrefix, fingerprint)
 }
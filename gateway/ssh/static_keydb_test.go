@@ -0,0 +1,91 @@
+package ssh_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/gateway/ssh"
+	"github.com/andrebq/vandrare/internal/store"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestKDB(t *testing.T) *ssh.DynKDB {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ssh.DynKDB{Store: st}
+}
+
+func newTestKey(t *testing.T) gossh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestMixedCaseDeny(t *testing.T) {
+	ctx := context.Background()
+	kdb := newTestKDB(t)
+	key := newTestKey(t)
+	if err := kdb.RegisterKey(ctx, key, "alice", time.Now().Add(-time.Minute), time.Now().Add(time.Hour), []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][3]string{
+		{"egress", "*.example.com:22", "ALLOW"},
+		{"egress", "secret.example.com:22", "Deny"},
+	} {
+		if err := kdb.SetPermission(ctx, key, p[0], p[1], p[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kdb.AuthZ(ctx, key, "egress", "db.example.com:22"); err != nil {
+		t.Fatalf("db.example.com should be allowed, got %v", err)
+	}
+	if err := kdb.AuthZ(ctx, key, "egress", "secret.example.com:22"); err == nil {
+		t.Fatal("secret.example.com should be denied")
+	}
+	decision, err := kdb.Explain(ctx, key, "egress", "secret.example.com:22")
+	if err != nil {
+		t.Fatal(err)
+	} else if decision.Allowed || decision.Rule == nil || decision.Rule.Source != "key" {
+		t.Fatalf("Should be denied by the key rule, got %v", decision.Reason)
+	}
+}
+
+func TestSSHPubKeyJSON(t *testing.T) {
+	buf, err := json.Marshal(&ssh.SSHPubKey{})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "null" {
+		t.Fatalf("Missing keys should be null, got %s", buf)
+	}
+	var empty ssh.SSHPubKey
+	if err := json.Unmarshal(buf, &empty); err != nil {
+		t.Fatal(err)
+	} else if empty.PublicKey != nil {
+		t.Fatalf("null should not decode to a key, got %v", empty.PublicKey)
+	}
+
+	key := newTestKey(t)
+	buf, err = json.Marshal(&ssh.SSHPubKey{PublicKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ssh.SSHPubKey
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	} else if decoded.PublicKey == nil || !bytes.Equal(decoded.Marshal(), key.Marshal()) {
+		t.Fatalf("Key should survive a round trip, got %s", buf)
+	}
+}
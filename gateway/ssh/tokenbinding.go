@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/sshsig"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type (
+	// seenNonces remembers the nonces of signed requests while their timestamps
+	// are still accepted, so captured requests cannot be replayed
+	seenNonces struct {
+		sync.Mutex
+		entries   map[string]time.Time
+		nextSweep time.Time
+		lastSweep time.Time
+	}
+)
+
+const (
+	// maxSignatureSkew is how far the timestamp of a signed request can be from the gateway clock,
+	// nonces are remembered for as long as a request could be accepted
+	maxSignatureSkew = time.Minute * 5
+	// maxSignedBodySize limits how much of the body is read to verify a request signature
+	maxSignedBodySize = 1 << 20
+	// maxSeenNonces limits how many nonces are remembered, signed requests
+	// are rejected while the limit is reached
+	maxSeenNonces = 100_000
+)
+
+// checkBindableKey returns an error unless fingerprint belongs to a registered key
+func (g *Gateway) checkBindableKey(ctx context.Context, fingerprint string) error {
+	if fingerprint == "" {
+		return nil
+	}
+	_, err := g.kdb.GetKey(ctx, fingerprint)
+	if errors.Is(err, errKeyNotFound) {
+		return fmt.Errorf("%w: key %v is not registered", errInvalidRequest, fingerprint)
+	}
+	return err
+}
+
+// bindToken binds the token with the given id to a registered key, see TokenDB.Bind
+func (g *Gateway) bindToken(ctx context.Context, id, fingerprint string) error {
+	if err := g.checkBindableKey(ctx, fingerprint); err != nil {
+		return err
+	}
+	return g.tdb.Bind(ctx, id, fingerprint)
+}
+
+// readSignedBody reads the body of a signed request and replaces it,
+// so handlers can still read it
+func readSignedBody(req *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBodySize+1))
+	if err != nil {
+		return nil, err
+	} else if len(body) > maxSignedBodySize {
+		return nil, fmt.Errorf("%w: body is larger than %v bytes", sshsig.ErrInvalidSignature, maxSignedBodySize)
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// add records the nonce used by the key with the given fingerprint, it fails if the nonce was
+// already used or if maxSeenNonces is reached. A request is accepted for up to twice the skew,
+// its timestamp might be in the future.
+func (s *seenNonces) add(fingerprint, nonce string, now time.Time) error {
+	key := fingerprint + " " + nonce
+	s.Lock()
+	defer s.Unlock()
+	full := len(s.entries) >= maxSeenNonces
+	// when full, sweep at most once a second so rejected requests stay cheap
+	if now.After(s.nextSweep) || (full && now.Sub(s.lastSweep) >= time.Second) {
+		for k, until := range s.entries {
+			if now.After(until) {
+				delete(s.entries, k)
+			}
+		}
+		s.nextSweep, s.lastSweep = now.Add(maxSignatureSkew), now
+	}
+	if until, found := s.entries[key]; found && !now.After(until) {
+		return fmt.Errorf("%w: nonce was already used", sshsig.ErrInvalidSignature)
+	} else if len(s.entries) >= maxSeenNonces {
+		return fmt.Errorf("%w: too many recent nonces, try again later", sshsig.ErrInvalidSignature)
+	}
+	if s.entries == nil {
+		s.entries = make(map[string]time.Time)
+	}
+	s.entries[key] = now.Add(maxSignatureSkew * 2)
+	return nil
+}
+
+// checkReplay rejects requests signed by key with a nonce which was already used, see sshsig.RequestMessage.
+// Callers must authenticate key first, so unknown keys cannot fill the list of nonces.
+func (g *Gateway) checkReplay(req *http.Request, key gossh.PublicKey) error {
+	return g.nonces.add(gossh.FingerprintSHA256(key), req.Header.Get(sshsig.NonceHeader), time.Now())
+}
+
+// verifyTokenBinding checks that req was signed (see sshsig.SignRequest) by the key with
+// the given fingerprint and that the key is still valid.
+func (g *Gateway) verifyTokenBinding(req *http.Request, fingerprint string) error {
+	body, err := readSignedBody(req)
+	if err != nil {
+		return err
+	}
+	key, err := sshsig.VerifyRequest(req, body, time.Now(), maxSignatureSkew)
+	if err != nil {
+		return err
+	}
+	if actual := gossh.FingerprintSHA256(key); actual != fingerprint {
+		return fmt.Errorf("%w: signed by %v instead of the bound key", sshsig.ErrInvalidSignature, actual)
+	}
+	// the token is only as good as the key, revoked or expired keys cannot be used
+	if err := g.kdb.AuthN(req.Context(), key); err != nil {
+		return err
+	}
+	return g.checkReplay(req, key)
+}
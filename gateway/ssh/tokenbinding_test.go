@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/sshsig"
+	"github.com/andrebq/vandrare/internal/store"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestSeenNonces(t *testing.T) {
+	var s seenNonces
+	now := time.Now()
+	if err := s.add("key-a", "nonce", now); err != nil {
+		t.Fatal("First use of a nonce should be accepted", err)
+	}
+	if s.add("key-a", "nonce", now.Add(maxSignatureSkew)) == nil {
+		t.Fatal("Replayed nonce should be rejected")
+	}
+	if err := s.add("key-b", "nonce", now); err != nil {
+		t.Fatal("Nonces of different keys should not conflict", err)
+	}
+	// the timestamp of the request can no longer be accepted, so the nonce can be forgotten
+	later := now.Add(maxSignatureSkew*2 + time.Second)
+	if err := s.add("key-c", "other", later); err != nil {
+		t.Fatal("Unrelated nonce should be accepted", err)
+	}
+	if _, found := s.entries["key-a nonce"]; found {
+		t.Fatal("Expired nonces should be removed")
+	}
+}
+
+func TestSeenNoncesLimit(t *testing.T) {
+	var s seenNonces
+	now := time.Now()
+	for i := 0; i < maxSeenNonces; i++ {
+		if err := s.add("key-a", fmt.Sprint(i), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.add("key-a", "one-too-many", now.Add(time.Second)) == nil {
+		t.Fatal("Nonces should be rejected once the limit is reached")
+	}
+	if len(s.entries) != maxSeenNonces {
+		t.Fatalf("Nonces should not grow past the limit, got %v", len(s.entries))
+	}
+	// once the older nonces expire there is room again, even before the regular sweep
+	s.nextSweep = now.Add(time.Hour)
+	if err := s.add("key-a", "one-too-many", now.Add(maxSignatureSkew*2+time.Second)); err != nil {
+		t.Fatal("Expired nonces should make room for new ones", err)
+	}
+}
+
+func TestSignatureAuthNonces(t *testing.T) {
+	ctx := context.Background()
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdb := &DynKDB{Store: st}
+	g, err := NewGateway(kdb, &TokenDB{Store: *st}, nil, GenerateCAKey([ed25519.SeedSize]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/gateway/ssh/certificates/hosts/all_known_hosts", nil)
+	if err := sshsig.AuthorizeRequest(req, nil, signer); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := g.signatureAuth(req.Clone(ctx)); err == nil {
+		t.Fatal("Unknown keys should not be authorized")
+	} else if len(g.nonces.entries) != 0 {
+		t.Fatal("Nonces of unknown keys should not be recorded")
+	}
+
+	key := signer.PublicKey()
+	if err := kdb.RegisterKey(ctx, key, "alice", time.Now().Add(-time.Minute), time.Now().Add(time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := g.signatureAuth(req.Clone(ctx)); err == nil {
+		t.Fatal("Keys without http-api scopes should not be authorized")
+	} else if len(g.nonces.entries) != 0 {
+		t.Fatal("Nonces of keys without scopes should not be recorded")
+	}
+	if err := kdb.SetPermission(ctx, key, httpAPIOperation, ScopeKnownHostsRead, "allow"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := g.signatureAuth(req.Clone(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := g.signatureAuth(req.Clone(ctx)); err == nil {
+		t.Fatal("Replayed request should be rejected")
+	}
+}
@@ -0,0 +1,247 @@
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// tokenCache keeps successful token validations for up to ttl, so
+	// bcrypt only runs once per token and ttl. Entries are keyed by a
+	// HMAC of the token, the plaintext is never kept in memory.
+	tokenCache struct {
+		key  []byte
+		ttl  time.Duration
+		size int
+
+		sync.Mutex
+		entries map[[sha256.Size]byte]*cachedToken
+		// generation changes on every invalidation, validations which
+		// started before it are not cached
+		generation int64
+
+		hits          atomic.Int64
+		misses        atomic.Int64
+		evictions     atomic.Int64
+		invalidations atomic.Int64
+	}
+
+	cachedToken struct {
+		TokenAuth
+		lastUsed   time.Time
+		validUntil time.Time
+		// written is when the last use was stored, pending counts the uses since then
+		written time.Time
+		pending int64
+	}
+
+	// TokenCacheStats reports how effective the token validation cache is
+	TokenCacheStats struct {
+		Enabled       bool    `json:"enabled"`
+		Size          int     `json:"size"`
+		MaxSize       int     `json:"maxSize"`
+		Hits          int64   `json:"hits"`
+		Misses        int64   `json:"misses"`
+		Evictions     int64   `json:"evictions"`
+		Invalidations int64   `json:"invalidations"`
+		HitRate       float64 `json:"hitRate"`
+	}
+)
+
+const (
+	defaultTokenCacheTTL  = time.Minute
+	defaultTokenCacheSize = 1024
+
+	// tokenTouchInterval is how often cache hits store the last use of a token
+	tokenTouchInterval = time.Minute
+)
+
+func newTokenCache(ttl time.Duration, size int) *tokenCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &tokenCache{
+		key:     key,
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*cachedToken),
+	}
+}
+
+func (c *tokenCache) hash(plaintext []byte) [sha256.Size]byte {
+	var ret [sha256.Size]byte
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(plaintext)
+	mac.Sum(ret[:0])
+	return ret
+}
+
+// get returns a copy of the entry for plaintext, a nil cache never has entries.
+// On misses, the current generation should be passed to put.
+func (c *tokenCache) get(plaintext []byte) (cachedToken, int64, bool) {
+	if c == nil {
+		return cachedToken{}, 0, false
+	}
+	h := c.hash(plaintext)
+	c.Lock()
+	defer c.Unlock()
+	entry, found := c.entries[h]
+	if found && time.Now().Before(entry.validUntil) {
+		c.hits.Add(1)
+		return *entry, c.generation, true
+	} else if found {
+		delete(c.entries, h)
+	}
+	c.misses.Add(1)
+	return cachedToken{}, c.generation, false
+}
+
+// put caches entry unless the cache was invalidated after generation
+func (c *tokenCache) put(plaintext []byte, entry cachedToken, expiresAt time.Time, generation int64) {
+	if c == nil {
+		return
+	}
+	entry.validUntil = time.Now().Add(c.ttl)
+	if !expiresAt.IsZero() && expiresAt.Before(entry.validUntil) {
+		entry.validUntil = expiresAt
+	}
+	h := c.hash(plaintext)
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if _, found := c.entries[h]; !found && len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.entries[h] = &entry
+}
+
+// touch updates the last use of the entry for plaintext and returns how many uses should
+// be stored, zero if the last use was stored less than interval ago. Uses of entries
+// which are no longer cached are always stored.
+func (c *tokenCache) touch(plaintext []byte, now time.Time, interval time.Duration) int64 {
+	if c == nil {
+		return 1
+	}
+	h := c.hash(plaintext)
+	c.Lock()
+	defer c.Unlock()
+	entry, found := c.entries[h]
+	if !found {
+		return 1
+	}
+	entry.lastUsed = now
+	entry.pending++
+	if now.Sub(entry.written) < interval {
+		return 0
+	}
+	uses := entry.pending
+	entry.written, entry.pending = now, 0
+	return uses
+}
+
+// touchInterval returns how often the last use of cached tokens is stored, often
+// enough for tokens in use to never look idle for maxIdle
+func touchInterval(maxIdle time.Duration) time.Duration {
+	if maxIdle > 0 && maxIdle/10 < tokenTouchInterval {
+		return maxIdle / 10
+	}
+	return tokenTouchInterval
+}
+
+// evict removes expired entries, or the one closer to expire if none expired yet.
+// Must be called with the lock held.
+func (c *tokenCache) evict() {
+	now := time.Now()
+	var oldest *[sha256.Size]byte
+	var oldestUntil time.Time
+	for h, e := range c.entries {
+		if !now.Before(e.validUntil) {
+			delete(c.entries, h)
+			c.evictions.Add(1)
+			continue
+		}
+		if oldest == nil || e.validUntil.Before(oldestUntil) {
+			h := h
+			oldest, oldestUntil = &h, e.validUntil
+		}
+	}
+	if len(c.entries) >= c.size && oldest != nil {
+		delete(c.entries, *oldest)
+		c.evictions.Add(1)
+	}
+}
+
+// invalidate removes the entries of the token with the given id
+func (c *tokenCache) invalidate(id string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	for h, e := range c.entries {
+		if e.ID == id {
+			delete(c.entries, h)
+			c.invalidations.Add(1)
+		}
+	}
+}
+
+// clear removes every entry
+func (c *tokenCache) clear() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	c.invalidations.Add(int64(len(c.entries)))
+	clear(c.entries)
+}
+
+func (c *tokenCache) stats() TokenCacheStats {
+	if c == nil {
+		return TokenCacheStats{}
+	}
+	c.Lock()
+	size := len(c.entries)
+	c.Unlock()
+	ret := TokenCacheStats{
+		Enabled:       true,
+		Size:          size,
+		MaxSize:       c.size,
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+	if total := ret.Hits + ret.Misses; total > 0 {
+		ret.HitRate = float64(ret.Hits) / float64(total)
+	}
+	return ret
+}
+
+// SetCache configures the cache of successful validations used by Check,
+// a zero (or negative) ttl or size disables it. Changing the settings drops cached entries.
+func (t *TokenDB) SetCache(ttl time.Duration, size int) {
+	if ttl <= 0 || size <= 0 {
+		t.cache.Store(nil)
+		return
+	}
+	if c := t.cache.Load(); c != nil && c.ttl == ttl && c.size == size {
+		return
+	}
+	t.cache.Store(newTokenCache(ttl, size))
+}
+
+// CacheStats returns the metrics of the validation cache
+func (t *TokenDB) CacheStats() TokenCacheStats {
+	return t.cache.Load().stats()
+}
@@ -0,0 +1,123 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/store"
+)
+
+func TestTokenCacheTTL(t *testing.T) {
+	c := newTokenCache(time.Millisecond*20, 10)
+	_, gen, _ := c.get([]byte("a"))
+	c.put([]byte("a"), cachedToken{TokenAuth: TokenAuth{ID: "a"}}, time.Time{}, gen)
+	// tokens which expire before the ttl are only cached until then
+	c.put([]byte("b"), cachedToken{TokenAuth: TokenAuth{ID: "b"}}, time.Now().Add(time.Millisecond), gen)
+	if entry, _, ok := c.get([]byte("a")); !ok || entry.ID != "a" {
+		t.Fatalf("Entry should be cached, got %v", entry.ID)
+	}
+	time.Sleep(time.Millisecond * 5)
+	if _, _, ok := c.get([]byte("b")); ok {
+		t.Fatal("Entry should expire with its token")
+	}
+	time.Sleep(time.Millisecond * 20)
+	if _, _, ok := c.get([]byte("a")); ok {
+		t.Fatal("Entry should expire after the ttl")
+	}
+}
+
+func TestTokenCacheEviction(t *testing.T) {
+	c := newTokenCache(time.Minute, 2)
+	for _, k := range []string{"a", "b", "c"} {
+		_, gen, _ := c.get([]byte(k))
+		c.put([]byte(k), cachedToken{TokenAuth: TokenAuth{ID: k}}, time.Time{}, gen)
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, ok := c.get([]byte("a")); ok {
+		t.Fatal("Entry closer to expire should have been evicted")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, _, ok := c.get([]byte(k)); !ok {
+			t.Fatalf("Entry %v should be cached", k)
+		}
+	}
+	if stats := c.stats(); stats.Size != 2 || stats.Evictions != 1 {
+		t.Fatalf("Unexpected stats: %#v", stats)
+	}
+}
+
+func TestTokenCacheGeneration(t *testing.T) {
+	c := newTokenCache(time.Minute, 10)
+	_, gen, _ := c.get([]byte("a"))
+	// a validation which raced with an invalidation must not be cached
+	c.invalidate("other")
+	c.put([]byte("a"), cachedToken{TokenAuth: TokenAuth{ID: "a"}}, time.Time{}, gen)
+	if _, _, ok := c.get([]byte("a")); ok {
+		t.Fatal("Entry from an older generation should not be cached")
+	}
+
+	_, gen, _ = c.get([]byte("a"))
+	c.put([]byte("a"), cachedToken{TokenAuth: TokenAuth{ID: "a"}}, time.Time{}, gen)
+	c.invalidate("a")
+	if _, _, ok := c.get([]byte("a")); ok {
+		t.Fatal("Invalidated entry should not be cached")
+	}
+}
+
+func TestTokenCacheTouch(t *testing.T) {
+	c := newTokenCache(time.Minute, 10)
+	now := time.Now()
+	_, gen, _ := c.get([]byte("a"))
+	c.put([]byte("a"), cachedToken{TokenAuth: TokenAuth{ID: "a"}, lastUsed: now, written: now}, time.Time{}, gen)
+	for i := 1; i <= 3; i++ {
+		if uses := c.touch([]byte("a"), now.Add(time.Duration(i)*time.Second), time.Minute); uses != 0 {
+			t.Fatalf("Use %v should not be stored yet, got %v", i, uses)
+		}
+	}
+	if uses := c.touch([]byte("a"), now.Add(time.Minute), time.Minute); uses != 4 {
+		t.Fatalf("Every pending use should be stored, got %v", uses)
+	}
+	if uses := c.touch([]byte("missing"), now, time.Minute); uses != 1 {
+		t.Fatalf("Uses of entries which are not cached should be stored, got %v", uses)
+	}
+	if interval := touchInterval(time.Minute); interval != time.Second*6 {
+		t.Fatalf("Short idle expiries should store uses more often, got %v", interval)
+	}
+}
+
+func TestTokenDBCache(t *testing.T) {
+	ctx := context.Background()
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb := &TokenDB{Store: *st}
+	tdb.SetCache(time.Minute, 10)
+	token, err := tdb.Issue(ctx, "alice", "ci", time.Hour, ScopeKnownHostsRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := tdb.Check(ctx, token, "127.0.0.1", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := tdb.CacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("Unexpected stats: %#v", stats)
+	}
+	if active, err := tdb.ListActive(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	} else if len(active) != 1 || active[0].UseCount != 1 {
+		t.Fatalf("Cache hits should not store every use, got %#v", active)
+	}
+
+	id, _ := TokenID(token)
+	if err := tdb.Revoke(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tdb.Check(ctx, token, "127.0.0.1", time.Hour); !errors.Is(err, store.ErrInvalidToken) {
+		t.Fatalf("Revoked token should not be served from the cache, got %v", err)
+	}
+}
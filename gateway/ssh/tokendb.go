@@ -3,6 +3,12 @@ package ssh
 import (
 	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/andrebq/vandrare/internal/monads"
@@ -12,71 +18,477 @@ import (
 type (
 	TokenDB struct {
 		Store store.Store
+
+		cache      atomic.Pointer[tokenCache]
+		hashPolicy atomic.Pointer[store.HashPolicy]
 	}
 
 	TokenInfo struct {
 		ID          string
+		Owner       string
 		Description string
 		ExpiresAt   int64
 		Active      bool
+		// Scopes is a space separated list of scopes
+		Scopes string
+
+		IssuedAt   int64
+		LastUsedAt int64
+		LastUsedIP string
+		UseCount   int64
+		HashScheme string
+		BoundKey   string
+	}
+
+	// TokenAuth is what a valid token grants, see TokenDB.Check
+	TokenAuth struct {
+		ID     string
+		Owner  string
+		Scopes []string
+		// BoundKey is the fingerprint of the key which must sign
+		// requests made with the token, empty if unbound
+		BoundKey string
+	}
+
+	// RotatedToken is the replacement issued by TokenDB.Rotate
+	RotatedToken struct {
+		ID          string   `json:"id"`
+		Owner       string   `json:"owner"`
+		Description string   `json:"description"`
+		Scopes      []string `json:"scopes"`
+		ExpiresAt   int64    `json:"expiresAt"`
+		BoundKey    string   `json:"boundKey,omitempty"`
+		Token       string   `json:"token"`
+		// PreviousExpiresAt is zero if the previous token was revoked immediately
+		PreviousID        string `json:"previousId"`
+		PreviousExpiresAt int64  `json:"previousExpiresAt"`
 	}
 )
 
-func (t *TokenDB) Valid(ctx context.Context, token string) (bool, string, error) {
+const (
+	// ScopeKnownHostsRead allows downloading the known_hosts file with every subdomain
+	ScopeKnownHostsRead = "known-hosts:read"
+	// ScopeKeysRegister allows requesting key registrations and checking their status
+	ScopeKeysRegister = "keys:register"
+	// ScopeAdmin allows using the admin API and implies every other scope
+	ScopeAdmin = "admin"
+)
+
+var (
+	tokenScopes = []string{ScopeKnownHostsRead, ScopeKeysRegister, ScopeAdmin}
+)
+
+const (
+	// idleTokensInterval is how often tokens are checked for idle expiry
+	idleTokensInterval = time.Hour
+)
+
+// SetHashPolicy changes how new tokens are hashed, existing tokens with
+// weaker hashes are rehashed the next time they are validated
+func (t *TokenDB) SetHashPolicy(policy store.HashPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	t.hashPolicy.Store(&policy)
+	return nil
+}
+
+func (t *TokenDB) tokens(ops store.Ops) store.TokenOps {
+	tko := ops.Tokens()
+	if policy := t.hashPolicy.Load(); policy != nil {
+		// already validated by SetHashPolicy
+		tko.SetHashPolicy(*policy)
+	}
+	return tko
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required, valid scopes: %v", errInvalidRequest, tokenScopes)
+	}
+	for _, s := range scopes {
+		if !slices.Contains(tokenScopes, s) {
+			return fmt.Errorf("%w: unknown scope %q, valid scopes: %v", errInvalidRequest, s, tokenScopes)
+		}
+	}
+	return nil
+}
+
+// hasScope returns true if scope is in scopes or if scopes contains ScopeAdmin
+func hasScope(scopes []string, scope string) bool {
+	return slices.Contains(scopes, scope) || slices.Contains(scopes, ScopeAdmin)
+}
+
+func decodeToken(token string) ([]byte, error) {
 	plaintext, err := base64.URLEncoding.DecodeString(token)
 	if err != nil {
-		plaintext, err = base64.StdEncoding.DecodeString(token)
-		if err != nil {
-			return false, "", err
+		return base64.StdEncoding.DecodeString(token)
+	}
+	return plaintext, nil
+}
+
+// TokenID returns the public identifier of token, as used by Revoke
+func TokenID(token string) (string, error) {
+	plaintext, err := decodeToken(token)
+	if err != nil {
+		return "", err
+	} else if len(plaintext) < 8 {
+		return "", store.ErrInvalidToken
+	}
+	return base64.RawURLEncoding.EncodeToString(plaintext[:8]), nil
+}
+
+// Check validates token and returns what it grants, the use is recorded
+// with clientIP. Tokens not used in the last maxIdle are expired, zero disables it.
+// Callers must verify the request signature of tokens bound to a key.
+//
+// Successful validations are cached (see SetCache), so bcrypt is skipped on hits
+// and their uses are stored in batches, see touchInterval.
+func (t *TokenDB) Check(ctx context.Context, token, clientIP string, maxIdle time.Duration) (TokenAuth, error) {
+	plaintext, err := decodeToken(token)
+	if err != nil {
+		return TokenAuth{}, err
+	}
+	cache := t.cache.Load()
+	entry, generation, ok := cache.get(plaintext)
+	if ok && (maxIdle <= 0 || time.Since(entry.lastUsed) <= maxIdle) {
+		// hits only write their use every touchInterval, uses of evicted entries may be lost
+		if uses := cache.touch(plaintext, time.Now(), touchInterval(maxIdle)); uses > 0 {
+			if err := t.recordUses(ctx, entry.ID, clientIP, uses); err != nil {
+				return TokenAuth{}, err
+			}
+		}
+		return entry.TokenAuth, nil
+	}
+
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	tko := t.tokens(ops)
+	info, err := tko.Check(ctx, plaintext)
+	if err != nil {
+		return TokenAuth{}, err
+	}
+	lastUsed := monads.Default(info.LastUsedAt, monads.Self(info.IssuedAt))
+	if maxIdle > 0 && time.Since(lastUsed) > maxIdle {
+		slog.Info("Token expired after being idle", "id", info.ID, "owner", info.Owner, "lastUsed", lastUsed)
+		_, err := tko.ExpireIdle(ctx, maxIdle)
+		ops.Fail(err)
+		if err := ops.Commit(); err != nil {
+			slog.Error("Unable to expire idle tokens", "err", err)
 		}
+		cache.invalidate(info.ID)
+		return TokenAuth{}, store.ErrInvalidToken
+	}
+	ops.Fail(tko.Touch(ctx, info.ID, clientIP))
+	if err := ops.Commit(); err != nil {
+		return TokenAuth{}, err
 	}
+	var expiresAt time.Time
+	info.ExpiresAt.Get(&expiresAt)
+	auth := TokenAuth{ID: info.ID, Owner: info.Owner, Scopes: info.Scopes, BoundKey: info.BoundKey}
+	now := time.Now()
+	cache.put(plaintext, cachedToken{TokenAuth: auth, lastUsed: now, written: now}, expiresAt, generation)
+	return auth, nil
+}
+
+func (t *TokenDB) recordUses(ctx context.Context, id, clientIP string, uses int64) error {
 	ops := t.Store.Ops(false)
 	defer ops.Close()
 
-	tko := ops.Tokens()
-	return tko.Valid(ctx, plaintext)
+	ops.Fail(t.tokens(ops).RecordUses(ctx, id, clientIP, uses))
+	return ops.Commit()
 }
 
-func (t *TokenDB) Issue(ctx context.Context, owner, description string, ttl time.Duration) (string, error) {
+// ExpireIdle expires every token not used in the last maxIdle
+func (t *TokenDB) ExpireIdle(ctx context.Context, maxIdle time.Duration) (int64, error) {
 	ops := t.Store.Ops(false)
 	defer ops.Close()
 
-	tko := ops.Tokens()
-	plain, err := tko.Issue(ctx, owner, description, ttl)
+	n, err := t.tokens(ops).ExpireIdle(ctx, maxIdle)
 	ops.Fail(err)
-	ops.Commit()
+	if err := ops.Commit(); err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		t.cache.Load().clear()
+	}
+	return n, nil
+}
+
+// watchIdleTokens periodically expires tokens according to Settings.TokenIdleExpiry
+func (g *Gateway) watchIdleTokens(ctx context.Context) {
+	ticker := time.NewTicker(idleTokensInterval)
+	defer ticker.Stop()
+	for {
+		if maxIdle := g.settings().TokenIdleExpiry; maxIdle > 0 {
+			n, err := g.tdb.ExpireIdle(ctx, maxIdle)
+			if err != nil {
+				slog.Error("Unable to expire idle tokens", "err", err)
+			} else if n > 0 {
+				slog.Info("Idle tokens expired", "count", n, "maxIdle", maxIdle)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *TokenDB) Issue(ctx context.Context, owner, description string, ttl time.Duration, scopes ...string) (string, error) {
+	return t.IssueBound(ctx, owner, description, ttl, "", scopes...)
+}
+
+// IssueBound issues a token bound to the key with the given fingerprint (see Bind),
+// an empty fingerprint issues an unbound token.
+func (t *TokenDB) IssueBound(ctx context.Context, owner, description string, ttl time.Duration, fingerprint string, scopes ...string) (string, error) {
+	if err := validateScopes(scopes); err != nil {
+		return "", err
+	}
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	tko := t.tokens(ops)
+	plain, err := tko.Issue(ctx, owner, description, ttl, scopes...)
+	ops.Fail(err)
+	if err == nil && fingerprint != "" {
+		id, _ := TokenID(base64.URLEncoding.EncodeToString((*plain)[:]))
+		err = tko.Bind(ctx, id, fingerprint)
+		ops.Fail(err)
+	}
+	if cerr := ops.Commit(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return "", err
 	}
 	return base64.URLEncoding.EncodeToString((*plain)[:]), nil
 }
 
+// Bind requires requests made with the token with the given id to be signed by
+// the key with the given fingerprint, an empty fingerprint removes the binding.
+// Callers must check that the key is registered.
+func (t *TokenDB) Bind(ctx context.Context, id, fingerprint string) error {
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	err := t.tokens(ops).Bind(ctx, id, fingerprint)
+	if errors.Is(err, store.ErrInvalidToken) {
+		return fmt.Errorf("%w: token %v not found", errInvalidRequest, id)
+	}
+	ops.Fail(err)
+	err = ops.Commit()
+	t.cache.Load().invalidate(id)
+	return err
+}
+
+// IssueOnce stores token for owner only if marker was never set before,
+// the marker and the token are written in the same transaction.
+func (t *TokenDB) IssueOnce(ctx context.Context, marker string, owner, description string, token *[32]byte, ttl time.Duration, scopes ...string) (bool, error) {
+	if err := validateScopes(scopes); err != nil {
+		return false, err
+	}
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	kv := ops.KV()
+	var issuedAt int64
+	err := store.GetJSON(ctx, &issuedAt, kv, marker)
+	if err == nil {
+		return false, nil
+	} else if !store.IsNotFound(err) {
+		return false, err
+	}
+	ops.Fail(t.tokens(ops).Put(ctx, token, owner, description, ttl, scopes...))
+	ops.Fail(store.PutJSON(ctx, kv, marker, time.Now().UnixMilli()))
+	if err := ops.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Rotate issues a replacement for token with the same owner, description, scopes, lifetime and bound key.
+// The old token expires after overlap, or immediately if overlap is zero, and cannot be rotated again.
+func (t *TokenDB) Rotate(ctx context.Context, token string, overlap time.Duration) (RotatedToken, error) {
+	plaintext, err := decodeToken(token)
+	if err != nil {
+		return RotatedToken{}, err
+	}
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	tko := t.tokens(ops)
+	info, err := tko.Check(ctx, plaintext)
+	if err != nil {
+		return RotatedToken{}, err
+	} else if info.RotatedTo != "" {
+		// the previous token is kept during the overlap so clients can switch, not to mint more tokens
+		return RotatedToken{}, store.ErrTokenRotated
+	}
+	ttl := time.Duration(-1)
+	var expiresAt time.Time
+	if info.ExpiresAt.Get(&expiresAt) {
+		ttl = info.Lifetime
+		if ttl <= 0 {
+			// issued before lifetimes were recorded, the expiry was not shortened by a rotation
+			ttl = expiresAt.Sub(info.IssuedAt)
+		}
+	}
+	plain, err := tko.Issue(ctx, info.Owner, info.Description, ttl, info.Scopes...)
+	ops.Fail(err)
+	ret := RotatedToken{Owner: info.Owner, Description: info.Description, Scopes: info.Scopes, BoundKey: info.BoundKey, PreviousID: info.ID}
+	if err == nil {
+		ret.Token = base64.URLEncoding.EncodeToString((*plain)[:])
+		ret.ID, _ = TokenID(ret.Token)
+		if info.BoundKey != "" {
+			ops.Fail(tko.Bind(ctx, ret.ID, info.BoundKey))
+		}
+		// fails if a concurrent rotation already replaced the token
+		ops.Fail(tko.MarkRotated(ctx, info.ID, ret.ID))
+	}
+	if overlap > 0 {
+		previousExpiresAt := time.Now().Add(overlap)
+		if !expiresAt.IsZero() && expiresAt.Before(previousExpiresAt) {
+			previousExpiresAt = expiresAt
+		}
+		ops.Fail(tko.ExpireAt(ctx, info.ID, previousExpiresAt))
+		ret.PreviousExpiresAt = previousExpiresAt.UnixMilli()
+	} else {
+		ops.Fail(tko.Remove(ctx, info.ID))
+	}
+	err = ops.Commit()
+	// even if the commit failed, the cached entry may no longer match the database
+	t.cache.Load().invalidate(info.ID)
+	if err != nil {
+		return RotatedToken{}, err
+	}
+	if ttl > 0 {
+		ret.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+	}
+	return ret, nil
+}
+
 func (t *TokenDB) ListActive(ctx context.Context, owner string) ([]TokenInfo, error) {
 	ops := t.Store.Ops(false)
 	defer ops.Close()
 
-	tko := ops.Tokens()
+	tko := t.tokens(ops)
 	entries, err := tko.List(ctx, owner, true)
 	if err != nil {
 		return nil, err
 	}
+	return newTokenInfos(entries), nil
+}
+
+// Search lists one page of tokens across owners, see store.TokenFilter
+func (t *TokenDB) Search(ctx context.Context, filter store.TokenFilter) ([]TokenInfo, error) {
+	switch filter.Status {
+	case "", store.TokenActive, store.TokenExpired:
+	default:
+		return nil, fmt.Errorf("%w: invalid status %q, use %v or %v", errInvalidRequest, filter.Status, store.TokenActive, store.TokenExpired)
+	}
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	entries, err := t.tokens(ops).Search(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return newTokenInfos(entries), nil
+}
+
+// Owners returns every owner with at least one token, active or not
+func (t *TokenDB) Owners(ctx context.Context) ([]string, error) {
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	return t.tokens(ops).Owners(ctx)
+}
+
+// RevokeWhere expires every active token matching filter, returns how many were revoked
+func (t *TokenDB) RevokeWhere(ctx context.Context, filter store.TokenFilter) (int64, error) {
+	if filter.Owner == "" && filter.Description == "" && filter.ExpiresAfter.IsZero() {
+		return 0, fmt.Errorf("%w: refusing to revoke every token, use an owner, description or expiry filter", errInvalidRequest)
+	}
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	n, err := t.tokens(ops).RevokeWhere(ctx, filter)
+	ops.Fail(err)
+	if err := ops.Commit(); err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		t.cache.Load().clear()
+	}
+	return n, nil
+}
+
+// Purge deletes tokens which expired more than olderThan ago
+func (t *TokenDB) Purge(ctx context.Context, olderThan time.Duration) (int64, error) {
+	if olderThan < 0 {
+		return 0, fmt.Errorf("%w: olderThan cannot be negative", errInvalidRequest)
+	}
+	ops := t.Store.Ops(false)
+	defer ops.Close()
+
+	n, err := t.tokens(ops).Purge(ctx, olderThan)
+	ops.Fail(err)
+	if err := ops.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func newTokenInfos(entries []store.TokenInfo) []TokenInfo {
+	now := time.Now()
 	ret := make([]TokenInfo, len(entries))
 	for i, v := range entries {
+		var expiresAt time.Time
 		ret[i] = TokenInfo{
 			ID:          v.ID,
+			Owner:       v.Owner,
 			Description: v.Description,
-			ExpiresAt:   monads.Default[time.Time](v.ExpiresAt, monads.Self(time.Time{})).UnixMilli(),
-			Active:      true,
+			ExpiresAt:   expiresAtMillis(v.ExpiresAt),
+			Active:      !v.ExpiresAt.Get(&expiresAt) || expiresAt.After(now),
+			Scopes:      strings.Join(v.Scopes, " "),
+			IssuedAt:    unixMillis(v.IssuedAt),
+			LastUsedAt:  expiresAtMillis(v.LastUsedAt),
+			LastUsedIP:  v.LastUsedIP,
+			UseCount:    v.UseCount,
+			HashScheme:  v.HashScheme,
+			BoundKey:    v.BoundKey,
 		}
 	}
-	return ret, nil
+	return ret
+}
+
+// unixMillis returns 0 for the zero time
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// expiresAtMillis returns 0 for tokens that never expire (or were never used)
+func expiresAtMillis(expiresAt monads.Maybe[time.Time]) int64 {
+	var t time.Time
+	if !expiresAt.Get(&t) {
+		return 0
+	}
+	return t.UnixMilli()
 }
 
 func (t *TokenDB) Revoke(ctx context.Context, id string) error {
 	ops := t.Store.Ops(false)
 	defer ops.Close()
 
-	tko := ops.Tokens()
+	tko := t.tokens(ops)
 	ops.Fail(tko.Remove(ctx, id))
-	return ops.Commit()
+	err := ops.Commit()
+	t.cache.Load().invalidate(id)
+	return err
 }
@@ -0,0 +1,69 @@
+package ssh_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/gateway/ssh"
+	"github.com/andrebq/vandrare/internal/store"
+)
+
+func TestRotateTwice(t *testing.T) {
+	ctx := context.Background()
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb := &ssh.TokenDB{Store: *st}
+	token, err := tdb.Issue(ctx, "alice", "ci", time.Hour, ssh.ScopeKnownHostsRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := tdb.Rotate(ctx, token, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tdb.Rotate(ctx, token, time.Minute); !errors.Is(err, store.ErrTokenRotated) {
+		t.Fatalf("Rotating the previous token again should fail with %v, got %v", store.ErrTokenRotated, err)
+	}
+	if _, err := tdb.Check(ctx, token, "127.0.0.1", 0); err != nil {
+		t.Fatalf("Previous token should be valid during the overlap, got %v", err)
+	}
+	if _, err := tdb.Rotate(ctx, first.Token, 0); err != nil {
+		t.Fatalf("The replacement should be rotated normally, got %v", err)
+	}
+}
+
+func TestRotateKeepsLifetime(t *testing.T) {
+	ctx := context.Background()
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tdb := &ssh.TokenDB{Store: *st}
+	token, err := tdb.Issue(ctx, "alice", "ci", time.Hour, ssh.ScopeKnownHostsRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := ssh.TokenID(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shorten the expiry, as a previous overlap or an idle expiry would
+	ops := st.Ops(false)
+	ops.Fail(ops.Tokens().ExpireAt(ctx, id, time.Now().Add(time.Minute)))
+	if err := ops.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	ops.Close()
+
+	rotated, err := tdb.Rotate(ctx, token, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := time.Until(time.UnixMilli(rotated.ExpiresAt)); lifetime < time.Hour-time.Minute {
+		t.Fatalf("Replacement should last about an hour, got %v", lifetime)
+	}
+}
@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/andrebq/vandrare/internal/store"
+)
+
+type (
+	// UserAssets is everything owned by a user
+	UserAssets struct {
+		User          store.User
+		Keys          []KeyEntry
+		Tokens        []TokenInfo
+		Registrations []KeyRegistration
+	}
+)
+
+var (
+	errUserNotFound = errors.New("ssh: user not found")
+)
+
+func userError(err error) error {
+	if store.IsNotFound(err) {
+		return errUserNotFound
+	}
+	return err
+}
+
+// PutUser creates or updates the display name and metadata of a user
+func (d *DynKDB) PutUser(ctx context.Context, user store.User) error {
+	if user.ID == "" {
+		return fmt.Errorf("%w: user id is required", errInvalidRequest)
+	}
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	ops.Fail(ops.Users().Put(ctx, user))
+	return ops.Commit()
+}
+
+func (d *DynKDB) GetUser(ctx context.Context, id string) (store.User, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	user, err := ops.Users().Get(ctx, id)
+	return user, userError(err)
+}
+
+func (d *DynKDB) ListUsers(ctx context.Context) ([]store.User, error) {
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	return ops.Users().List(ctx)
+}
+
+// SetUserStatus changes the status of a user, the keys of suspended users cannot be used.
+// See Gateway.setUserStatus, which also takes care of tokens.
+func (d *DynKDB) SetUserStatus(ctx context.Context, id string, status store.UserStatus) error {
+	if err := status.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	ops.Fail(userError(ops.Users().SetStatus(ctx, id, status)))
+	return ops.Commit()
+}
+
+// SyncUsers creates the owners of keys and registrations stored before users existed
+func (d *DynKDB) SyncUsers(ctx context.Context) error {
+	keys, err := d.ListKeys(ctx)
+	if err != nil {
+		return err
+	}
+	registrations, err := d.ListKeyRegistrations(ctx, "")
+	if err != nil {
+		return err
+	}
+	ops := d.Store.Ops(false)
+	defer ops.Close()
+	users := ops.Users()
+	for _, k := range keys {
+		if k.Config.Owner != "" {
+			ops.Fail(users.Ensure(ctx, k.Config.Owner))
+		}
+	}
+	for _, r := range registrations {
+		if r.Owner != "" {
+			ops.Fail(users.Ensure(ctx, r.Owner))
+		}
+	}
+	return ops.Commit()
+}
+
+// setUserStatus changes the status of a user, suspending a user disables all their keys and tokens
+func (g *Gateway) setUserStatus(ctx context.Context, id string, status store.UserStatus) error {
+	err := g.kdb.SetUserStatus(ctx, id, status)
+	// cached validations do not check the status of the owner
+	g.tdb.cache.Load().clear()
+	slog.Info("User status changed", "user", id, "status", status, "err", err)
+	return err
+}
+
+// userAssets returns the user with the given id and every key, token and registration they own
+func (g *Gateway) userAssets(ctx context.Context, id string) (UserAssets, error) {
+	var ret UserAssets
+	var err error
+	if ret.User, err = g.kdb.GetUser(ctx, id); err != nil {
+		return ret, err
+	}
+	keys, err := g.kdb.ListKeys(ctx)
+	if err != nil {
+		return ret, err
+	}
+	for _, k := range keys {
+		if k.Config.Owner == id {
+			ret.Keys = append(ret.Keys, k)
+		}
+	}
+	registrations, err := g.kdb.ListKeyRegistrations(ctx, "")
+	if err != nil {
+		return ret, err
+	}
+	for _, r := range registrations {
+		if r.Owner == id {
+			ret.Registrations = append(ret.Registrations, r)
+		}
+	}
+	filter := store.TokenFilter{Owner: id, Limit: store.MaxTokenPageSize}
+	for {
+		page, err := g.tdb.Search(ctx, filter)
+		if err != nil {
+			return ret, err
+		}
+		ret.Tokens = append(ret.Tokens, page...)
+		if len(page) < filter.Limit {
+			break
+		}
+		filter.After = page[len(page)-1].ID
+	}
+	return ret, nil
+}
@@ -0,0 +1,133 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/sshsig"
+	"golang.org/x/crypto/ssh"
+)
+
+type (
+	// RotatedToken is returned by the gateway when a token is rotated
+	RotatedToken struct {
+		ID                string   `json:"id"`
+		Owner             string   `json:"owner"`
+		Description       string   `json:"description"`
+		Scopes            []string `json:"scopes"`
+		ExpiresAt         int64    `json:"expiresAt"`
+		BoundKey          string   `json:"boundKey"`
+		Token             Token    `json:"token"`
+		PreviousID        string   `json:"previousId"`
+		PreviousExpiresAt int64    `json:"previousExpiresAt"`
+	}
+)
+
+var (
+	gatewayRotateTokenPath = must(url.Parse("./gateway/tokens/rotate"))
+)
+
+// RotateToken asks the gateway to replace token, which remains valid for at most overlap.
+// A negative overlap uses the maximum allowed by the gateway.
+//
+// Tokens bound to a key require signer to be that key, it is ignored if nil.
+func RotateToken(ctx context.Context, gateway *url.URL, token Token, overlap time.Duration, signer ssh.Signer) (RotatedToken, error) {
+	var body []byte
+	if overlap >= 0 {
+		body = must(json.Marshal(struct {
+			Overlap string `json:"overlap"`
+		}{Overlap: overlap.String()}))
+	}
+	ref := gateway.ResolveReference(gatewayRotateTokenPath)
+	req, err := http.NewRequestWithContext(ctx, "POST", ref.String(), bytes.NewReader(body))
+	if err != nil {
+		return RotatedToken{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	req.Header.Set("Content-Type", "application/json")
+	if signer != nil {
+		if err := sshsig.SignRequest(req, body, signer); err != nil {
+			return RotatedToken{}, err
+		}
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return RotatedToken{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return RotatedToken{}, fmt.Errorf("unexpected response from vandrare gateway: %v %v", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var rotated RotatedToken
+	if err := json.NewDecoder(res.Body).Decode(&rotated); err != nil {
+		return RotatedToken{}, err
+	}
+	return rotated, nil
+}
+
+// ReadTokenFile returns the token stored in file, surrounding spaces are ignored
+func ReadTokenFile(file string) (Token, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return "", fmt.Errorf("%v does not contain a token", file)
+	}
+	return Token(token), nil
+}
+
+// ReadSignerFile reads an unencrypted private key, used to sign requests made
+// with tokens bound to a key
+func ReadSignerFile(file string) (ssh.Signer, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key from %v (keys with a passphrase are not supported): %w", file, err)
+	}
+	return signer, nil
+}
+
+// WriteTokenFile replaces the content of file with token, readers either
+// see the old or the new token. New files are created with mode 0600.
+func WriteTokenFile(file string, token Token) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := fmt.Fprintln(tmp, token); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
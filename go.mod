@@ -10,6 +10,7 @@ require (
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/urfave/cli/v2 v2.27.1
 	golang.org/x/crypto v0.17.0
+	golang.org/x/term v0.15.0
 	modernc.org/sqlite v1.29.8
 )
 
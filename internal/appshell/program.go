@@ -0,0 +1,63 @@
+package appshell
+
+import (
+	"context"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+)
+
+type (
+	// Program is a compiled script which can be run many times,
+	// even concurrently, with different inputs
+	Program struct {
+		compiled *tengo.Compiled
+		inputs   []string
+	}
+)
+
+// AddStdlib makes the given stdlib modules (eg.: "times", "text") available to scripts
+func (s *Shell) AddStdlib(names ...string) {
+	s.modules.AddMap(stdlib.GetModuleMap(names...))
+}
+
+// Compile compiles code with the same conventions as Eval, inputs are the names of
+// the variables visible to code and maxAllocs limits how many objects a single
+// run can allocate (negative means no limit).
+func (s *Shell) Compile(code string, maxAllocs int64, inputs ...string) (*Program, error) {
+	sc := tengo.NewScript([]byte(wrapCode(code)))
+	sc.EnableFileImport(false)
+	sc.SetImports(s.modules)
+	sc.SetMaxAllocs(maxAllocs)
+	for _, name := range inputs {
+		if err := sc.Add(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	compiled, err := sc.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return &Program{compiled: compiled, inputs: inputs}, nil
+}
+
+// Run executes the program until it returns or ctx is done, inputs which were
+// not declared by Compile are ignored. Returns the output of the program.
+func (p *Program) Run(ctx context.Context, inputs map[string]any) (any, error) {
+	c := p.compiled.Clone()
+	for _, name := range p.inputs {
+		if v, ok := inputs[name]; ok {
+			if err := c.Set(name, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := c.RunContext(ctx); err != nil {
+		return nil, err
+	}
+	output := c.Get("output")
+	if output.IsUndefined() {
+		return nil, nil
+	}
+	return tengo.ToInterface(output.Object()), nil
+}
@@ -70,7 +70,7 @@ func (s *Shell) EvalInteractive(ctx context.Context, stdin io.Reader) error {
 }
 
 func (s *Shell) Eval(ctx context.Context, code string) (any, error) {
-	wrapCode := fmt.Sprintf(`output := (func() { %v })()`, code)
+	wrapCode := wrapCode(code)
 	println(wrapCode)
 	sc := tengo.NewScript([]byte(wrapCode))
 	sc.EnableFileImport(false)
@@ -86,6 +86,11 @@ func (s *Shell) Eval(ctx context.Context, code string) (any, error) {
 	return tengo.ToInterface(output.Object()), nil
 }
 
+// wrapCode allows code to return its output
+func wrapCode(code string) string {
+	return fmt.Sprintf("output := (func() {\n%v\n})()", code)
+}
+
 func (s *Shell) ValidScript(input string) error {
 	fileSet := parser.NewFileSet()
 	srcFile := fileSet.AddFile("(main)", -1, len(input))
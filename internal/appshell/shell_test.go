@@ -2,8 +2,11 @@ package appshell_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/andrebq/vandrare/internal/appshell"
 	"github.com/d5/tengo/v2"
@@ -43,3 +46,31 @@ func TestSimple(t *testing.T) {
 		t.Fatal("msg does not match expected outcome")
 	}
 }
+
+func TestProgram(t *testing.T) {
+	shell := appshell.New(false)
+	shell.AddStdlib("text")
+	prog, err := shell.Compile(`
+		text := import("text")
+		if input.loop {
+			for {}
+		}
+		return text.to_upper(input.name) // comments are fine
+	`, 1000, "input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		output, err := prog.Run(context.Background(), map[string]any{"input": map[string]any{"name": name}, "unknown": 1})
+		if err != nil {
+			t.Fatal(err)
+		} else if output != strings.ToUpper(name) {
+			t.Fatalf("Unexpected output %#v", output)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := prog.Run(ctx, map[string]any{"input": map[string]any{"loop": true}}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run should stop when ctx is done, got %v", err)
+	}
+}
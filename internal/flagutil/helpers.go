@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
@@ -53,3 +54,27 @@ func Bool(dest *bool, longName string, alias []string, envPrefix string, usage s
 		EnvVars:     computeEnvVar(envPrefix, longName),
 	}
 }
+
+func Duration(dest *time.Duration, longName string, alias []string, envPrefix string, usage string, required bool) *cli.DurationFlag {
+	return &cli.DurationFlag{
+		Destination: dest,
+		Value:       *dest,
+		Name:        longName,
+		Aliases:     alias,
+		Usage:       usage,
+		Required:    required,
+		EnvVars:     computeEnvVar(envPrefix, longName),
+	}
+}
+
+func Int(dest *int, longName string, alias []string, envPrefix string, usage string, required bool) *cli.IntFlag {
+	return &cli.IntFlag{
+		Destination: dest,
+		Value:       *dest,
+		Name:        longName,
+		Aliases:     alias,
+		Usage:       usage,
+		Required:    required,
+		EnvVars:     computeEnvVar(envPrefix, longName),
+	}
+}
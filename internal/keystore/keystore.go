@@ -0,0 +1,98 @@
+// Package keystore protects small secrets (eg.: the CA seed) with a passphrase,
+// the key is derived with scrypt and the secret sealed with XChaCha20-Poly1305.
+package keystore
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	formatV1 = "vandrare-keystore-v1"
+	kdf      = "scrypt"
+)
+
+type (
+	// Params controls the cost of the key derivation, see scrypt.Key
+	Params struct {
+		N int `json:"n"`
+		R int `json:"r"`
+		P int `json:"p"`
+	}
+
+	sealed struct {
+		Format string `json:"format"`
+		KDF    string `json:"kdf"`
+		Params Params `json:"params"`
+		Salt   []byte `json:"salt"`
+		Nonce  []byte `json:"nonce"`
+		Data   []byte `json:"data"`
+	}
+)
+
+var (
+	ErrInvalidPassphrase = errors.New("keystore: invalid passphrase or corrupted data")
+	ErrUnknownFormat     = errors.New("keystore: unknown format")
+)
+
+// DefaultParams are the parameters recommended for interactive logins
+func DefaultParams() Params {
+	return Params{N: 1 << 15, R: 8, P: 1}
+}
+
+// Seal encrypts secret with passphrase and returns the encoded keystore
+func Seal(secret, passphrase []byte, params Params) ([]byte, error) {
+	s := sealed{
+		Format: formatV1,
+		KDF:    kdf,
+		Params: params,
+		Salt:   make([]byte, 16),
+		Nonce:  make([]byte, chacha20poly1305.NonceSizeX),
+	}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, err
+	}
+	aead, err := s.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.Data = aead.Seal(nil, s.Nonce, secret, []byte(s.Format))
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// Open decrypts a keystore created by Seal
+func Open(buf, passphrase []byte) ([]byte, error) {
+	var s sealed
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, err)
+	}
+	if s.Format != formatV1 || s.KDF != kdf || len(s.Nonce) != chacha20poly1305.NonceSizeX {
+		return nil, ErrUnknownFormat
+	}
+	aead, err := s.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := aead.Open(nil, s.Nonce, s.Data, []byte(s.Format))
+	if err != nil {
+		return nil, ErrInvalidPassphrase
+	}
+	return secret, nil
+}
+
+func (s *sealed) aead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, s.Salt, s.Params.N, s.Params.R, s.Params.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: unable to derive key: %w", err)
+	}
+	return chacha20poly1305.NewX(key)
+}
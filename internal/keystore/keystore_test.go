@@ -0,0 +1,35 @@
+package keystore_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/andrebq/vandrare/internal/keystore"
+)
+
+func TestSealOpen(t *testing.T) {
+	// cheap parameters to keep the test fast
+	params := keystore.Params{N: 1 << 10, R: 8, P: 1}
+	secret := bytes.Repeat([]byte{42}, 32)
+	buf, err := keystore.Seal(secret, []byte("correct horse"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf, secret) {
+		t.Fatal("Secret should not be visible in the keystore")
+	}
+	out, err := keystore.Open(buf, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, secret) {
+		t.Fatalf("Unexpected secret: %x", out)
+	}
+	if _, err := keystore.Open(buf, []byte("wrong horse")); !errors.Is(err, keystore.ErrInvalidPassphrase) {
+		t.Fatal("Wrong passphrase should be rejected", err)
+	}
+	if _, err := keystore.Open([]byte("not json"), []byte("correct horse")); !errors.Is(err, keystore.ErrUnknownFormat) {
+		t.Fatal("Invalid keystore should be rejected", err)
+	}
+}
@@ -0,0 +1,34 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// ErrNoTerminal is returned when a passphrase is required but there is no terminal to ask for it
+var ErrNoTerminal = errors.New("keystore: no terminal available to read the passphrase")
+
+// ReadPassphrase prints prompt and reads a line from the controlling terminal
+// with echo disabled. Standard input is used when there is no controlling terminal
+// (eg.: on Windows) and it is a terminal.
+func ReadPassphrase(prompt string) ([]byte, error) {
+	fd, out := int(os.Stdin.Fd()), io.Writer(os.Stderr)
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		fd, out = int(tty.Fd()), tty
+	} else if !term.IsTerminal(fd) {
+		return nil, ErrNoTerminal
+	}
+
+	fmt.Fprint(out, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(out)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: unable to read passphrase: %w", err)
+	}
+	return passphrase, nil
+}
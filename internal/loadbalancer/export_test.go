@@ -0,0 +1,6 @@
+package loadbalancer
+
+// SetAfterPick replaces the hook called by Offer once a worker is picked
+func SetAfterPick(fn func()) {
+	afterPick = fn
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/andrebq/vandrare/internal/set"
 )
@@ -11,47 +13,216 @@ import (
 type (
 	LB[T comparable] struct {
 		mutext  sync.RWMutex
-		workers set.RandomSet[chan<- T]
+		workers set.RandomSet[*worker[T]]
+		byChan  map[chan T]*worker[T]
+		opts    Options
+
+		stats struct {
+			offered   atomic.Uint64
+			delivered atomic.Uint64
+			rejected  atomic.Uint64
+			skipped   atomic.Uint64
+			totalWait atomic.Int64
+			maxWait   atomic.Int64
+		}
+	}
+
+	// worker is the queue of a single worker, senders hold mu (read) while
+	// delivering so Remove can wait for deliveries in progress
+	worker[T any] struct {
+		ch   chan T
+		done chan struct{}
+		mu   sync.RWMutex
+	}
+
+	// Options control how work is queued on each worker
+	Options struct {
+		// QueueSize is the number of items that can be pending on each worker,
+		// once the queue is full Offer blocks until the worker catches up
+		QueueSize int
+		// OfferTimeout is the maximum amount of time Offer waits for
+		// a worker to accept an item, zero means wait until ctx is done
+		OfferTimeout time.Duration
+		// SkipBusy makes Offer look for a worker with room in its queue before
+		// blocking on the randomly selected one
+		SkipBusy bool
+	}
+
+	// Stats is a snapshot of the LB counters
+	Stats struct {
+		Offered   uint64
+		Delivered uint64
+		Rejected  uint64
+		Skipped   uint64
+
+		TotalWait time.Duration
+		MaxWait   time.Duration
+
+		// QueueDepth has the number of pending items for each worker
+		QueueDepth []int
 	}
 )
 
 var (
 	errNoWorkers = errors.New("loadbalancer: no worker available")
+
+	// afterPick is called by Offer once a worker is picked, only used by tests
+	afterPick = func() {}
 )
 
+// DefaultOptions used by NewLB
+func DefaultOptions() Options {
+	return Options{
+		QueueSize:    4,
+		OfferTimeout: time.Second * 30,
+		SkipBusy:     true,
+	}
+}
+
 func NewLB[T comparable](parent context.Context, seed int64) *LB[T] {
+	return NewLBWithOptions[T](parent, seed, DefaultOptions())
+}
+
+func NewLBWithOptions[T comparable](parent context.Context, seed int64, opts Options) *LB[T] {
+	if opts.QueueSize < 0 {
+		opts.QueueSize = 0
+	}
 	return &LB[T]{
-		workers: set.Random[chan<- T](seed),
+		workers: set.Random[*worker[T]](seed),
+		byChan:  make(map[chan T]*worker[T]),
+		opts:    opts,
 	}
 }
 
+// Offer sends work to one of the workers, if SkipBusy is set
+// workers with a full queue are skipped as long as there is another worker
+// with room available. Workers removed while Offer waits are replaced
+// by another worker.
 func (lb *LB[T]) Offer(ctx context.Context, work T) error {
-	lb.mutext.Lock()
-	worker, found := lb.workers.Pick()
-	lb.mutext.Unlock()
-	if !found {
-		return errNoWorkers
+	start := time.Now()
+	lb.stats.offered.Add(1)
+	if lb.opts.OfferTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lb.opts.OfferTimeout)
+		defer cancel()
+	}
+
+	for {
+		lb.mutext.Lock()
+		picked, found := lb.workers.Pick()
+		var candidates []*worker[T]
+		if found && lb.opts.SkipBusy {
+			candidates = make([]*worker[T], 0, lb.workers.Len())
+			candidates = append(candidates, picked)
+			lb.workers.Each(func(other *worker[T]) bool {
+				if other != picked {
+					candidates = append(candidates, other)
+				}
+				return true
+			})
+		}
+		lb.mutext.Unlock()
+		if !found {
+			lb.stats.rejected.Add(1)
+			return errNoWorkers
+		}
+		afterPick()
+
+		for i, c := range candidates {
+			if c.trySend(work) {
+				lb.stats.skipped.Add(uint64(i))
+				lb.delivered(start)
+				return nil
+			}
+		}
+
+		switch delivered, err := picked.send(ctx, work); {
+		case err != nil:
+			lb.stats.rejected.Add(1)
+			return err
+		case delivered:
+			lb.delivered(start)
+			return nil
+		}
+	}
+}
+
+// trySend delivers work only if the worker has room in its queue
+func (w *worker[T]) trySend(work T) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	select {
+	case w.ch <- work:
+		return true
+	default:
+		return false
+	}
+}
+
+// send waits until work is delivered, the worker is removed (returns false)
+// or ctx is done
+func (w *worker[T]) send(ctx context.Context, work T) (bool, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	select {
+	case <-w.done:
+		return false, nil
+	default:
 	}
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
-	case worker <- work:
-		return nil
+		return false, ctx.Err()
+	case <-w.done:
+		return false, nil
+	case w.ch <- work:
+		return true, nil
+	}
+}
+
+func (lb *LB[T]) delivered(start time.Time) {
+	wait := int64(time.Since(start))
+	lb.stats.delivered.Add(1)
+	lb.stats.totalWait.Add(wait)
+	for {
+		max := lb.stats.maxWait.Load()
+		if wait <= max || lb.stats.maxWait.CompareAndSwap(max, wait) {
+			return
+		}
 	}
 }
 
 func (lb *LB[T]) New() chan T {
-	ch := make(chan T)
+	w := &worker[T]{ch: make(chan T, lb.opts.QueueSize), done: make(chan struct{})}
 	lb.mutext.Lock()
-	lb.workers.Add(ch)
+	lb.workers.Add(w)
+	lb.byChan[w.ch] = w
 	lb.mutext.Unlock()
-	return ch
+	return w.ch
 }
 
-func (lb *LB[T]) Remove(conn chan<- T) {
+// Remove the worker from the balancer, items still pending
+// on its queue are not touched and should be drained by the caller.
+// Once Remove returns no other item is delivered to conn.
+func (lb *LB[T]) Remove(conn chan T) {
 	lb.mutext.Lock()
-	lb.workers.Remove(conn)
+	w, found := lb.byChan[conn]
+	if found {
+		lb.workers.Remove(w)
+		delete(lb.byChan, conn)
+	}
 	lb.mutext.Unlock()
+	if !found {
+		return
+	}
+	// wake up Offers waiting on this worker and wait for deliveries in progress
+	close(w.done)
+	w.mu.Lock()
+	w.mu.Unlock()
 }
 
 func (lb *LB[T]) Empty() bool {
@@ -60,3 +231,23 @@ func (lb *LB[T]) Empty() bool {
 	lb.mutext.Unlock()
 	return sz == 0
 }
+
+// Stats returns a snapshot of the current counters
+func (lb *LB[T]) Stats() Stats {
+	st := Stats{
+		Offered:   lb.stats.offered.Load(),
+		Delivered: lb.stats.delivered.Load(),
+		Rejected:  lb.stats.rejected.Load(),
+		Skipped:   lb.stats.skipped.Load(),
+		TotalWait: time.Duration(lb.stats.totalWait.Load()),
+		MaxWait:   time.Duration(lb.stats.maxWait.Load()),
+	}
+	lb.mutext.RLock()
+	st.QueueDepth = make([]int, 0, lb.workers.Len())
+	lb.workers.Each(func(w *worker[T]) bool {
+		st.QueueDepth = append(st.QueueDepth, len(w.ch))
+		return true
+	})
+	lb.mutext.RUnlock()
+	return st
+}
@@ -0,0 +1,129 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/loadbalancer"
+)
+
+func TestOfferTimeout(t *testing.T) {
+	lb := loadbalancer.NewLBWithOptions[int](context.Background(), 1, loadbalancer.Options{
+		QueueSize:    1,
+		OfferTimeout: time.Millisecond * 10,
+	})
+	if err := lb.Offer(context.Background(), 1); err == nil {
+		t.Fatal("Offer without workers should fail")
+	}
+
+	worker := lb.New()
+	if err := lb.Offer(context.Background(), 1); err != nil {
+		t.Fatal("First offer should fit in the queue", err)
+	}
+	if err := lb.Offer(context.Background(), 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Second offer should have timed out, got %v", err)
+	}
+	if v := <-worker; v != 1 {
+		t.Fatalf("Expecting 1 got %v", v)
+	}
+
+	st := lb.Stats()
+	if st.Offered != 3 || st.Delivered != 1 || st.Rejected != 2 {
+		t.Fatalf("Unexpected stats: %#v", st)
+	}
+}
+
+func TestSkipBusy(t *testing.T) {
+	lb := loadbalancer.NewLBWithOptions[int](context.Background(), 1, loadbalancer.Options{
+		QueueSize:    1,
+		OfferTimeout: time.Millisecond * 10,
+		SkipBusy:     true,
+	})
+	first, second := lb.New(), lb.New()
+	for i := 0; i < 2; i++ {
+		if err := lb.Offer(context.Background(), i); err != nil {
+			t.Fatal("Offer should pick the idle worker", err)
+		}
+	}
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("Work should be spread across workers, got %v and %v", len(first), len(second))
+	}
+	if st := lb.Stats(); len(st.QueueDepth) != 2 || st.QueueDepth[0] != 1 || st.QueueDepth[1] != 1 {
+		t.Fatalf("Unexpected queue depth: %v", st.QueueDepth)
+	}
+}
+
+func TestRemoveAfterPick(t *testing.T) {
+	for _, skipBusy := range []bool{false, true} {
+		lb := loadbalancer.NewLBWithOptions[int](context.Background(), 1, loadbalancer.Options{
+			QueueSize:    1,
+			OfferTimeout: time.Second,
+			SkipBusy:     skipBusy,
+		})
+		worker := lb.New()
+		// the worker goes away between Offer picking it and sending to it
+		loadbalancer.SetAfterPick(func() {
+			loadbalancer.SetAfterPick(func() {})
+			lb.Remove(worker)
+		})
+		if err := lb.Offer(context.Background(), 1); err == nil {
+			t.Fatal("Offer should fail once the only worker is removed")
+		}
+		if len(worker) != 0 {
+			t.Fatal("Nothing should be delivered to a removed worker")
+		}
+	}
+}
+
+func TestRemoveRacingOffer(t *testing.T) {
+	lb := loadbalancer.NewLBWithOptions[int](context.Background(), 1, loadbalancer.Options{
+		QueueSize:    1,
+		OfferTimeout: time.Second * 10,
+		SkipBusy:     true,
+	})
+	for i := 0; i < 200; i++ {
+		worker := lb.New()
+		if i%2 == 0 {
+			// make the next offer block on a full queue
+			if err := lb.Offer(context.Background(), -1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		offered := make(chan error, 1)
+		before := lb.Stats().Offered
+		go func() { offered <- lb.Offer(context.Background(), i) }()
+		if i%2 == 0 {
+			// wait for the offer to block on the full queue
+			for lb.Stats().Offered == before {
+				time.Sleep(time.Microsecond)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		lb.Remove(worker)
+		var drained []int
+		for done := false; !done; {
+			select {
+			case v := <-worker:
+				drained = append(drained, v)
+			default:
+				done = true
+			}
+		}
+		err := <-offered
+		if len(worker) > 0 {
+			t.Fatalf("Item %v was delivered after the queue was drained", i)
+		}
+		delivered := len(drained) > 0 && drained[len(drained)-1] == i
+		switch {
+		case err == nil && !delivered:
+			t.Fatalf("Item %v was delivered after Remove returned", i)
+		case err != nil && delivered:
+			t.Fatalf("Item %v was delivered but Offer failed with %v", i, err)
+		}
+		if !lb.Empty() {
+			t.Fatal("Balancer should not have workers")
+		}
+	}
+}
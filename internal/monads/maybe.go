@@ -26,7 +26,7 @@ func Default[T any](m Maybe[T], fallback func() T) T {
 func Self[T any](v T) func() T { return func() T { return v } }
 
 func Some[T any](val T) Maybe[T] {
-	return Maybe[T]{v: val}
+	return Maybe[T]{v: val, valid: true}
 }
 
 func Nothing[T any]() Maybe[T] {
@@ -0,0 +1,33 @@
+package monads_test
+
+import (
+	"testing"
+
+	"github.com/andrebq/vandrare/internal/monads"
+)
+
+func TestMaybe(t *testing.T) {
+	var out int
+	some := monads.Some(42)
+	if !some.Valid() || !some.Get(&out) || out != 42 {
+		t.Fatalf("Some should hold its value, got %v", out)
+	}
+	if monads.Must(some) != 42 {
+		t.Fatal("Must should return the value of Some")
+	}
+	if monads.Default(some, monads.Self(1)) != 42 {
+		t.Fatal("Default should ignore the fallback of Some")
+	}
+
+	out = 0
+	nothing := monads.Nothing[int]()
+	if nothing.Valid() || nothing.Get(&out) || out != 0 {
+		t.Fatalf("Nothing should not hold a value, got %v", out)
+	}
+	if monads.Default(nothing, monads.Self(1)) != 1 {
+		t.Fatal("Default should use the fallback of Nothing")
+	}
+	if zero := monads.Some(0); !zero.Valid() {
+		t.Fatal("Some with the zero value should still be valid")
+	}
+}
@@ -0,0 +1,104 @@
+// Package pipe copies data between two connections in both directions,
+// propagating half-close so protocols that signal end of input via EOF
+// keep working.
+package pipe
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+type (
+	// Conn is the minimum interface required from each side of a pipe,
+	// if it also implements CloseWriter half-close is propagated,
+	// otherwise the side is closed once its input is exhausted
+	Conn interface {
+		io.ReadWriteCloser
+	}
+
+	// CloseWriter is implemented by *net.TCPConn, *net.UnixConn and ssh.Channel
+	CloseWriter interface {
+		CloseWrite() error
+	}
+
+	// Stats has the outcome of each direction of a pipe
+	Stats struct {
+		// Upstream has the bytes copied from a to b
+		Upstream Direction
+		// Downstream has the bytes copied from b to a
+		Downstream Direction
+	}
+
+	Direction struct {
+		Bytes int64
+		// Reason why the direction was closed, nil means a clean EOF
+		Reason error
+	}
+)
+
+const (
+	bufferSize = 32 * 1024
+)
+
+var (
+	buffers = sync.Pool{
+		New: func() any {
+			buf := make([]byte, bufferSize)
+			return &buf
+		},
+	}
+)
+
+// Run copies a->b and b->a until both directions are done, when
+// one direction reaches EOF the write side of the other connection is
+// closed but data can still flow in the opposite direction.
+//
+// Both connections are closed once Run returns.
+func Run(a, b Conn) Stats {
+	var st Stats
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		st.Upstream = halfCopy(b, a)
+	}()
+	go func() {
+		defer wg.Done()
+		st.Downstream = halfCopy(a, b)
+	}()
+	wg.Wait()
+	a.Close()
+	b.Close()
+	return st
+}
+
+func halfCopy(to, from Conn) Direction {
+	bufp := buffers.Get().(*[]byte)
+	defer buffers.Put(bufp)
+	n, err := io.CopyBuffer(onlyWriter{to}, onlyReader{from}, *bufp)
+	d := Direction{Bytes: n, Reason: err}
+	if cw, ok := to.(CloseWriter); ok {
+		if cerr := cw.CloseWrite(); cerr != nil && d.Reason == nil && !errors.Is(cerr, io.EOF) {
+			d.Reason = cerr
+		}
+	} else {
+		// without half-close support, the only way to signal EOF is
+		// closing the connection entirely
+		to.Close()
+	}
+	if d.Reason != nil {
+		// reading failed, so there is no point in keeping the other
+		// direction alive
+		from.Close()
+		to.Close()
+	}
+	return d
+}
+
+// onlyReader and onlyWriter hide ReadFrom/WriteTo so io.CopyBuffer
+// actually uses the pooled buffer
+type (
+	onlyReader struct{ io.Reader }
+	onlyWriter struct{ io.Writer }
+)
@@ -0,0 +1,62 @@
+package pipe_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/andrebq/vandrare/internal/pipe"
+)
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed.(*net.TCPConn), (<-accepted).(*net.TCPConn)
+}
+
+func TestHalfClose(t *testing.T) {
+	client, gatewayIn := tcpPair(t)
+	gatewayOut, backend := tcpPair(t)
+
+	done := make(chan pipe.Stats, 1)
+	go func() { done <- pipe.Run(gatewayIn, gatewayOut) }()
+
+	go func() {
+		// backend behaves like `cat > file && echo ok`,
+		// it only answers after reading everything
+		buf, _ := io.ReadAll(backend)
+		backend.Write([]byte("got " + string(buf)))
+		backend.Close()
+	}()
+
+	client.Write([]byte("hello"))
+	client.CloseWrite()
+	answer, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if string(answer) != "got hello" {
+		t.Fatalf("Unexpected answer: %q", answer)
+	}
+
+	st := <-done
+	if st.Upstream.Bytes != 5 || st.Downstream.Bytes != int64(len(answer)) {
+		t.Fatalf("Unexpected byte counts: %#v", st)
+	}
+	if st.Upstream.Reason != nil || st.Downstream.Reason != nil {
+		t.Fatalf("Both directions should end with EOF: %#v", st)
+	}
+}
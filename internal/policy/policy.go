@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	// Effect of a rule, see Allow and Deny
+	Effect string
+
+	// Rule allows or denies operations on resources, both operation and resource
+	// can be glob patterns (see Glob)
+	Rule struct {
+		Operation string
+		Resource  string
+		Effect    Effect
+		// Source describes where the rule came from, eg.: the key or a group
+		Source string
+	}
+
+	// Matcher returns true if resource is covered by pattern
+	Matcher func(pattern, resource string) bool
+
+	// Decision is the outcome of Evaluate, Rule is the rule which decided it
+	// and is nil if no rule matched.
+	Decision struct {
+		Allowed bool
+		Rule    *Rule
+		Reason  string
+	}
+)
+
+const (
+	Allow = Effect("allow")
+	Deny  = Effect("deny")
+)
+
+// ParseEffect returns the effect named by s, case is ignored
+func ParseEffect(s string) (Effect, error) {
+	switch e := Effect(strings.ToLower(s)); e {
+	case Allow, Deny:
+		return e, nil
+	}
+	return "", fmt.Errorf("policy: invalid effect %q, use %v or %v", s, Allow, Deny)
+}
+
+// Evaluate decides if operation on resource is allowed by rules, nothing is allowed
+// unless a rule allows it and any matching deny wins over matching allows.
+// Resources are matched with match, or Glob if match is nil.
+func Evaluate(rules []Rule, operation, resource string, match Matcher) Decision {
+	if match == nil {
+		match = Glob
+	}
+	var allowed *Rule
+	for i := range rules {
+		r := &rules[i]
+		if r.Operation == "" || !Glob(r.Operation, operation) || !match(r.Resource, resource) {
+			continue
+		}
+		switch r.Effect {
+		case Deny:
+			return Decision{Rule: r, Reason: fmt.Sprintf("denied by %v", r)}
+		case Allow:
+			if allowed == nil {
+				allowed = r
+			}
+		}
+	}
+	if allowed == nil {
+		return Decision{Reason: fmt.Sprintf("no rule allows %v on %v", operation, resource)}
+	}
+	return Decision{Allowed: true, Rule: allowed, Reason: fmt.Sprintf("allowed by %v", allowed)}
+}
+
+func (r Rule) String() string {
+	if r.Source == "" {
+		return fmt.Sprintf("%v %v %v", r.Effect, r.Operation, r.Resource)
+	}
+	return fmt.Sprintf("%v %v %v (%v)", r.Effect, r.Operation, r.Resource, r.Source)
+}
+
+// IsGlob returns true if pattern contains wildcards
+func IsGlob(pattern string) bool {
+	return strings.Contains(pattern, "*")
+}
+
+// Glob returns true if s matches pattern, where '*' matches any sequence
+// of characters (including none) and everything else must match exactly.
+func Glob(pattern, s string) bool {
+	head, rest, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, head) {
+		return false
+	}
+	s = s[len(head):]
+	for {
+		var part string
+		part, rest, wildcard = strings.Cut(rest, "*")
+		if !wildcard {
+			// last part is anchored at the end
+			return len(s) >= len(part) && strings.HasSuffix(s, part)
+		}
+		idx := strings.Index(s, part)
+		if idx < 0 {
+			return false
+		}
+		s = s[idx+len(part):]
+	}
+}
@@ -0,0 +1,62 @@
+package policy_test
+
+import (
+	"testing"
+
+	"github.com/andrebq/vandrare/internal/policy"
+)
+
+func TestGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern, input string
+		match          bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"abc", "abc", true},
+		{"abc", "abcd", false},
+		{"*.example.com:22", "db.example.com:22", true},
+		{"*.example.com:22", "example.com:22", false},
+		{"*.example.com:22", "db.example.com:2222", false},
+		{"db.*:*", "db.example.com:22", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXcYb", false},
+		{"a*a", "a", false},
+		{"keys:*", "keys:register", true},
+	} {
+		if got := policy.Glob(c.pattern, c.input); got != c.match {
+			t.Errorf("Glob(%q, %q) should be %v", c.pattern, c.input, c.match)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	rules := []policy.Rule{
+		{Operation: "egress", Resource: "*.example.com:22", Effect: policy.Allow, Source: "key"},
+		{Operation: "*", Resource: "secret.example.com:*", Effect: policy.Deny, Source: "group:ops"},
+		{Operation: "egress", Resource: "*:443", Effect: policy.Allow, Source: "group:web"},
+	}
+	for _, c := range []struct {
+		operation, resource string
+		allowed             bool
+		rule                int
+	}{
+		{"egress", "db.example.com:22", true, 0},
+		{"egress", "secret.example.com:22", false, 1},
+		{"expose-endpoint", "secret.example.com:80", false, 1},
+		{"egress", "other.org:443", true, 2},
+		{"egress", "other.org:80", false, -1},
+		{"http-api", "admin", false, -1},
+	} {
+		d := policy.Evaluate(rules, c.operation, c.resource, nil)
+		if d.Allowed != c.allowed {
+			t.Errorf("%v %v: expected allowed=%v got %v", c.operation, c.resource, c.allowed, d.Reason)
+		}
+		switch {
+		case c.rule < 0 && d.Rule != nil:
+			t.Errorf("%v %v: should be decided by default, got %v", c.operation, c.resource, d.Rule)
+		case c.rule >= 0 && (d.Rule == nil || *d.Rule != rules[c.rule]):
+			t.Errorf("%v %v: should be decided by %v, got %v", c.operation, c.resource, rules[c.rule], d.Rule)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// Listener parses PROXY headers from connections coming from
+	// one of the Trusted networks, connections from other sources are
+	// returned untouched.
+	Listener struct {
+		net.Listener
+		Trusted []*net.IPNet
+		// Timeout is how long to wait for the header, defaults to 5 seconds
+		Timeout time.Duration
+	}
+
+	// Conn reports the addresses announced by the PROXY header,
+	// the header is parsed on the first call to Read, RemoteAddr or LocalAddr.
+	Conn struct {
+		net.Conn
+		timeout time.Duration
+
+		once   sync.Once
+		reader *bufio.Reader
+		src    net.Addr
+		dst    net.Addr
+		err    error
+	}
+)
+
+// ParseCIDRs parses a list of CIDRs (or single IPs) to be used as Listener.Trusted
+func ParseCIDRs(entries []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		if ip := net.ParseIP(e); ip != nil {
+			bits := len(ip) * 8
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+	return &Conn{Conn: conn, timeout: timeout}, nil
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Conn) parse() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.src, c.dst, c.err = ReadHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *Conn) Read(buf []byte) (int, error) {
+	c.parse()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(buf)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.parse()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.parse()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,175 @@
+// Package proxyproto implements the HAProxy PROXY protocol (v1 and v2),
+// used by TCP load balancers to forward the address of the original client.
+//
+// See: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	famUnspec = 0x00
+	famTCP4   = 0x11
+	famTCP6   = 0x21
+)
+
+var (
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrNoHeader      = errors.New("proxyproto: missing header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid header")
+)
+
+// ReadHeader reads a v1 or v2 header from r, src and dst are nil when
+// the header does not carry addresses (v1 UNKNOWN or v2 LOCAL),
+// in which case the caller should use the addresses of the connection itself.
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	peek, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, nil, ErrNoHeader
+	}
+	if string(peek) == v1Prefix {
+		return readV1(r)
+	}
+	peek, err = r.Peek(len(v2Signature))
+	if err != nil || !bytes.Equal(peek, v2Signature) {
+		return nil, nil, ErrNoHeader
+	}
+	return readV2(r)
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, ErrInvalidHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr == nil || err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, ErrInvalidHeader
+	}
+	cmd := hdr[12] & 0x0f
+	fam := hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+	switch {
+	case cmd == cmdLocal:
+		return nil, nil, nil
+	case cmd != cmdProxy:
+		return nil, nil, ErrInvalidHeader
+	}
+	var ipLen int
+	switch fam {
+	case famTCP4:
+		ipLen = net.IPv4len
+	case famTCP6:
+		ipLen = net.IPv6len
+	default:
+		// unsupported families (UDP, unix sockets) are handled as LOCAL
+		return nil, nil, nil
+	}
+	if len(body) < ipLen*2+4 {
+		return nil, nil, ErrInvalidHeader
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[ipLen*2:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:ipLen*2]...)),
+		Port: int(binary.BigEndian.Uint16(body[ipLen*2+2:])),
+	}
+	return src, dst, nil
+}
+
+// HeaderV2 returns a v2 header announcing a connection from src to dst,
+// if either address is not a TCP address a LOCAL header is returned instead.
+func HeaderV2(src, dst net.Addr) []byte {
+	buf := bytes.Buffer{}
+	buf.Write(v2Signature)
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		buf.Write([]byte{0x20 | cmdLocal, famUnspec, 0, 0})
+		return buf.Bytes()
+	}
+	sip, dip := s.IP.To4(), d.IP.To4()
+	fam := byte(famTCP4)
+	if sip == nil || dip == nil {
+		sip, dip = s.IP.To16(), d.IP.To16()
+		fam = famTCP6
+	}
+	buf.Write([]byte{0x20 | cmdProxy, fam})
+	binary.Write(&buf, binary.BigEndian, uint16(len(sip)*2+4))
+	buf.Write(sip)
+	buf.Write(dip)
+	binary.Write(&buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(d.Port))
+	return buf.Bytes()
+}
+
+// WriteV2 writes a v2 header to w, see HeaderV2
+func WriteV2(w io.Writer, src, dst net.Addr) error {
+	_, err := w.Write(HeaderV2(src, dst))
+	if err != nil {
+		return fmt.Errorf("proxyproto: unable to write header: %w", err)
+	}
+	return nil
+}
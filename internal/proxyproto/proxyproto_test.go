@@ -0,0 +1,78 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/andrebq/vandrare/internal/proxyproto"
+)
+
+func TestV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.168.0.1 10.0.0.1 56324 2222\r\nSSH-2.0"))
+	src, dst, err := proxyproto.ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.String() != "192.168.0.1:56324" || dst.String() != "10.0.0.1:2222" {
+		t.Fatal("Unexpected addresses", src, dst)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "SSH-2.0" {
+		t.Fatalf("Header parsing consumed too much: %q", rest)
+	}
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	for _, tc := range []struct{ src, dst string }{
+		{"192.168.0.1:56324", "10.0.0.1:2222"},
+		{"[2001:db8::1]:56324", "[2001:db8::2]:2222"},
+	} {
+		src, _ := net.ResolveTCPAddr("tcp", tc.src)
+		dst, _ := net.ResolveTCPAddr("tcp", tc.dst)
+		buf := append(proxyproto.HeaderV2(src, dst), "SSH-2.0"...)
+		r := bufio.NewReader(bytes.NewReader(buf))
+		gotSrc, gotDst, err := proxyproto.ReadHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotSrc.String() != tc.src || gotDst.String() != tc.dst {
+			t.Fatal("Unexpected addresses", gotSrc, gotDst)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "SSH-2.0" {
+			t.Fatalf("Header parsing consumed too much: %q", rest)
+		}
+	}
+}
+
+func TestListenerTrust(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := proxyproto.ParseCIDRs([]string{"127.0.0.0/8"})
+	l := &proxyproto.Listener{Listener: inner, Trusted: trusted}
+	defer l.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 2222\r\nhello"))
+		c.Close()
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "203.0.113.7:4000" {
+		t.Fatal("Remote address should come from the header", conn.RemoteAddr())
+	}
+	if body, _ := io.ReadAll(conn); string(body) != "hello" {
+		t.Fatalf("Unexpected body: %q", body)
+	}
+}
@@ -7,6 +7,7 @@ import (
 type (
 	rndset[T comparable] struct {
 		items []T
+		index map[T]int
 		rnd   *rand.Rand
 	}
 
@@ -14,6 +15,8 @@ type (
 		Add(T) bool
 		Remove(T) bool
 		Len() int
+		// Each calls fn for every item in the set until fn returns false
+		Each(fn func(T) bool)
 	}
 
 	RandomSet[T comparable] interface {
@@ -24,18 +27,26 @@ type (
 
 func Random[T comparable](seed int64) RandomSet[T] {
 	return &rndset[T]{
-		rnd: rand.New(rand.NewSource(seed)),
+		index: make(map[T]int),
+		rnd:   rand.New(rand.NewSource(seed)),
 	}
 }
 
 func (r *rndset[T]) Len() int { return len(r.items) }
 
-func (r *rndset[T]) Add(item T) bool {
+func (r *rndset[T]) Each(fn func(T) bool) {
 	for _, v := range r.items {
-		if v == item {
-			return false
+		if !fn(v) {
+			return
 		}
 	}
+}
+
+func (r *rndset[T]) Add(item T) bool {
+	if _, found := r.index[item]; found {
+		return false
+	}
+	r.index[item] = len(r.items)
 	r.items = append(r.items, item)
 	return true
 }
@@ -45,20 +56,20 @@ func (r *rndset[T]) Pick() (T, bool) {
 	if len(r.items) == 0 {
 		return zero, false
 	}
-	// TODO: too slow, but works for now
-	r.rnd.Shuffle(len(r.items), func(i, j int) { r.items[i], r.items[j] = r.items[j], r.items[i] })
-	return r.items[0], true
+	return r.items[r.rnd.Intn(len(r.items))], true
 }
 
 func (r *rndset[T]) Remove(item T) bool {
-	for i, v := range r.items {
-		if v == item {
-			var zero T
-			all := r.items
-			r.items = append(r.items[:i], r.items[i+1:]...)
-			all[len(all)-1] = zero
-			return true
-		}
+	idx, found := r.index[item]
+	if !found {
+		return false
 	}
-	return false
+	var zero T
+	last := len(r.items) - 1
+	r.items[idx] = r.items[last]
+	r.index[r.items[idx]] = idx
+	r.items[last] = zero
+	r.items = r.items[:last]
+	delete(r.index, item)
+	return true
 }
@@ -0,0 +1,103 @@
+package set_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/andrebq/vandrare/internal/set"
+)
+
+func TestRandom(t *testing.T) {
+	rs := set.Random[int](1)
+	for i := 0; i < 10; i++ {
+		if !rs.Add(i) {
+			t.Fatal("Add should accept new items", i)
+		}
+	}
+	if rs.Add(5) {
+		t.Fatal("Add should reject duplicates")
+	}
+	for _, v := range []int{0, 9, 5} {
+		if !rs.Remove(v) {
+			t.Fatal("Remove should find", v)
+		}
+	}
+	if rs.Remove(5) || rs.Len() != 7 {
+		t.Fatal("Remove should not find 5 twice", rs.Len())
+	}
+	seen := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		v, ok := rs.Pick()
+		if !ok {
+			t.Fatal("Pick on non-empty set should work")
+		}
+		seen[v]++
+	}
+	for _, v := range []int{0, 9, 5} {
+		if seen[v] != 0 {
+			t.Fatal("Removed item was picked", v)
+		}
+	}
+	if len(seen) != 7 {
+		t.Fatal("Pick should eventually return all items", seen)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	ws := set.Weighted[string](1)
+	ws.SetWeight("heavy", 8)
+	ws.SetWeight("light", 2)
+	ws.Add("gone")
+	ws.Add("single")
+	if !ws.Remove("gone") {
+		t.Fatal("Remove should find gone")
+	}
+	ws.SetWeight("single", 0)
+
+	const rounds = 10000
+	count := map[string]int{}
+	for i := 0; i < rounds; i++ {
+		v, _ := ws.Pick()
+		count[v]++
+	}
+	if len(count) != 2 {
+		t.Fatal("Only heavy and light should be picked", count)
+	}
+	if ratio := float64(count["heavy"]) / rounds; math.Abs(ratio-0.8) > 0.03 {
+		t.Fatal("Heavy should be picked ~80% of the time", ratio)
+	}
+}
+
+func BenchmarkRandomPick(b *testing.B) {
+	rs := set.Random[int](1)
+	for i := 0; i < 1000; i++ {
+		rs.Add(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.Pick()
+	}
+}
+
+func BenchmarkRandomAddRemove(b *testing.B) {
+	rs := set.Random[int](1)
+	for i := 0; i < 1000; i++ {
+		rs.Add(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.Remove(i % 1000)
+		rs.Add(i % 1000)
+	}
+}
+
+func BenchmarkWeightedPick(b *testing.B) {
+	ws := set.Weighted[int](1)
+	for i := 0; i < 1000; i++ {
+		ws.SetWeight(i, int64(i%10+1))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ws.Pick()
+	}
+}
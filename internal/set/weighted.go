@@ -0,0 +1,136 @@
+package set
+
+import (
+	"math/bits"
+	"math/rand"
+)
+
+type (
+	// weightedSet keeps a Fenwick tree over the weights of its items,
+	// which gives O(log n) updates and picks regardless of how skewed
+	// the weights are.
+	weightedSet[T comparable] struct {
+		items   []T
+		weights []int64
+		// tree is 1-indexed, tree[0] is never used
+		tree  []int64
+		index map[T]int
+		rnd   *rand.Rand
+	}
+
+	// WeightedSet picks items with probability proportional to their weight,
+	// items added via Add have weight 1.
+	WeightedSet[T comparable] interface {
+		RandomSet[T]
+		// SetWeight adds item to the set or updates its weight,
+		// a weight less or equal to zero removes the item.
+		SetWeight(item T, weight int64) bool
+		Weight(item T) int64
+	}
+)
+
+func Weighted[T comparable](seed int64) WeightedSet[T] {
+	return &weightedSet[T]{
+		tree:  []int64{0},
+		index: make(map[T]int),
+		rnd:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (w *weightedSet[T]) Len() int { return len(w.items) }
+
+func (w *weightedSet[T]) Each(fn func(T) bool) {
+	for _, v := range w.items {
+		if !fn(v) {
+			return
+		}
+	}
+}
+
+func (w *weightedSet[T]) Add(item T) bool {
+	if _, found := w.index[item]; found {
+		return false
+	}
+	return w.SetWeight(item, 1)
+}
+
+func (w *weightedSet[T]) Weight(item T) int64 {
+	idx, found := w.index[item]
+	if !found {
+		return 0
+	}
+	return w.weights[idx]
+}
+
+func (w *weightedSet[T]) SetWeight(item T, weight int64) bool {
+	if weight <= 0 {
+		return w.Remove(item)
+	}
+	if idx, found := w.index[item]; found {
+		w.update(idx, weight-w.weights[idx])
+		w.weights[idx] = weight
+		return true
+	}
+	w.index[item] = len(w.items)
+	w.items = append(w.items, item)
+	w.weights = append(w.weights, weight)
+	// the new node covers (pos - lowbit(pos), pos]
+	pos := len(w.items)
+	w.tree = append(w.tree, weight+w.prefix(pos-1)-w.prefix(pos-(pos&-pos)))
+	return true
+}
+
+func (w *weightedSet[T]) Remove(item T) bool {
+	idx, found := w.index[item]
+	if !found {
+		return false
+	}
+	last := len(w.items) - 1
+	if idx != last {
+		w.update(idx, w.weights[last]-w.weights[idx])
+		w.items[idx], w.weights[idx] = w.items[last], w.weights[last]
+		w.index[w.items[idx]] = idx
+	}
+	var zero T
+	w.items[last] = zero
+	w.items = w.items[:last]
+	w.weights = w.weights[:last]
+	// no other node covers the last position, so it can simply be dropped
+	w.tree = w.tree[:last+1]
+	delete(w.index, item)
+	return true
+}
+
+func (w *weightedSet[T]) Pick() (T, bool) {
+	var zero T
+	if len(w.items) == 0 {
+		return zero, false
+	}
+	target := w.rnd.Int63n(w.prefix(len(w.items)))
+	// find the smallest position whose prefix sum is larger than target
+	pos := 0
+	for step := 1 << (bits.Len(uint(len(w.items))) - 1); step > 0; step >>= 1 {
+		next := pos + step
+		if next <= len(w.items) && w.tree[next] <= target {
+			pos = next
+			target -= w.tree[next]
+		}
+	}
+	return w.items[pos], true
+}
+
+// update adds delta to the weight at idx (0-indexed)
+func (w *weightedSet[T]) update(idx int, delta int64) {
+	for pos := idx + 1; pos < len(w.tree); pos += pos & -pos {
+		w.tree[pos] += delta
+	}
+}
+
+// prefix returns the sum of the first n weights
+func (w *weightedSet[T]) prefix(n int) int64 {
+	var sum int64
+	for pos := n; pos > 0; pos -= pos & -pos {
+		sum += w.tree[pos]
+	}
+	return sum
+}
@@ -0,0 +1,120 @@
+package sshsig
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// RequestNamespace is the namespace of signatures over requests made with bound tokens
+	RequestNamespace = "vandrare-request"
+	// AuthNamespace is the namespace of signatures used instead of tokens, see AuthorizeRequest
+	AuthNamespace = "vandrare-auth"
+
+	// AuthScheme is used in the Authorization header of requests signed by AuthorizeRequest
+	AuthScheme = "SSHSig"
+
+	TimestampHeader = "X-Vandrare-Timestamp"
+	NonceHeader     = "X-Vandrare-Nonce"
+	SignatureHeader = "X-Vandrare-Signature"
+
+	// MaxNonceSize limits the size of the nonce of a request
+	MaxNonceSize = 64
+)
+
+// RequestMessage returns the data signed for an HTTP request: method, request URI
+// (path and query), unix timestamp in seconds, nonce and the SHA-256 of the body.
+// The nonce is unique per request, so verifiers can reject replays.
+func RequestMessage(method, uri string, timestamp int64, nonce string, body []byte) []byte {
+	return fmt.Appendf(nil, "%v\n%v\n%v\n%v\n%x\n", method, uri, timestamp, nonce, sha256.Sum256(body))
+}
+
+// SignRequest adds the timestamp and signature headers to req, as required
+// for tokens bound to a key. body must be the content sent in req.Body.
+func SignRequest(req *http.Request, body []byte, signer ssh.Signer) error {
+	sig, err := signRequest(req, body, signer, RequestNamespace)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(SignatureHeader, sig)
+	return nil
+}
+
+// AuthorizeRequest adds the timestamp header and an Authorization header with the
+// signature of req, so it can be authenticated without a token. body must be the
+// content sent in req.Body.
+func AuthorizeRequest(req *http.Request, body []byte, signer ssh.Signer) error {
+	sig, err := signRequest(req, body, signer, AuthNamespace)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", AuthScheme+" "+sig)
+	return nil
+}
+
+func signRequest(req *http.Request, body []byte, signer ssh.Signer, namespace string) (string, error) {
+	ts := time.Now().Unix()
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(buf[:])
+	sig, err := Sign(signer, namespace, RequestMessage(req.Method, req.URL.RequestURI(), ts, nonce, body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(NonceHeader, nonce)
+	return base64.StdEncoding.EncodeToString(sig.Marshal()), nil
+}
+
+// VerifyRequest checks the signature headers added by SignRequest, body is the content of req.Body.
+// Timestamps further than maxSkew from now are rejected. The key which signed the request
+// is returned and must be checked by the caller, as well as the nonce (see NonceHeader)
+// which must not be accepted twice from the same key within maxSkew.
+func VerifyRequest(req *http.Request, body []byte, now time.Time, maxSkew time.Duration) (ssh.PublicKey, error) {
+	return verifyRequest(req, req.Header.Get(SignatureHeader), RequestNamespace, body, now, maxSkew)
+}
+
+// VerifyAuthorization is like VerifyRequest for requests signed by AuthorizeRequest
+func VerifyAuthorization(req *http.Request, body []byte, now time.Time, maxSkew time.Duration) (ssh.PublicKey, error) {
+	scheme, sig, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if scheme != AuthScheme {
+		return nil, fmt.Errorf("%w: expecting %v authorization", ErrInvalidSignature, AuthScheme)
+	}
+	return verifyRequest(req, strings.TrimSpace(sig), AuthNamespace, body, now, maxSkew)
+}
+
+func verifyRequest(req *http.Request, encoded, namespace string, body []byte, now time.Time, maxSkew time.Duration) (ssh.PublicKey, error) {
+	ts, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing or invalid %v", ErrInvalidSignature, TimestampHeader)
+	}
+	if skew := now.Sub(time.Unix(ts, 0)).Abs(); skew > maxSkew {
+		return nil, fmt.Errorf("%w: timestamp is %v away from the server clock", ErrInvalidSignature, skew.Truncate(time.Second))
+	}
+	nonce := req.Header.Get(NonceHeader)
+	if nonce == "" || len(nonce) > MaxNonceSize || strings.ContainsAny(nonce, "\r\n") {
+		return nil, fmt.Errorf("%w: missing or invalid %v", ErrInvalidSignature, NonceHeader)
+	}
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(buf) == 0 {
+		return nil, fmt.Errorf("%w: missing or invalid signature", ErrInvalidSignature)
+	}
+	sig, err := Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(sig, namespace, RequestMessage(req.Method, req.URL.RequestURI(), ts, nonce, body)); err != nil {
+		return nil, err
+	}
+	return sig.PublicKey, nil
+}
@@ -0,0 +1,189 @@
+// Package sshsig implements the signature format used by ssh-keygen -Y
+// (see PROTOCOL.sshsig in the OpenSSH sources), so signatures created by
+// this package can be verified with ssh-keygen and vice-versa.
+package sshsig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type (
+	// Signature is a parsed SSHSIG blob
+	Signature struct {
+		PublicKey     ssh.PublicKey
+		Namespace     string
+		HashAlgorithm string
+		Signature     *ssh.Signature
+	}
+
+	signedData struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          string
+	}
+
+	wireSignature struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+)
+
+const (
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+
+	magic      = "SSHSIG"
+	version    = 1
+	pemType    = "SSH SIGNATURE"
+	armorWidth = 70
+)
+
+var (
+	ErrInvalidSignature = errors.New("sshsig: invalid signature")
+)
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("sshsig: unsupported hash algorithm %q", algorithm)
+}
+
+// message returns the data which is actually signed by the key
+func message(namespace, algorithm string, data []byte) ([]byte, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(data)
+	return append([]byte(magic), ssh.Marshal(signedData{
+		Namespace:     namespace,
+		HashAlgorithm: algorithm,
+		Hash:          string(h.Sum(nil)),
+	})...), nil
+}
+
+// Sign signs data using sha512, like ssh-keygen -Y sign -n namespace.
+// RSA keys use rsa-sha2-512 since ssh-rsa (SHA-1) signatures are not accepted by Verify.
+func Sign(signer ssh.Signer, namespace string, data []byte) (*Signature, error) {
+	if namespace == "" {
+		return nil, errors.New("sshsig: namespace is required")
+	}
+	msg, err := message(namespace, HashSHA512, data)
+	if err != nil {
+		return nil, err
+	}
+	var sig *ssh.Signature
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(nil, msg, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = signer.Sign(nil, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		PublicKey:     signer.PublicKey(),
+		Namespace:     namespace,
+		HashAlgorithm: HashSHA512,
+		Signature:     sig,
+	}, nil
+}
+
+// Verify checks that sig is a signature of data, made by sig.PublicKey for the
+// given namespace. Callers must check if sig.PublicKey is the expected key.
+func Verify(sig *Signature, namespace string, data []byte) error {
+	if sig.Namespace != namespace {
+		return fmt.Errorf("%w: expecting namespace %q got %q", ErrInvalidSignature, namespace, sig.Namespace)
+	}
+	if sig.Signature.Format == ssh.KeyAlgoRSA {
+		return fmt.Errorf("%w: ssh-rsa signatures use SHA-1", ErrInvalidSignature)
+	}
+	msg, err := message(sig.Namespace, sig.HashAlgorithm, data)
+	if err != nil {
+		return err
+	}
+	if err := sig.PublicKey.Verify(msg, sig.Signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// Marshal returns the binary form of the signature
+func (s *Signature) Marshal() []byte {
+	return append([]byte(magic), ssh.Marshal(wireSignature{
+		Version:       version,
+		PublicKey:     s.PublicKey.Marshal(),
+		Namespace:     s.Namespace,
+		HashAlgorithm: s.HashAlgorithm,
+		Signature:     ssh.Marshal(s.Signature),
+	})...)
+}
+
+// Armor returns the signature in the format written by ssh-keygen -Y sign
+func (s *Signature) Armor() []byte {
+	encoded := base64.StdEncoding.EncodeToString(s.Marshal())
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-----BEGIN %v-----\n", pemType)
+	for len(encoded) > armorWidth {
+		fmt.Fprintln(&buf, encoded[:armorWidth])
+		encoded = encoded[armorWidth:]
+	}
+	fmt.Fprintln(&buf, encoded)
+	fmt.Fprintf(&buf, "-----END %v-----\n", pemType)
+	return buf.Bytes()
+}
+
+// Parse reads a signature in the binary form, see Marshal
+func Parse(data []byte) (*Signature, error) {
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, fmt.Errorf("%w: missing %v preamble", ErrInvalidSignature, magic)
+	}
+	var wire wireSignature
+	if err := ssh.Unmarshal(data[len(magic):], &wire); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if wire.Version != version {
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrInvalidSignature, wire.Version)
+	}
+	pub, err := ssh.ParsePublicKey(wire.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(wire.Signature, sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return &Signature{
+		PublicKey:     pub,
+		Namespace:     wire.Namespace,
+		HashAlgorithm: wire.HashAlgorithm,
+		Signature:     sig,
+	}, nil
+}
+
+// Unarmor reads a signature in the format written by ssh-keygen -Y sign, see Armor
+func Unarmor(data []byte) (*Signature, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("%w: expecting a %v block", ErrInvalidSignature, pemType)
+	}
+	return Parse(block.Bytes)
+}
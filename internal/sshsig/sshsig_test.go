@@ -0,0 +1,150 @@
+package sshsig_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrebq/vandrare/internal/sshsig"
+	"golang.org/x/crypto/ssh"
+)
+
+// generated with: printf 'hello\n' | ssh-keygen -Y sign -f id_ed25519 -n file
+const keygenSignature = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgjG0zAYvydoheUOtbvGfB86DwGU
+gwLU9vrsGVAO74OfoAAAAEZmlsZQAAAAAAAAAGc2hhNTEyAAAAUwAAAAtzc2gtZWQyNTUx
+OQAAAEAUfru7FHtE5OteUCED5hp0kflwsKfx9gmNg1ZWdoA9zfCZEG1YnUpeoxz7BCHShD
+K3EnAjtOj/i8Q0s9pnljkF
+-----END SSH SIGNATURE-----
+`
+
+func TestVerifyKeygenSignature(t *testing.T) {
+	sig, err := sshsig.Unarmor([]byte(keygenSignature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp := ssh.FingerprintSHA256(sig.PublicKey); fp != "SHA256:6EHGjKg5vx6bPKlgofVf6fUtQWkX/manSH8aSwjuU1I" {
+		t.Fatalf("Unexpected key %v", fp)
+	}
+	if err := sshsig.Verify(sig, "file", []byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sshsig.Verify(sig, "file", []byte("hello")); !errors.Is(err, sshsig.ErrInvalidSignature) {
+		t.Fatalf("Tampered data should be rejected, got %v", err)
+	}
+	if err := sshsig.Verify(sig, "git", []byte("hello\n")); !errors.Is(err, sshsig.ErrInvalidSignature) {
+		t.Fatalf("Other namespaces should be rejected, got %v", err)
+	}
+}
+
+func TestSignRoundTrip(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []any{edKey, rsaKey} {
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("some data")
+		sig, err := sshsig.Sign(signer, "test", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := sshsig.Unarmor(sig.Armor())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed.PublicKey.Marshal(), signer.PublicKey().Marshal()) {
+			t.Fatal("Public key not preserved")
+		}
+		if err := sshsig.Verify(parsed, "test", data); err != nil {
+			t.Fatalf("%v: %v", signer.PublicKey().Type(), err)
+		}
+		parsed, err = sshsig.Parse(sig.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sshsig.Verify(parsed, "test", []byte("other data")); !errors.Is(err, sshsig.ErrInvalidSignature) {
+			t.Fatalf("%v: signature should not match other data, got %v", signer.PublicKey().Type(), err)
+		}
+	}
+}
+
+func TestRequestSignatures(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"hello":"world"}`)
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest("POST", "http://localhost/path?q=1", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	req := newRequest()
+	if err := sshsig.AuthorizeRequest(req, body, signer); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(req.Header.Get("Authorization"), sshsig.AuthScheme+" ") {
+		t.Fatalf("Unexpected authorization header %v", req.Header.Get("Authorization"))
+	}
+	if key, err := sshsig.VerifyAuthorization(req, body, time.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+		t.Fatal("Verify should return the key which signed the request")
+	}
+	if _, err := sshsig.VerifyAuthorization(req, []byte("{}"), time.Now(), time.Minute); !errors.Is(err, sshsig.ErrInvalidSignature) {
+		t.Fatalf("Other bodies should be rejected, got %v", err)
+	}
+	if _, err := sshsig.VerifyAuthorization(req, body, time.Now().Add(time.Hour), time.Minute); !errors.Is(err, sshsig.ErrInvalidSignature) {
+		t.Fatalf("Old signatures should be rejected, got %v", err)
+	}
+	nonce := req.Header.Get(sshsig.NonceHeader)
+	if nonce == "" {
+		t.Fatal("Signed requests should have a nonce")
+	}
+	req.Header.Set(sshsig.NonceHeader, nonce+"x")
+	if _, err := sshsig.VerifyAuthorization(req, body, time.Now(), time.Minute); !errors.Is(err, sshsig.ErrInvalidSignature) {
+		t.Fatalf("Other nonces should be rejected, got %v", err)
+	}
+	req.Header.Del(sshsig.NonceHeader)
+	if _, err := sshsig.VerifyAuthorization(req, body, time.Now(), time.Minute); !errors.Is(err, sshsig.ErrInvalidSignature) {
+		t.Fatalf("Requests without a nonce should be rejected, got %v", err)
+	}
+	req.Header.Set(sshsig.NonceHeader, nonce)
+	req.URL.RawQuery = "q=2"
+	if _, err := sshsig.VerifyAuthorization(req, body, time.Now(), time.Minute); !errors.Is(err, sshsig.ErrInvalidSignature) {
+		t.Fatalf("Other queries should be rejected, got %v", err)
+	}
+
+	req = newRequest()
+	if err := sshsig.SignRequest(req, body, signer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sshsig.VerifyRequest(req, body, time.Now(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// signatures of bound tokens cannot be used as an authorization
+	req.Header.Set("Authorization", sshsig.AuthScheme+" "+req.Header.Get(sshsig.SignatureHeader))
+	if _, err := sshsig.VerifyAuthorization(req, body, time.Now(), time.Minute); !errors.Is(err, sshsig.ErrInvalidSignature) {
+		t.Fatalf("Namespaces should not be interchangeable, got %v", err)
+	}
+}
@@ -10,6 +10,8 @@ type (
 	KVOps interface {
 		SetBytes(context.Context, string, []byte)
 		GetBytes(context.Context, []byte, string) []byte
+		Keys(ctx context.Context, prefix string) []string
+		Delete(ctx context.Context, key string)
 		Err() error
 	}
 
@@ -33,7 +35,7 @@ func (kv *kvops) GetBytes(ctx context.Context, out []byte, key string) []byte {
 		out = append(out, buf...)
 		return out
 	}
-	err := kv.sqler.QueryRowContext(ctx, "select item_val from dt_key_value where item_key = $1", key).Scan(&out)
+	err := kv.sqler.QueryRowContext(ctx, "select item_val from dt_key_value where item_key = $1", key).Scan(&buf)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 	} else if err == nil {
@@ -66,6 +68,43 @@ func (kv *kvops) SetBytes(ctx context.Context, key string, buf []byte) {
 	}
 }
 
+// Delete removes key, deleting a key that does not exist is not an error
+func (kv *kvops) Delete(ctx context.Context, key string) {
+	if kv.err != nil {
+		return
+	}
+	_, kv.err = kv.sqler.ExecContext(ctx, "delete from dt_key_value where item_key = $1", key)
+	if kv.err == nil {
+		delete(kv.cached, key)
+	}
+}
+
+// Keys returns, in order, every key that starts with prefix
+func (kv *kvops) Keys(ctx context.Context, prefix string) []string {
+	if kv.err != nil {
+		return nil
+	}
+	rows, err := kv.sqler.QueryContext(ctx,
+		"select item_key from dt_key_value where substr(item_key, 1, length($1)) = $1 order by item_key", prefix)
+	if err != nil {
+		kv.err = err
+		return nil
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if kv.err = rows.Scan(&key); kv.err != nil {
+			return nil
+		}
+		keys = append(keys, key)
+	}
+	if kv.err = rows.Err(); kv.err != nil {
+		return nil
+	}
+	return keys
+}
+
 func (kv *kvops) Err() error {
 	if kv.err != nil {
 		return kv.err
@@ -39,3 +39,57 @@ func TestBasicKV(t *testing.T) {
 	}
 	ops.Close()
 }
+
+func TestKVKeys(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+	kv := ops.KV()
+	for _, k := range []string{"reg:b", "reg:a", "regular", "other:a"} {
+		kv.SetBytes(context.Background(), k, []byte(k))
+	}
+	keys := kv.Keys(context.Background(), "reg:")
+	if kv.Err() != nil {
+		t.Fatal(kv.Err())
+	}
+	if len(keys) != 2 || keys[0] != "reg:a" || keys[1] != "reg:b" {
+		t.Fatal("Unexpected keys", keys)
+	}
+
+	kv.Delete(context.Background(), "reg:a")
+	if buf := kv.GetBytes(context.Background(), nil, "reg:a"); buf != nil {
+		t.Fatal("Key should have been deleted", string(buf))
+	}
+	if keys := kv.Keys(context.Background(), "reg:"); len(keys) != 1 {
+		t.Fatal("Unexpected keys after delete", keys)
+	}
+}
+
+func TestKVGetBytesAppends(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	ops.KV().SetBytes(context.Background(), "hello", []byte("world"))
+	if err := ops.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	ops.Close()
+
+	// a new transaction reads from the database first and from its cache afterwards
+	ops = st.Ops(true)
+	defer ops.Close()
+	kv := ops.KV()
+	for i := 0; i < 2; i++ {
+		if buf := kv.GetBytes(context.Background(), []byte("hello "), "hello"); string(buf) != "hello world" {
+			t.Fatalf("Read %v: value should be appended to out, got %q", i, buf)
+		}
+	}
+	if buf := kv.GetBytes(context.Background(), []byte("hello "), "missing"); buf != nil {
+		t.Fatalf("Missing keys should return nil, got %q", buf)
+	}
+}
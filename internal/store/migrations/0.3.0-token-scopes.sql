@@ -0,0 +1,33 @@
+alter table dt_token_set add column scopes text not null default '';
+
+-- tokens issued before scopes existed keep the endpoints every token could call,
+-- only the initial admin token becomes admin. Any token could be issued to the admin
+-- owner, so the initial one is found by the gateway:admin-token marker, written in the
+-- same transaction (and therefore with the same clock) as the token.
+update dt_token_set set scopes = 'known-hosts:read keys:register';
+update dt_token_set set scopes = 'admin'
+where user = 'admin' and exists (
+    select 1 from dt_key_value kv
+    where kv.item_key = 'gateway:admin-token'
+        and kv.clk_updated_at_unixms = dt_token_set.clk_updated_at_unixms
+        and kv.clk_trid = dt_token_set.clk_trid
+);
+
+drop view vw_token_set;
+create view vw_token_set as
+    select
+        token_id,
+        salted_token,
+        user,
+        description,
+        expires_at_unixms,
+        scopes,
+
+        case
+        when (expires_at_unixms is null or expires_at_unixms > unixepoch('subsec')) then true
+        else false
+        end as is_active,
+
+        clk_updated_at_unixms,
+        clk_trid integer
+    from dt_token_set
@@ -0,0 +1,34 @@
+-- tokens used to store the transaction clock as text instead of unix millis
+update dt_token_set
+    set clk_updated_at_unixms = coalesce(unixepoch(substr(clk_updated_at_unixms, 1, 19)), unixepoch()) * 1000
+    where typeof(clk_updated_at_unixms) = 'text';
+
+alter table dt_token_set add column issued_at_unixms integer not null default 0;
+alter table dt_token_set add column last_used_at_unixms integer;
+alter table dt_token_set add column last_used_ip text not null default '';
+alter table dt_token_set add column use_count integer not null default 0;
+
+update dt_token_set set issued_at_unixms = clk_updated_at_unixms;
+
+drop view vw_token_set;
+create view vw_token_set as
+    select
+        token_id,
+        salted_token,
+        user,
+        description,
+        expires_at_unixms,
+        scopes,
+        issued_at_unixms,
+        last_used_at_unixms,
+        last_used_ip,
+        use_count,
+
+        case
+        when (expires_at_unixms is null or expires_at_unixms > unixepoch('subsec') * 1000) then true
+        else false
+        end as is_active,
+
+        clk_updated_at_unixms,
+        clk_trid
+    from dt_token_set
@@ -0,0 +1,29 @@
+alter table dt_token_set add column hash_scheme text not null default '';
+
+-- every token so far was hashed with bcrypt, the cost is part of the hash ($2a$10$...)
+update dt_token_set
+    set hash_scheme = 'bcrypt:cost=' || cast(substr(cast(salted_token as text), 5, 2) as integer);
+
+drop view vw_token_set;
+create view vw_token_set as
+    select
+        token_id,
+        salted_token,
+        user,
+        description,
+        expires_at_unixms,
+        scopes,
+        issued_at_unixms,
+        last_used_at_unixms,
+        last_used_ip,
+        use_count,
+        hash_scheme,
+
+        case
+        when (expires_at_unixms is null or expires_at_unixms > unixepoch('subsec') * 1000) then true
+        else false
+        end as is_active,
+
+        clk_updated_at_unixms,
+        clk_trid
+    from dt_token_set
@@ -0,0 +1,27 @@
+-- fingerprint of the ssh key which must sign requests made with the token, empty if unbound
+alter table dt_token_set add column bound_key text not null default '';
+
+drop view vw_token_set;
+create view vw_token_set as
+    select
+        token_id,
+        salted_token,
+        user,
+        description,
+        expires_at_unixms,
+        scopes,
+        issued_at_unixms,
+        last_used_at_unixms,
+        last_used_ip,
+        use_count,
+        hash_scheme,
+        bound_key,
+
+        case
+        when (expires_at_unixms is null or expires_at_unixms > unixepoch('subsec') * 1000) then true
+        else false
+        end as is_active,
+
+        clk_updated_at_unixms,
+        clk_trid
+    from dt_token_set
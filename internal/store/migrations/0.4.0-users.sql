@@ -0,0 +1,20 @@
+create table dt_users(
+    user_id text not null,
+    display_name text not null default '',
+    -- active or suspended, tokens and keys of suspended users cannot be used
+    status text not null default 'active',
+    -- json object with string values
+    metadata text not null default '{}',
+    created_at_unixms integer not null,
+
+    clk_updated_at_unixms integer not null,
+    clk_trid integer not null,
+
+    primary key(user_id)
+);
+
+-- every token owner becomes a user, owners of keys and registrations are stored
+-- in the kv and are created by the gateway
+insert into dt_users (user_id, created_at_unixms, clk_updated_at_unixms, clk_trid)
+    select distinct user, cast(unixepoch('subsec') * 1000 as integer), cast(unixepoch('subsec') * 1000 as integer), 0
+    from dt_token_set;
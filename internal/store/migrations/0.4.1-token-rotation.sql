@@ -0,0 +1,31 @@
+-- id of the token issued to replace this one by a rotation, empty if never rotated
+alter table dt_token_set add column rotated_to text not null default '';
+-- lifetime the token was issued with, null if the token never expires (or was issued before this column existed)
+alter table dt_token_set add column lifetime_ms integer null;
+
+drop view vw_token_set;
+create view vw_token_set as
+    select
+        token_id,
+        salted_token,
+        user,
+        description,
+        expires_at_unixms,
+        scopes,
+        issued_at_unixms,
+        last_used_at_unixms,
+        last_used_ip,
+        use_count,
+        hash_scheme,
+        bound_key,
+        rotated_to,
+        lifetime_ms,
+
+        case
+        when (expires_at_unixms is null or expires_at_unixms > unixepoch('subsec') * 1000) then true
+        else false
+        end as is_active,
+
+        clk_updated_at_unixms,
+        clk_trid
+    from dt_token_set
@@ -16,6 +16,14 @@ func (o *ops) KV() KVOps {
 
 func (o *ops) Tokens() TokenOps {
 	return &tokenOps{
+		clock:  o.clock,
+		sqler:  o,
+		policy: DefaultHashPolicy(),
+	}
+}
+
+func (o *ops) Users() UserOps {
+	return &userOps{
 		clock: o.clock,
 		sqler: o,
 	}
@@ -41,6 +41,7 @@ type (
 		QueryRowContext(context.Context, string, ...any) *sql.Row
 		KV() KVOps
 		Tokens() TokenOps
+		Users() UserOps
 		Commit() error
 		Rollback() error
 		Close() error
@@ -1,6 +1,9 @@
 package store
 
-import "testing"
+import (
+	"database/sql"
+	"testing"
+)
 
 func TestMigration(t *testing.T) {
 	st, err := OpenMemory()
@@ -11,3 +14,52 @@ func TestMigration(t *testing.T) {
 		t.Fatal("initializing after opening should be a no-op", err)
 	}
 }
+
+func TestMigrateTokenScopes(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// every connection to :memory: opens a new database
+	db.SetMaxOpenConns(1)
+	if err := seedMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.version.Less(version{0, 3, 0}) {
+			if err := applyMigration(db, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, stmt := range []string{
+		`insert into dt_key_value values ('gateway:admin-token', '1000', 1000, 1)`,
+		`insert into dt_token_set values ('initial', x'00', 'admin', 'Initial admin token', null, 1000, 1)`,
+		`insert into dt_token_set values ('later', x'00', 'admin', 'ci', null, 2000, 2)`,
+		`insert into dt_token_set values ('other', x'00', 'alice', 'ci', null, 3000, 3)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[string]string{
+		"initial": "admin",
+		"later":   "known-hosts:read keys:register",
+		"other":   "known-hosts:read keys:register",
+	} {
+		var scopes string
+		if err := db.QueryRow("select scopes from dt_token_set where token_id = ?", id).Scan(&scopes); err != nil {
+			t.Fatal(err)
+		} else if scopes != expected {
+			t.Errorf("Token %v should have scopes %q, got %q", id, expected, scopes)
+		}
+	}
+}
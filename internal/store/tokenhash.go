@@ -0,0 +1,140 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type (
+	// HashPolicy defines how token secrets are hashed, the scheme used by each
+	// token is stored with it, tokens hashed with weaker schemes are rehashed
+	// when they are successfully validated.
+	//
+	// A scheme is weaker if it uses another algorithm or lower parameters,
+	// so changing the algorithm migrates tokens as they are used.
+	HashPolicy struct {
+		// Algorithm is either HashBcrypt or HashArgon2id
+		Algorithm string
+
+		BcryptCost int
+
+		Argon2Time uint32
+		// Argon2Memory in KiB
+		Argon2Memory  uint32
+		Argon2Threads uint8
+	}
+)
+
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+)
+
+// DefaultHashPolicy is used when no other policy is configured
+func DefaultHashPolicy() HashPolicy {
+	return HashPolicy{Algorithm: HashBcrypt, BcryptCost: bcrypt.DefaultCost}
+}
+
+// DefaultArgon2idPolicy uses the parameters recommended by RFC 9106 for memory constrained environments
+func DefaultArgon2idPolicy() HashPolicy {
+	return HashPolicy{Algorithm: HashArgon2id, Argon2Time: 3, Argon2Memory: 64 * 1024, Argon2Threads: 4}
+}
+
+func (p HashPolicy) Validate() error {
+	switch p.Algorithm {
+	case HashBcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost should be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		if p.Argon2Time < 1 || p.Argon2Memory < 8*uint32(p.Argon2Threads) || p.Argon2Threads < 1 {
+			return errors.New("argon2id requires time >= 1, threads >= 1 and memory >= 8*threads KiB")
+		}
+	default:
+		return fmt.Errorf("unknown hash algorithm %q, use %v or %v", p.Algorithm, HashBcrypt, HashArgon2id)
+	}
+	return nil
+}
+
+// String returns the scheme stored alongside each token
+func (p HashPolicy) String() string {
+	switch p.Algorithm {
+	case HashArgon2id:
+		return fmt.Sprintf("%v:t=%v,m=%v,p=%v", p.Algorithm, p.Argon2Time, p.Argon2Memory, p.Argon2Threads)
+	default:
+		return fmt.Sprintf("%v:cost=%v", p.Algorithm, p.BcryptCost)
+	}
+}
+
+func parseHashScheme(scheme string) (HashPolicy, error) {
+	var p HashPolicy
+	var err error
+	switch {
+	case strings.HasPrefix(scheme, HashArgon2id+":"):
+		p.Algorithm = HashArgon2id
+		_, err = fmt.Sscanf(scheme, HashArgon2id+":t=%d,m=%d,p=%d", &p.Argon2Time, &p.Argon2Memory, &p.Argon2Threads)
+	case strings.HasPrefix(scheme, HashBcrypt+":"):
+		p.Algorithm = HashBcrypt
+		_, err = fmt.Sscanf(scheme, HashBcrypt+":cost=%d", &p.BcryptCost)
+	default:
+		err = fmt.Errorf("unknown hash scheme %q", scheme)
+	}
+	if err == nil {
+		err = p.Validate()
+	}
+	return p, err
+}
+
+func (p HashPolicy) hash(secret []byte) ([]byte, error) {
+	switch p.Algorithm {
+	case HashArgon2id:
+		salt := make([]byte, argon2SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		return append(salt, argon2.IDKey(secret, salt, p.Argon2Time, p.Argon2Memory, p.Argon2Threads, argon2KeySize)...), nil
+	case HashBcrypt:
+		return bcrypt.GenerateFromPassword(secret, p.BcryptCost)
+	}
+	return nil, p.Validate()
+}
+
+func (p HashPolicy) verify(hashed, secret []byte) error {
+	switch p.Algorithm {
+	case HashArgon2id:
+		if len(hashed) != argon2SaltSize+argon2KeySize {
+			return ErrInvalidToken
+		}
+		salt, key := hashed[:argon2SaltSize], hashed[argon2SaltSize:]
+		actual := argon2.IDKey(secret, salt, p.Argon2Time, p.Argon2Memory, p.Argon2Threads, argon2KeySize)
+		if subtle.ConstantTimeCompare(key, actual) != 1 {
+			return ErrInvalidToken
+		}
+		return nil
+	case HashBcrypt:
+		return bcrypt.CompareHashAndPassword(hashed, secret)
+	}
+	return p.Validate()
+}
+
+// weakerThan returns true if hashes generated with p should be
+// replaced by hashes generated by policy, see HashPolicy
+func (p HashPolicy) weakerThan(policy HashPolicy) bool {
+	switch {
+	case p.Algorithm != policy.Algorithm:
+		return true
+	case p.Algorithm == HashBcrypt:
+		return p.BcryptCost < policy.BcryptCost
+	default:
+		return p.Argon2Time < policy.Argon2Time || p.Argon2Memory < policy.Argon2Memory
+	}
+}
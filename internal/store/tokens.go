@@ -8,10 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/andrebq/vandrare/internal/monads"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type (
@@ -21,7 +21,8 @@ type (
 	tokenOps struct {
 		sqler Ops
 
-		clock txclock
+		clock  txclock
+		policy HashPolicy
 	}
 
 	TokenInfo struct {
@@ -29,12 +30,67 @@ type (
 		Description string
 		ExpiresAt   monads.Maybe[time.Time]
 		ID          string
+		Scopes      []string
+
+		IssuedAt   time.Time
+		LastUsedAt monads.Maybe[time.Time]
+		LastUsedIP string
+		UseCount   int64
+
+		// HashScheme is the algorithm and parameters used to hash the token
+		HashScheme string
+		// BoundKey is the fingerprint of the ssh key bound to the token, empty if unbound
+		BoundKey string
+		// RotatedTo is the ID of the token which replaced this one, empty if never rotated
+		RotatedTo string
+		// Lifetime is the ttl the token was issued with, zero if unknown or if it never expires
+		Lifetime time.Duration
+	}
+
+	// TokenFilter selects tokens across owners, empty fields match everything
+	TokenFilter struct {
+		Owner       string
+		Description string
+		Status      TokenStatus
+		// ExpiresAfter matches tokens which expire after the given time,
+		// tokens that never expire always match
+		ExpiresAfter time.Time
+
+		// After is the ID of the last token of the previous page
+		After string
+		// Limit of tokens returned by Search, zero means DefaultTokenPageSize
+		Limit int
 	}
 
+	TokenStatus string
+
 	TokenOps interface {
 		Valid(ctx context.Context, plaintext []byte) (bool, string, error)
-		Issue(ctx context.Context, user, description string, ttl time.Duration) (plaintext *[32]byte, err error)
+		Check(ctx context.Context, plaintext []byte) (TokenInfo, error)
+		Touch(ctx context.Context, id, clientIP string) error
+		// RecordUses is Touch for many uses at once, the last of them by clientIP
+		RecordUses(ctx context.Context, id, clientIP string, uses int64) error
+		ExpireIdle(ctx context.Context, idle time.Duration) (int64, error)
+		ExpireAt(ctx context.Context, id string, at time.Time) error
+		// Bind requires requests made with the token to be signed by the key
+		// with the given fingerprint, an empty fingerprint removes the binding
+		Bind(ctx context.Context, id, fingerprint string) error
+		// MarkRotated records that the token with the given id was replaced by successor,
+		// fails with ErrTokenRotated if it was already rotated
+		MarkRotated(ctx context.Context, id, successor string) error
+		// SetHashPolicy changes the policy used by Put/Issue and by Check to rehash weaker tokens
+		SetHashPolicy(policy HashPolicy) error
+		Issue(ctx context.Context, user, description string, ttl time.Duration, scopes ...string) (plaintext *[32]byte, err error)
+		Put(ctx context.Context, plaintext *[32]byte, user, description string, ttl time.Duration, scopes ...string) error
 		List(ctx context.Context, user string, onlyActive bool) ([]TokenInfo, error)
+		// Search returns one page of tokens matching filter ordered by ID
+		Search(ctx context.Context, filter TokenFilter) ([]TokenInfo, error)
+		// Owners returns every owner with at least one token
+		Owners(ctx context.Context) ([]string, error)
+		// RevokeWhere expires every active token matching filter, pagination is ignored
+		RevokeWhere(ctx context.Context, filter TokenFilter) (int64, error)
+		// Purge deletes tokens which expired more than olderThan ago
+		Purge(ctx context.Context, olderThan time.Duration) (int64, error)
 		Remove(ctx context.Context, id string) error
 	}
 
@@ -43,60 +99,257 @@ type (
 
 const (
 	ErrInvalidToken = errMsg("invalid token")
+	ErrTokenRotated = errMsg("token already rotated")
+
+	TokenActive  = TokenStatus("active")
+	TokenExpired = TokenStatus("expired")
+
+	DefaultTokenPageSize = 100
+	MaxTokenPageSize     = 1000
 )
 
 func (e errMsg) Error() string { return string(e) }
 
+// Valid checks the token and records its use (see Touch)
 func (t *tokenOps) Valid(ctx context.Context, plaintext []byte) (bool, string, error) {
+	info, err := t.Check(ctx, plaintext)
+	if err != nil {
+		return false, "", err
+	}
+	if err := t.Touch(ctx, info.ID, ""); err != nil {
+		return false, "", err
+	}
+	return true, info.Owner, nil
+}
+
+func (t *tokenOps) SetHashPolicy(policy HashPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	t.policy = policy
+	return nil
+}
+
+// Check validates the token and returns its information, including the scopes
+// it was issued with. Tokens of suspended users are not valid. Usage is not recorded, see Touch.
+//
+// Tokens hashed with a scheme weaker than the current policy are rehashed.
+func (t *tokenOps) Check(ctx context.Context, plaintext []byte) (TokenInfo, error) {
 	if len(plaintext) != 32 {
-		return false, "", ErrInvalidToken
+		return TokenInfo{}, ErrInvalidToken
 	}
 	lookup := base64.RawURLEncoding.EncodeToString(plaintext[:8])
 	secret := plaintext[8:]
 
 	var found []byte
-	var expires sql.NullInt64
-	var user string
+	var expires, issuedAt, lastUsedAt, lifetime sql.NullInt64
+	var info TokenInfo
+	var scopes, ownerStatus string
 
-	err := t.sqler.QueryRowContext(ctx, "select salted_token, user, expires_at_unixms from dt_token_set where token_id = ?", lookup).Scan(&found, &user, &expires)
+	err := t.sqler.QueryRowContext(ctx, `select t.salted_token, t.user, t.description, t.expires_at_unixms, t.scopes,
+			t.issued_at_unixms, t.last_used_at_unixms, t.last_used_ip, t.use_count, t.hash_scheme, t.bound_key,
+			t.rotated_to, t.lifetime_ms, coalesce(u.status, ?)
+		from dt_token_set t left join dt_users u on u.user_id = t.user
+		where t.token_id = ?`, string(UserActive), lookup).
+		Scan(&found, &info.Owner, &info.Description, &expires, &scopes,
+			&issuedAt, &lastUsedAt, &info.LastUsedIP, &info.UseCount, &info.HashScheme, &info.BoundKey,
+			&info.RotatedTo, &lifetime, &ownerStatus)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			slog.Error("Unable to read tokens from database", "err", err)
 		}
-		return false, "", ErrInvalidToken
+		return TokenInfo{}, ErrInvalidToken
 	}
 
 	now := time.Now().UnixMilli()
-	if expires.Valid && now > expires.Int64 {
-		return false, "", ErrInvalidToken
+	if expires.Valid && now >= expires.Int64 {
+		return TokenInfo{}, ErrInvalidToken
+	}
+	if UserStatus(ownerStatus) != UserActive {
+		slog.Info("Token of an inactive user", "lookup", lookup, "owner", info.Owner, "status", ownerStatus)
+		return TokenInfo{}, ErrInvalidToken
 	}
 
-	err = bcrypt.CompareHashAndPassword(found, secret)
+	scheme, err := parseHashScheme(info.HashScheme)
+	if err != nil {
+		slog.Error("Token with an invalid hash scheme", "lookup", lookup, "err", err)
+		return TokenInfo{}, ErrInvalidToken
+	}
+	err = scheme.verify(found, secret)
 	if err != nil {
 		slog.Info("Failed authentication attempt", "lookup", lookup)
-		return false, "", ErrInvalidToken
+		return TokenInfo{}, ErrInvalidToken
+	}
+	if scheme.weakerThan(t.policy) {
+		if err := t.rehash(ctx, lookup, secret); err != nil {
+			// the token is still valid, it will be rehashed next time
+			slog.Error("Unable to rehash token", "lookup", lookup, "err", err)
+		} else {
+			slog.Info("Token rehashed", "lookup", lookup, "from", info.HashScheme, "to", t.policy.String())
+			info.HashScheme = t.policy.String()
+		}
 	}
-	return true, user, nil
+	info.ID = lookup
+	info.Scopes = strings.Fields(scopes)
+	setTimes(&info, expires, issuedAt, lastUsedAt)
+	if lifetime.Valid {
+		info.Lifetime = time.Duration(lifetime.Int64) * time.Millisecond
+	}
+	return info, nil
 }
 
-func (t *tokenOps) Issue(ctx context.Context, user, description string, ttl time.Duration) (plaintext *[32]byte, err error) {
+func setTimes(info *TokenInfo, expires, issuedAt, lastUsedAt sql.NullInt64) {
+	if expires.Valid {
+		info.ExpiresAt = monads.Some(time.UnixMilli(expires.Int64))
+	}
+	if issuedAt.Valid && issuedAt.Int64 > 0 {
+		info.IssuedAt = time.UnixMilli(issuedAt.Int64)
+	}
+	if lastUsedAt.Valid {
+		info.LastUsedAt = monads.Some(time.UnixMilli(lastUsedAt.Int64))
+	}
+}
+
+func (t *tokenOps) rehash(ctx context.Context, id string, secret []byte) error {
+	salted, err := t.policy.hash(secret)
+	if err != nil {
+		return err
+	}
+	_, err = t.sqler.ExecContext(ctx, `
+		update dt_token_set set
+			salted_token = ?,
+			hash_scheme = ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where token_id = ?`, salted, t.policy.String(), t.clock.ts.UnixMilli(), t.clock.trid, id)
+	return err
+}
+
+// Touch records that the token with the given id was just used by clientIP
+func (t *tokenOps) Touch(ctx context.Context, id, clientIP string) error {
+	return t.RecordUses(ctx, id, clientIP, 1)
+}
+
+func (t *tokenOps) RecordUses(ctx context.Context, id, clientIP string, uses int64) error {
+	_, err := t.sqler.ExecContext(ctx, `
+		update dt_token_set set
+			last_used_at_unixms = ?,
+			last_used_ip = ?,
+			use_count = use_count + ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where token_id = ?`, time.Now().UnixMilli(), clientIP, uses, t.clock.ts.UnixMilli(), t.clock.trid, id)
+	return err
+}
+
+// ExpireAt makes the token with the given id expire at the given time,
+// tokens which would expire earlier are kept as they are.
+func (t *tokenOps) ExpireAt(ctx context.Context, id string, at time.Time) error {
+	_, err := t.sqler.ExecContext(ctx, `
+		update dt_token_set set
+			expires_at_unixms = ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where token_id = ?
+			and (expires_at_unixms is null or expires_at_unixms > ?)`,
+		at.UnixMilli(), t.clock.ts.UnixMilli(), t.clock.trid, id, at.UnixMilli())
+	return err
+}
+
+func (t *tokenOps) Bind(ctx context.Context, id, fingerprint string) error {
+	res, err := t.sqler.ExecContext(ctx, `
+		update dt_token_set set
+			bound_key = ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where token_id = ?`, fingerprint, t.clock.ts.UnixMilli(), t.clock.trid, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (t *tokenOps) MarkRotated(ctx context.Context, id, successor string) error {
+	res, err := t.sqler.ExecContext(ctx, `
+		update dt_token_set set
+			rotated_to = ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where token_id = ? and rotated_to = ''`, successor, t.clock.ts.UnixMilli(), t.clock.trid, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTokenRotated
+	}
+	return nil
+}
+
+// ExpireIdle expires active tokens which were not used (or issued, if never used)
+// in the last idle period, returns how many tokens were expired.
+func (t *tokenOps) ExpireIdle(ctx context.Context, idle time.Duration) (int64, error) {
+	now := time.Now()
+	res, err := t.sqler.ExecContext(ctx, `
+		update dt_token_set set
+			expires_at_unixms = ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where coalesce(last_used_at_unixms, issued_at_unixms) < ?
+			and (expires_at_unixms is null or expires_at_unixms > ?)`,
+		now.UnixMilli(), t.clock.ts.UnixMilli(), t.clock.trid, now.Add(-idle).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (t *tokenOps) Issue(ctx context.Context, user, description string, ttl time.Duration, scopes ...string) (plaintext *[32]byte, err error) {
 	var idAndSecret [32]byte
 	_, err = rand.Read(idAndSecret[:])
 	if err != nil {
 		return
 	}
-	lookupID := idAndSecret[:8]
-	secret := idAndSecret[8:]
-	salted, err := bcrypt.GenerateFromPassword(secret, bcrypt.DefaultCost)
+	err = t.Put(ctx, &idAndSecret, user, description, ttl, scopes...)
 	if err != nil {
 		return
 	}
+	plaintext = &idAndSecret
+	return
+}
+
+// Put stores a token generated by the caller, the first 8 bytes are used as its ID.
+// Scopes cannot contain spaces. The user is created if needed, see UserOps.Ensure.
+func (t *tokenOps) Put(ctx context.Context, plaintext *[32]byte, user, description string, ttl time.Duration, scopes ...string) error {
+	for _, s := range scopes {
+		if s == "" || strings.ContainsAny(s, " \t\n") {
+			return fmt.Errorf("invalid token scope: %q", s)
+		}
+	}
+	lookupID := plaintext[:8]
+	secret := plaintext[8:]
+	salted, err := t.policy.hash(secret)
+	if err != nil {
+		return err
+	}
 	lookup := base64.RawURLEncoding.EncodeToString(lookupID[:8])
 
-	var expire sql.NullInt64
+	if err := (&userOps{sqler: t.sqler, clock: t.clock}).Ensure(ctx, user); err != nil {
+		return err
+	}
+
+	var expire, lifetime sql.NullInt64
 	if ttl > 0 {
 		expire.Int64 = time.Now().Add(ttl).UnixMilli()
 		expire.Valid = true
+		lifetime.Int64 = ttl.Milliseconds()
+		lifetime.Valid = true
 	}
 
 	_, err = t.sqler.ExecContext(ctx, `
@@ -106,6 +359,10 @@ func (t *tokenOps) Issue(ctx context.Context, user, description string, ttl time
 			user,
 			description,
 			expires_at_unixms,
+			scopes,
+			issued_at_unixms,
+			hash_scheme,
+			lifetime_ms,
 			clk_updated_at_unixms,
 			clk_trid
 		) values (
@@ -115,17 +372,18 @@ func (t *tokenOps) Issue(ctx context.Context, user, description string, ttl time
 			?,
 			?,
 			?,
+			?,
+			?,
+			?,
+			?,
 			?
-		)`, lookup, salted, user, description, expire, t.clock.ts, t.clock.trid)
-	if err != nil {
-		return
-	}
-	plaintext = &idAndSecret
-	return
+		)`, lookup, salted, user, description, expire, strings.Join(scopes, " "), time.Now().UnixMilli(), t.policy.String(), lifetime, t.clock.ts.UnixMilli(), t.clock.trid)
+	return err
 }
 
 func (t *tokenOps) List(ctx context.Context, user string, onlyActive bool) ([]TokenInfo, error) {
-	cmd := `select token_id, user, description, expires_at_unixms
+	cmd := `select token_id, user, description, expires_at_unixms, scopes,
+			issued_at_unixms, last_used_at_unixms, last_used_ip, use_count, hash_scheme, bound_key
 		from vw_token_set where user = ?`
 	if onlyActive {
 		cmd = fmt.Sprintf("%v and is_active", cmd)
@@ -134,21 +392,122 @@ func (t *tokenOps) List(ctx context.Context, user string, onlyActive bool) ([]To
 	if err != nil {
 		return nil, err
 	}
+	return scanTokens(rows)
+}
+
+// where builds the condition for the filter, ignoring pagination
+func (f TokenFilter) where() (string, []any, error) {
+	conds := []string{"1 = 1"}
+	var args []any
+	if f.Owner != "" {
+		conds = append(conds, "user = ?")
+		args = append(args, f.Owner)
+	}
+	if f.Description != "" {
+		conds = append(conds, "description = ?")
+		args = append(args, f.Description)
+	}
+	switch f.Status {
+	case "":
+	case TokenActive:
+		conds = append(conds, "is_active")
+	case TokenExpired:
+		conds = append(conds, "not is_active")
+	default:
+		return "", nil, fmt.Errorf("invalid token status %q, use %v or %v", f.Status, TokenActive, TokenExpired)
+	}
+	if !f.ExpiresAfter.IsZero() {
+		conds = append(conds, "(expires_at_unixms is null or expires_at_unixms > ?)")
+		args = append(args, f.ExpiresAfter.UnixMilli())
+	}
+	return strings.Join(conds, " and "), args, nil
+}
+
+func (t *tokenOps) Search(ctx context.Context, filter TokenFilter) ([]TokenInfo, error) {
+	where, args, err := filter.where()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case filter.Limit <= 0:
+		filter.Limit = DefaultTokenPageSize
+	case filter.Limit > MaxTokenPageSize:
+		filter.Limit = MaxTokenPageSize
+	}
+	args = append(args, filter.After, filter.Limit)
+	rows, err := t.sqler.QueryContext(ctx, fmt.Sprintf(`select token_id, user, description, expires_at_unixms, scopes,
+			issued_at_unixms, last_used_at_unixms, last_used_ip, use_count, hash_scheme, bound_key
+		from vw_token_set where %v and token_id > ?
+		order by token_id
+		limit ?`, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanTokens(rows)
+}
+
+func (t *tokenOps) Owners(ctx context.Context) ([]string, error) {
+	rows, err := t.sqler.QueryContext(ctx, "select distinct user from dt_token_set order by user")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+		out = append(out, owner)
+	}
+	return out, rows.Err()
+}
+
+func (t *tokenOps) RevokeWhere(ctx context.Context, filter TokenFilter) (int64, error) {
+	filter.Status = TokenActive
+	where, args, err := filter.where()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixMilli()
+	args = append([]any{now, t.clock.ts.UnixMilli(), t.clock.trid}, args...)
+	res, err := t.sqler.ExecContext(ctx, fmt.Sprintf(`
+		update dt_token_set set
+			expires_at_unixms = ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where token_id in (select token_id from vw_token_set where %v)`, where), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (t *tokenOps) Purge(ctx context.Context, olderThan time.Duration) (int64, error) {
+	res, err := t.sqler.ExecContext(ctx, "delete from dt_token_set where expires_at_unixms <= ?", time.Now().Add(-olderThan).UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func scanTokens(rows *sql.Rows) ([]TokenInfo, error) {
 	defer rows.Close()
 	var out []TokenInfo
 	for rows.Next() {
 		var ti TokenInfo
-		var unixTime sql.NullInt64
-		err := rows.Scan(&ti.ID, &ti.Owner, &ti.Description, &unixTime)
+		var expires, issuedAt, lastUsedAt sql.NullInt64
+		var scopes string
+		err := rows.Scan(&ti.ID, &ti.Owner, &ti.Description, &expires, &scopes,
+			&issuedAt, &lastUsedAt, &ti.LastUsedIP, &ti.UseCount, &ti.HashScheme, &ti.BoundKey)
 		if err != nil {
 			return nil, err
 		}
-		if unixTime.Valid {
-			ti.ExpiresAt = monads.Some(time.UnixMilli(unixTime.Int64))
-		}
+		ti.Scopes = strings.Fields(scopes)
+		setTimes(&ti, expires, issuedAt, lastUsedAt)
 		out = append(out, ti)
 	}
-	return out, nil
+	return out, rows.Err()
 }
 
 func (t *tokenOps) Remove(ctx context.Context, id string) error {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"reflect"
 	"testing"
 	"time"
 
@@ -59,3 +60,325 @@ func TestTokens(t *testing.T) {
 		t.Fatal("System authorized a random key as valid!")
 	}
 }
+
+func TestPutToken(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+
+	var token [32]byte
+	rand.Read(token[:])
+	tks := ops.Tokens()
+	if err := tks.Put(context.Background(), &token, "admin", "initial", -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tks.Put(context.Background(), &token, "admin", "duplicated", -1); err == nil {
+		t.Fatal("Tokens with the same ID should be rejected")
+	}
+	if valid, user, err := tks.Valid(context.Background(), token[:]); !valid || err != nil || user != "admin" {
+		t.Fatal("Token should be valid", valid, user, err)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+
+	tks := ops.Tokens()
+	token, err := tks.Issue(context.Background(), "random-user", "scoped", -1, "known-hosts:read", "keys:register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := tks.Check(context.Background(), token[:])
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Owner != "random-user" || !reflect.DeepEqual(info.Scopes, []string{"known-hosts:read", "keys:register"}) {
+		t.Fatalf("Unexpected token info: %#v", info)
+	}
+	if _, err := tks.Issue(context.Background(), "random-user", "invalid", -1, "has space"); err == nil {
+		t.Fatal("Scopes with spaces should be rejected")
+	}
+}
+
+func TestTokenUsage(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+
+	ctx := context.Background()
+	tks := ops.Tokens()
+	used, err := tks.Issue(ctx, "random-user", "used", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := tks.Issue(ctx, "random-user", "idle", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 10)
+	cutoff := time.Now()
+	for i := 0; i < 2; i++ {
+		if valid, _, err := tks.Valid(ctx, used[:]); !valid || err != nil {
+			t.Fatal("Token should be valid", err)
+		}
+	}
+	info, err := tks.Check(ctx, used[:])
+	if err != nil {
+		t.Fatal(err)
+	} else if info.UseCount != 2 || !info.LastUsedAt.Valid() {
+		t.Fatalf("Usage was not recorded: %#v", info)
+	}
+	if err := tks.RecordUses(ctx, info.ID, "127.0.0.1", 3); err != nil {
+		t.Fatal(err)
+	} else if info, err := tks.Check(ctx, used[:]); err != nil {
+		t.Fatal(err)
+	} else if info.UseCount != 5 || info.LastUsedIP != "127.0.0.1" {
+		t.Fatalf("Batched uses were not recorded: %#v", info)
+	}
+
+	if n, err := tks.ExpireIdle(ctx, time.Since(cutoff)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("Only the idle token should have expired, got %v", n)
+	}
+	if _, err := tks.Check(ctx, idle[:]); !errors.Is(err, store.ErrInvalidToken) {
+		t.Fatal("Idle token should have expired", err)
+	}
+	active, err := tks.List(ctx, "random-user", true)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(active) != 1 || active[0].Description != "used" {
+		t.Fatalf("Unexpected active tokens: %#v", active)
+	}
+}
+
+func TestTokenRehash(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+
+	ctx := context.Background()
+	tks := ops.Tokens()
+	if err := tks.SetHashPolicy(store.HashPolicy{Algorithm: store.HashBcrypt, BcryptCost: 4}); err != nil {
+		t.Fatal(err)
+	}
+	token, err := tks.Issue(ctx, "random-user", "weak", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argon := store.HashPolicy{Algorithm: store.HashArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	if err := tks.SetHashPolicy(argon); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{argon.String(), argon.String()} {
+		info, err := tks.Check(ctx, token[:])
+		if err != nil {
+			t.Fatal(err)
+		} else if info.HashScheme != expected {
+			t.Fatalf("Token should use %v, got %v", expected, info.HashScheme)
+		}
+	}
+
+	// a weaker policy does not downgrade existing tokens
+	if err := tks.SetHashPolicy(store.HashPolicy{Algorithm: store.HashArgon2id, Argon2Time: 1, Argon2Memory: 512, Argon2Threads: 1}); err != nil {
+		t.Fatal(err)
+	} else if info, err := tks.Check(ctx, token[:]); err != nil {
+		t.Fatal(err)
+	} else if info.HashScheme != argon.String() {
+		t.Fatalf("Token should not be downgraded, got %v", info.HashScheme)
+	}
+
+	if err := tks.SetHashPolicy(store.HashPolicy{Algorithm: "md5"}); err == nil {
+		t.Fatal("Unknown algorithms should be rejected")
+	}
+}
+
+func TestTokenSearchAndRevoke(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+
+	ctx := context.Background()
+	tks := ops.Tokens()
+	tks.SetHashPolicy(store.HashPolicy{Algorithm: store.HashBcrypt, BcryptCost: 4})
+	for _, v := range []struct {
+		owner, description string
+		ttl                time.Duration
+	}{
+		{"alice", "laptop", -1},
+		{"alice", "ci", time.Hour},
+		{"bob", "laptop", time.Hour * 48},
+		{"bob", "old", time.Millisecond},
+	} {
+		if _, err := tks.Issue(ctx, v.owner, v.description, v.ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 2)
+
+	if owners, err := tks.Owners(ctx); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(owners, []string{"alice", "bob"}) {
+		t.Fatalf("Unexpected owners: %v", owners)
+	}
+
+	var all []store.TokenInfo
+	filter := store.TokenFilter{Limit: 3}
+	for {
+		page, err := tks.Search(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(page) == 0 {
+			break
+		}
+		all = append(all, page...)
+		filter.After = page[len(page)-1].ID
+	}
+	if len(all) != 4 {
+		t.Fatalf("Pagination should return every token, got %v", len(all))
+	}
+	if expired, err := tks.Search(ctx, store.TokenFilter{Status: store.TokenExpired}); err != nil {
+		t.Fatal(err)
+	} else if len(expired) != 1 || expired[0].Description != "old" {
+		t.Fatalf("Unexpected expired tokens: %#v", expired)
+	}
+
+	if n, err := tks.RevokeWhere(ctx, store.TokenFilter{ExpiresAfter: time.Now().Add(time.Hour * 24)}); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("Only long lived tokens should be revoked, got %v", n)
+	}
+	if n, err := tks.RevokeWhere(ctx, store.TokenFilter{Owner: "alice", Description: "ci"}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("Only alice/ci should be revoked, got %v", n)
+	}
+	if active, err := tks.Search(ctx, store.TokenFilter{Status: store.TokenActive}); err != nil {
+		t.Fatal(err)
+	} else if len(active) != 0 {
+		t.Fatalf("Every token should be revoked, got %#v", active)
+	}
+
+	if n, err := tks.Purge(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("Tokens expired recently should be kept, got %v", n)
+	}
+	if n, err := tks.Purge(ctx, 0); err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Fatalf("Every expired token should be purged, got %v", n)
+	}
+}
+
+func TestTokenBinding(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+
+	ctx := context.Background()
+	tks := ops.Tokens()
+	tks.SetHashPolicy(store.HashPolicy{Algorithm: store.HashBcrypt, BcryptCost: 4})
+	token, err := tks.Issue(ctx, "random-user", "server", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := tks.Check(ctx, token[:])
+	if err != nil {
+		t.Fatal(err)
+	} else if info.BoundKey != "" {
+		t.Fatalf("New tokens should not be bound, got %v", info.BoundKey)
+	}
+
+	const fingerprint = "SHA256:6EHGjKg5vx6bPKlgofVf6fUtQWkX/manSH8aSwjuU1I"
+	if err := tks.Bind(ctx, info.ID, fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := tks.Check(ctx, token[:]); err != nil {
+		t.Fatal(err)
+	} else if info.BoundKey != fingerprint {
+		t.Fatalf("Token should be bound to %v, got %q", fingerprint, info.BoundKey)
+	}
+	if list, err := tks.List(ctx, "random-user", true); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 || list[0].BoundKey != fingerprint {
+		t.Fatalf("Binding should be listed, got %#v", list)
+	}
+
+	if err := tks.Bind(ctx, info.ID, ""); err != nil {
+		t.Fatal(err)
+	} else if info, err := tks.Check(ctx, token[:]); err != nil {
+		t.Fatal(err)
+	} else if info.BoundKey != "" {
+		t.Fatalf("Binding should be removed, got %v", info.BoundKey)
+	}
+
+	if err := tks.Bind(ctx, "missing", fingerprint); !errors.Is(err, store.ErrInvalidToken) {
+		t.Fatalf("Binding an unknown token should fail with %v, got %v", store.ErrInvalidToken, err)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+
+	ctx := context.Background()
+	tks := ops.Tokens()
+	token, err := tks.Issue(ctx, "random-user", "server", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := tks.Check(ctx, token[:])
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Lifetime != time.Hour || info.RotatedTo != "" {
+		t.Fatalf("Token should last an hour and not be rotated, got %v and %q", info.Lifetime, info.RotatedTo)
+	}
+	if err := tks.ExpireAt(ctx, info.ID, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tks.MarkRotated(ctx, info.ID, "successor"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := tks.Check(ctx, token[:]); err != nil {
+		t.Fatal(err)
+	} else if info.Lifetime != time.Hour || info.RotatedTo != "successor" {
+		t.Fatalf("Lifetime should not change and rotation should be recorded, got %v and %q", info.Lifetime, info.RotatedTo)
+	}
+	if err := tks.MarkRotated(ctx, info.ID, "other"); !errors.Is(err, store.ErrTokenRotated) {
+		t.Fatalf("Second rotation should fail with %v, got %v", store.ErrTokenRotated, err)
+	}
+
+	forever, err := tks.Issue(ctx, "random-user", "forever", -1)
+	if err != nil {
+		t.Fatal(err)
+	} else if info, err := tks.Check(ctx, forever[:]); err != nil {
+		t.Fatal(err)
+	} else if info.Lifetime != 0 {
+		t.Fatalf("Tokens which never expire should not have a lifetime, got %v", info.Lifetime)
+	}
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type (
+	userOps struct {
+		sqler Ops
+
+		clock txclock
+	}
+
+	// User owns keys, tokens and key registrations
+	User struct {
+		ID          string
+		DisplayName string
+		Status      UserStatus
+		Metadata    map[string]string
+		CreatedAt   time.Time
+	}
+
+	UserStatus string
+
+	UserOps interface {
+		// Ensure creates an active user with the given id, existing users are not changed
+		Ensure(ctx context.Context, id string) error
+		// Put creates or updates the display name and metadata of the user,
+		// the status of existing users is kept
+		Put(ctx context.Context, user User) error
+		Get(ctx context.Context, id string) (User, error)
+		List(ctx context.Context) ([]User, error)
+		SetStatus(ctx context.Context, id string, status UserStatus) error
+		// Active returns false if the user exists and is not active, unknown users are active
+		Active(ctx context.Context, id string) (bool, error)
+	}
+)
+
+const (
+	UserActive    = UserStatus("active")
+	UserSuspended = UserStatus("suspended")
+)
+
+func (s UserStatus) Validate() error {
+	switch s {
+	case UserActive, UserSuspended:
+		return nil
+	}
+	return fmt.Errorf("invalid user status %q, use %v or %v", s, UserActive, UserSuspended)
+}
+
+func (u *userOps) Ensure(ctx context.Context, id string) error {
+	if id == "" {
+		return errors.New("user id cannot be empty")
+	}
+	_, err := u.sqler.ExecContext(ctx, `
+		insert or ignore into dt_users (
+			user_id,
+			created_at_unixms,
+			clk_updated_at_unixms,
+			clk_trid
+		) values (?, ?, ?, ?)`, id, time.Now().UnixMilli(), u.clock.ts.UnixMilli(), u.clock.trid)
+	return err
+}
+
+func (u *userOps) Put(ctx context.Context, user User) error {
+	if user.ID == "" {
+		return errors.New("user id cannot be empty")
+	}
+	if user.Metadata == nil {
+		user.Metadata = map[string]string{}
+	}
+	metadata, err := json.Marshal(user.Metadata)
+	if err != nil {
+		return err
+	}
+	if err := u.Ensure(ctx, user.ID); err != nil {
+		return err
+	}
+	_, err = u.sqler.ExecContext(ctx, `
+		update dt_users set
+			display_name = ?,
+			metadata = ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where user_id = ?`, user.DisplayName, string(metadata), u.clock.ts.UnixMilli(), u.clock.trid, user.ID)
+	return err
+}
+
+func (u *userOps) Get(ctx context.Context, id string) (User, error) {
+	rows, err := u.sqler.QueryContext(ctx, `select user_id, display_name, status, metadata, created_at_unixms
+		from dt_users where user_id = ?`, id)
+	if err != nil {
+		return User{}, err
+	}
+	users, err := scanUsers(rows)
+	if err != nil {
+		return User{}, err
+	} else if len(users) == 0 {
+		return User{}, fmt.Errorf("user %v: %w", id, errNotFound)
+	}
+	return users[0], nil
+}
+
+func (u *userOps) List(ctx context.Context) ([]User, error) {
+	rows, err := u.sqler.QueryContext(ctx, `select user_id, display_name, status, metadata, created_at_unixms
+		from dt_users order by user_id`)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsers(rows)
+}
+
+func (u *userOps) SetStatus(ctx context.Context, id string, status UserStatus) error {
+	if err := status.Validate(); err != nil {
+		return err
+	}
+	res, err := u.sqler.ExecContext(ctx, `
+		update dt_users set
+			status = ?,
+			clk_updated_at_unixms = ?,
+			clk_trid = ?
+		where user_id = ?`, string(status), u.clock.ts.UnixMilli(), u.clock.trid, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("user %v: %w", id, errNotFound)
+	}
+	return nil
+}
+
+func (u *userOps) Active(ctx context.Context, id string) (bool, error) {
+	var status string
+	err := u.sqler.QueryRowContext(ctx, "select status from dt_users where user_id = ?", id).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return UserStatus(status) == UserActive, nil
+}
+
+func scanUsers(rows *sql.Rows) ([]User, error) {
+	defer rows.Close()
+	var out []User
+	for rows.Next() {
+		var u User
+		var status, metadata string
+		var createdAt int64
+		if err := rows.Scan(&u.ID, &u.DisplayName, &status, &metadata, &createdAt); err != nil {
+			return nil, err
+		}
+		u.Status = UserStatus(status)
+		u.CreatedAt = time.UnixMilli(createdAt)
+		if err := json.Unmarshal([]byte(metadata), &u.Metadata); err != nil {
+			return nil, fmt.Errorf("invalid metadata for user %v: %w", u.ID, err)
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,75 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/andrebq/vandrare/internal/store"
+)
+
+func TestUsers(t *testing.T) {
+	st, err := store.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := st.Ops(false)
+	defer ops.Close()
+
+	ctx := context.Background()
+	users := ops.Users()
+	if err := users.Put(ctx, store.User{ID: "alice", DisplayName: "Alice", Metadata: map[string]string{"team": "infra"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Ensure(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := users.Get(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	} else if alice.DisplayName != "Alice" || alice.Status != store.UserActive || !reflect.DeepEqual(alice.Metadata, map[string]string{"team": "infra"}) {
+		t.Fatalf("Ensure should not change existing users, got %#v", alice)
+	}
+	if _, err := users.Get(ctx, "bob"); !store.IsNotFound(err) {
+		t.Fatalf("Unknown users should not be found, got %v", err)
+	}
+
+	// issuing a token creates its owner
+	tks := ops.Tokens()
+	tks.SetHashPolicy(store.HashPolicy{Algorithm: store.HashBcrypt, BcryptCost: 4})
+	token, err := tks.Issue(ctx, "bob", "laptop", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, err := users.List(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 2 || list[0].ID != "alice" || list[1].ID != "bob" {
+		t.Fatalf("Unexpected users %#v", list)
+	}
+
+	if err := users.SetStatus(ctx, "bob", store.UserSuspended); err != nil {
+		t.Fatal(err)
+	}
+	if active, err := users.Active(ctx, "bob"); err != nil || active {
+		t.Fatalf("Suspended users should not be active, got %v %v", active, err)
+	}
+	if _, err := tks.Check(ctx, token[:]); !errors.Is(err, store.ErrInvalidToken) {
+		t.Fatalf("Tokens of suspended users should be invalid, got %v", err)
+	}
+	if err := users.SetStatus(ctx, "bob", store.UserActive); err != nil {
+		t.Fatal(err)
+	} else if _, err := tks.Check(ctx, token[:]); err != nil {
+		t.Fatalf("Tokens should be valid after the user is reactivated, got %v", err)
+	}
+
+	if err := users.SetStatus(ctx, "carol", store.UserSuspended); !store.IsNotFound(err) {
+		t.Fatalf("Unknown users cannot be suspended, got %v", err)
+	}
+	if err := users.SetStatus(ctx, "bob", "banned"); err == nil {
+		t.Fatal("Invalid status should be rejected")
+	}
+	if active, err := users.Active(ctx, "carol"); err != nil || !active {
+		t.Fatalf("Unknown users should be active, got %v %v", active, err)
+	}
+}